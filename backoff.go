@@ -0,0 +1,81 @@
+package rabbitmq
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// BackoffOptions describe how long to wait between reconnection attempts.
+// The first attempt waits Initial, and every following attempt waits Multiplier
+// times longer than the previous one, up to Max. A Max of zero means there is no limit.
+// Jitter randomizes each wait between half and all of its duration so that
+// many clients don't reconnect at the same time
+type BackoffOptions struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     bool
+	// clock waits for the backoff, the tests replace it to control the time
+	clock clock
+}
+
+// getDefaultBackoffOptions describes the backoff used when no options are provided
+func getDefaultBackoffOptions() BackoffOptions {
+	return BackoffOptions{
+		Initial:    time.Second,
+		Max:        0,
+		Multiplier: 2,
+		Jitter:     false,
+	}
+}
+
+// withDefaults fills in the defaults for values that weren't provided or are invalid
+func (options BackoffOptions) withDefaults() BackoffOptions {
+	defaultOptions := getDefaultBackoffOptions()
+	if options.Initial <= 0 {
+		options.Initial = defaultOptions.Initial
+	}
+	if options.Multiplier < 1 {
+		options.Multiplier = defaultOptions.Multiplier
+	}
+	if options.clock == nil {
+		options.clock = realClock{}
+	}
+	return options
+}
+
+// jitterRand is seeded separately from the global source so that
+// different processes don't produce the same jitter
+var jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+var jitterRandMux = &sync.Mutex{}
+
+// duration returns how long to wait before the given attempt, starting at 1
+func (options BackoffOptions) duration(attempt int) time.Duration {
+	backoffTime := float64(options.Initial) * math.Pow(options.Multiplier, float64(attempt-1))
+	if options.Max > 0 && backoffTime > float64(options.Max) {
+		backoffTime = float64(options.Max)
+	}
+	if backoffTime > math.MaxInt64 {
+		backoffTime = math.MaxInt64
+	}
+	if options.Jitter {
+		jitterRandMux.Lock()
+		backoffTime = backoffTime/2 + jitterRand.Float64()*backoffTime/2
+		jitterRandMux.Unlock()
+	}
+	return time.Duration(backoffTime)
+}
+
+// clock waits for the reconnection backoff, realClock is used outside of tests,
+// which replace it with withConsumerOptionsClock or withPublisherOptionsClock
+type clock interface {
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
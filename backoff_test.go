@@ -0,0 +1,113 @@
+package rabbitmq
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samuelkuklis/go-rabbitmq/rabbitmqtest"
+)
+
+// fakeClock records the waits and lets them elapse right away, now is the time they end
+type fakeClock struct {
+	mux   *sync.Mutex
+	now   time.Time
+	waits []time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{mux: &sync.Mutex{}, now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.now = c.now.Add(d)
+	c.waits = append(c.waits, d)
+	elapsed := make(chan time.Time, 1)
+	elapsed <- c.now
+	return elapsed
+}
+
+func (c *fakeClock) Waits() []time.Duration {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return append([]time.Duration(nil), c.waits...)
+}
+
+func TestBackoffOptionsDuration(t *testing.T) {
+	tests := []struct {
+		name    string
+		options BackoffOptions
+		want    []time.Duration
+	}{
+		{
+			name:    "defaults",
+			options: BackoffOptions{},
+			want:    []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second},
+		},
+		{
+			name:    "max",
+			options: BackoffOptions{Initial: 100 * time.Millisecond, Max: 250 * time.Millisecond, Multiplier: 2},
+			want:    []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 250 * time.Millisecond, 250 * time.Millisecond},
+		},
+		{
+			name:    "constant",
+			options: BackoffOptions{Initial: time.Second, Multiplier: 1},
+			want:    []time.Duration{time.Second, time.Second, time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := tt.options.withDefaults()
+			for i, want := range tt.want {
+				got := options.duration(i + 1)
+				if got != want {
+					t.Errorf("attempt %d: got %v, want %v", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffOptionsDurationJitter(t *testing.T) {
+	options := BackoffOptions{Initial: time.Second, Multiplier: 2, Jitter: true}.withDefaults()
+	for i := 0; i < 100; i++ {
+		got := options.duration(2)
+		if got < time.Second || got > 2*time.Second {
+			t.Fatalf("got %v, want between 1s and 2s", got)
+		}
+	}
+}
+
+func TestConsumerReconnectBackoff(t *testing.T) {
+	broker := rabbitmqtest.NewBroker()
+	defer broker.Close()
+	clock := newFakeClock()
+	consumer, err := NewConsumer(broker.URL(), broker.Config(),
+		WithConsumerOptionsReconnectBackoff(time.Second, 5*time.Second, 2),
+		WithConsumerOptionsMaxReconnectAttempts(5),
+		withConsumerOptionsClock(clock),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// dialing the closed broker fails, so every attempt is made
+	broker.Close()
+	select {
+	case err := <-consumer.NotifyClosed():
+		if err == nil {
+			t.Error("got no error after giving up reconnecting")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer didn't give up reconnecting")
+	}
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	got := clock.Waits()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got waits %v, want %v", got, want)
+	}
+}
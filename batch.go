@@ -0,0 +1,221 @@
+package rabbitmq
+
+import (
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// defaultBatchAckInterval is how often acks are flushed when no interval is given
+const defaultBatchAckInterval = time.Second
+
+// WithConsumeOptionsBatchAck returns a function that makes the consumer ack deliveries in batches,
+// with the multiple flag set on the highest delivery tag below which every delivery was handled.
+// The acks are sent once size deliveries in a row are handled, and every interval otherwise,
+// a zero interval defaults to 1 second.
+//
+// Deliveries that are nacked, rejected or retried are settled right away on their own, so they don't
+// hold back the deliveries after them. A delivery that is still being handled does, until it's settled.
+// Acks that aren't sent yet when the channel is lost are lost too and the messages are redelivered,
+// so handlers must be idempotent.
+// The multiple flag acks every delivery of the channel up to the tag, so it must not be used on a
+// consumer that consumes from several queues. The prefetch count should be larger than size,
+// or deliveries only get acked every interval
+func WithConsumeOptionsBatchAck(size int, interval time.Duration) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.BatchAckSize = size
+		options.BatchAckInterval = interval
+	}
+}
+
+// batchAcknowledger holds back the acks of the deliveries of a channel
+// and sends them with the multiple flag once they're contiguous
+type batchAcknowledger struct {
+	amqp.Acknowledger
+	logger   fieldLogger
+	size     int
+	interval time.Duration
+
+	mux *sync.Mutex
+	// outstanding are the delivery tags that aren't acked or settled on their own yet, in order,
+	// handled are the ones of them that were acked by the handler
+	outstanding []uint64
+	handled     map[uint64]bool
+	// drained is set once the channel delivers no more messages
+	drained  bool
+	stopped  chan struct{}
+	stopOnce *sync.Once
+	// closed is closed with the channel, the deliveries that aren't settled yet can't be anymore.
+	// It's buffered for the single error amqp sends on it, so it needn't be drained
+	closed <-chan *amqp.Error
+}
+
+func newBatchAcknowledger(channel *amqp.Channel, logger fieldLogger, options ConsumeOptions) *batchAcknowledger {
+	interval := options.BatchAckInterval
+	if interval <= 0 {
+		interval = defaultBatchAckInterval
+	}
+	return &batchAcknowledger{
+		Acknowledger: channel,
+		logger:       logger,
+		size:         options.BatchAckSize,
+		interval:     interval,
+		mux:          &sync.Mutex{},
+		handled:      map[uint64]bool{},
+		stopped:      make(chan struct{}),
+		stopOnce:     &sync.Once{},
+		closed:       channel.NotifyClose(make(chan *amqp.Error, 1)),
+	}
+}
+
+// track records the deliveries in the order the server sent them and makes them
+// be acked through the batch acknowledger. The returned channel is closed with msgs
+func (acker *batchAcknowledger) track(msgs <-chan amqp.Delivery) <-chan amqp.Delivery {
+	tracked := make(chan amqp.Delivery)
+	go func() {
+		defer close(tracked)
+		for msg := range msgs {
+			acker.mux.Lock()
+			acker.outstanding = append(acker.outstanding, msg.DeliveryTag)
+			acker.mux.Unlock()
+			msg.Acknowledger = acker
+			tracked <- msg
+		}
+		acker.mux.Lock()
+		defer acker.mux.Unlock()
+		acker.drained = true
+		err := acker.flush()
+		if err != nil {
+			acker.logger.Errorf("can't ack messages: %v", err)
+		}
+	}()
+	go acker.run()
+	return tracked
+}
+
+// run flushes the acks every interval until all the deliveries are settled or the channel is closed
+func (acker *batchAcknowledger) run() {
+	ticker := time.NewTicker(acker.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-acker.stopped:
+			return
+		case <-acker.closed:
+			return
+		case <-ticker.C:
+			acker.mux.Lock()
+			err := acker.flush()
+			acker.mux.Unlock()
+			if err != nil {
+				acker.logger.Errorf("can't ack messages: %v", err)
+			}
+		}
+	}
+}
+
+// Ack records the delivery as handled, the ack is sent with the next batch.
+// If multiple is set, every outstanding delivery up to tag is
+func (acker *batchAcknowledger) Ack(tag uint64, multiple bool) error {
+	acker.mux.Lock()
+	defer acker.mux.Unlock()
+	if multiple {
+		for _, outstanding := range acker.outstanding {
+			if outstanding <= tag {
+				acker.handled[outstanding] = true
+			}
+		}
+	} else {
+		acker.handled[tag] = true
+	}
+	if acker.drained || acker.contiguous() >= acker.size {
+		return acker.flush()
+	}
+	return nil
+}
+
+// Nack sends the acks of the batch and then the nack, right away
+func (acker *batchAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	acker.mux.Lock()
+	defer acker.mux.Unlock()
+	err := acker.flush()
+	if err != nil {
+		return err
+	}
+	acker.settle(tag, multiple)
+	err = acker.Acknowledger.Nack(tag, multiple, requeue)
+	acker.stopIfSettled()
+	return err
+}
+
+// Reject sends the acks of the batch and then the reject, right away
+func (acker *batchAcknowledger) Reject(tag uint64, requeue bool) error {
+	acker.mux.Lock()
+	defer acker.mux.Unlock()
+	err := acker.flush()
+	if err != nil {
+		return err
+	}
+	acker.settle(tag, false)
+	err = acker.Acknowledger.Reject(tag, requeue)
+	acker.stopIfSettled()
+	return err
+}
+
+// contiguous returns how many of the first outstanding deliveries were handled.
+// The caller must hold the lock
+func (acker *batchAcknowledger) contiguous() int {
+	n := 0
+	for n < len(acker.outstanding) && acker.handled[acker.outstanding[n]] {
+		n++
+	}
+	return n
+}
+
+// flush acks the handled deliveries up to the first one that isn't. The caller must hold the lock
+func (acker *batchAcknowledger) flush() error {
+	n := acker.contiguous()
+	if n > 0 {
+		tag := acker.outstanding[n-1]
+		err := acker.Acknowledger.Ack(tag, true)
+		if err != nil {
+			// the channel is gone, the deliveries will be redelivered
+			acker.stop()
+			return err
+		}
+		for _, acked := range acker.outstanding[:n] {
+			delete(acker.handled, acked)
+		}
+		acker.outstanding = acker.outstanding[n:]
+	}
+	acker.stopIfSettled()
+	return nil
+}
+
+// settle forgets the deliveries settled on their own. The caller must hold the lock
+func (acker *batchAcknowledger) settle(tag uint64, multiple bool) {
+	outstanding := acker.outstanding[:0]
+	for _, t := range acker.outstanding {
+		if t == tag || (multiple && t < tag) {
+			delete(acker.handled, t)
+			continue
+		}
+		outstanding = append(outstanding, t)
+	}
+	acker.outstanding = outstanding
+}
+
+// stopIfSettled stops the batching once the channel is drained and every delivery
+// is settled. The caller must hold the lock
+func (acker *batchAcknowledger) stopIfSettled() {
+	if acker.drained && len(acker.outstanding) == 0 {
+		acker.stop()
+	}
+}
+
+func (acker *batchAcknowledger) stop() {
+	acker.stopOnce.Do(func() {
+		close(acker.stopped)
+	})
+}
@@ -0,0 +1,127 @@
+package rabbitmq
+
+import "time"
+
+// ConsumeOptionsBuilder gathers consume options through chained calls, as an alternative to
+// listing the option funcs. Build returns an option func that can be passed to StartConsuming
+// along with other ones, the options apply in the order they were given:
+//
+//	options := rabbitmq.NewConsumeOptionsBuilder().
+//		Durable().
+//		Exchange("events", "topic").
+//		Prefetch(50).
+//		Concurrency(10).
+//		Build()
+//	err := consumer.StartConsuming(handler, "my_queue", []string{"events.#"}, options)
+type ConsumeOptionsBuilder struct {
+	optionFuncs []func(*ConsumeOptions)
+}
+
+// NewConsumeOptionsBuilder returns a builder without any option
+func NewConsumeOptionsBuilder() *ConsumeOptionsBuilder {
+	return &ConsumeOptionsBuilder{}
+}
+
+// With adds option funcs, for the options the builder has no method for
+func (builder *ConsumeOptionsBuilder) With(optionFuncs ...func(*ConsumeOptions)) *ConsumeOptionsBuilder {
+	builder.optionFuncs = append(builder.optionFuncs, optionFuncs...)
+	return builder
+}
+
+// Build returns an option func applying all the options of the builder
+func (builder *ConsumeOptionsBuilder) Build() func(*ConsumeOptions) {
+	optionFuncs := append([]func(*ConsumeOptions){}, builder.optionFuncs...)
+	return func(options *ConsumeOptions) {
+		for _, optionFunc := range optionFuncs {
+			optionFunc(options)
+		}
+	}
+}
+
+// Durable is WithConsumeOptionsQueueDurable
+func (builder *ConsumeOptionsBuilder) Durable() *ConsumeOptionsBuilder {
+	return builder.With(WithConsumeOptionsQueueDurable)
+}
+
+// AutoDelete is WithConsumeOptionsQueueAutoDelete
+func (builder *ConsumeOptionsBuilder) AutoDelete() *ConsumeOptionsBuilder {
+	return builder.With(WithConsumeOptionsQueueAutoDelete)
+}
+
+// Exclusive is WithConsumeOptionsQueueExclusive
+func (builder *ConsumeOptionsBuilder) Exclusive() *ConsumeOptionsBuilder {
+	return builder.With(WithConsumeOptionsQueueExclusive)
+}
+
+// Quorum is WithConsumeOptionsQuorumQueue
+func (builder *ConsumeOptionsBuilder) Quorum() *ConsumeOptionsBuilder {
+	return builder.With(WithConsumeOptionsQuorumQueue)
+}
+
+// QueueArg sets an argument used when declaring the queue
+func (builder *ConsumeOptionsBuilder) QueueArg(key string, value interface{}) *ConsumeOptionsBuilder {
+	return builder.With(func(options *ConsumeOptions) {
+		setQueueArg(options, key, value)
+	})
+}
+
+// DeadLetterExchange is WithConsumeOptionsDeadLetterExchange
+func (builder *ConsumeOptionsBuilder) DeadLetterExchange(name string) *ConsumeOptionsBuilder {
+	return builder.With(WithConsumeOptionsDeadLetterExchange(name))
+}
+
+// Exchange sets the name and kind of the binding exchange,
+// the routing keys given to StartConsuming bind the queue to it
+func (builder *ConsumeOptionsBuilder) Exchange(name, kind string) *ConsumeOptionsBuilder {
+	return builder.With(WithConsumeOptionsBindingExchangeName(name), WithConsumeOptionsBindingExchangeKind(kind))
+}
+
+// ExchangeDurable is WithConsumeOptionsBindingExchangeDurable
+func (builder *ConsumeOptionsBuilder) ExchangeDurable() *ConsumeOptionsBuilder {
+	return builder.With(WithConsumeOptionsBindingExchangeDurable)
+}
+
+// Bindings is WithConsumeOptionsBindings
+func (builder *ConsumeOptionsBuilder) Bindings(bindings ...BindingDeclaration) *ConsumeOptionsBuilder {
+	return builder.With(WithConsumeOptionsBindings(bindings...))
+}
+
+// Prefetch is WithConsumeOptionsQOSPrefetch
+func (builder *ConsumeOptionsBuilder) Prefetch(prefetchCount int) *ConsumeOptionsBuilder {
+	return builder.With(WithConsumeOptionsQOSPrefetch(prefetchCount))
+}
+
+// Concurrency is WithConsumeOptionsConcurrency
+func (builder *ConsumeOptionsBuilder) Concurrency(concurrency int) *ConsumeOptionsBuilder {
+	return builder.With(WithConsumeOptionsConcurrency(concurrency))
+}
+
+// HandlerTimeout is WithConsumeOptionsHandlerTimeout
+func (builder *ConsumeOptionsBuilder) HandlerTimeout(timeout time.Duration) *ConsumeOptionsBuilder {
+	return builder.With(WithConsumeOptionsHandlerTimeout(timeout))
+}
+
+// Middleware is WithConsumeOptionsMiddleware
+func (builder *ConsumeOptionsBuilder) Middleware(middleware ...Middleware) *ConsumeOptionsBuilder {
+	return builder.With(WithConsumeOptionsMiddleware(middleware...))
+}
+
+// Retry is WithConsumeOptionsRetry
+func (builder *ConsumeOptionsBuilder) Retry(maxAttempts int, backoff func(attempt int) time.Duration) *ConsumeOptionsBuilder {
+	return builder.With(WithConsumeOptionsRetry(maxAttempts, backoff))
+}
+
+// ConsumerName is WithConsumeOptionsConsumerName
+func (builder *ConsumeOptionsBuilder) ConsumerName(name string) *ConsumeOptionsBuilder {
+	return builder.With(WithConsumeOptionsConsumerName(name))
+}
+
+// ManualAck is WithConsumeOptionsConsumerManualAck
+func (builder *ConsumeOptionsBuilder) ManualAck() *ConsumeOptionsBuilder {
+	return builder.With(WithConsumeOptionsConsumerManualAck)
+}
+
+// ConsumerArg is WithConsumeOptionsConsumerArg
+func (builder *ConsumeOptionsBuilder) ConsumerArg(key string, value interface{}) *ConsumeOptionsBuilder {
+	return builder.With(WithConsumeOptionsConsumerArg(key, value))
+}
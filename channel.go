@@ -1,61 +1,192 @@
 package rabbitmq
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/streadway/amqp"
 )
 
+// errManagerClosed is returned when reconnecting a manager that was closed
+var errManagerClosed = errors.New("channel manager was closed")
+
 type channelManager struct {
-	logger              Logger
-	url                 string
-	channel             *amqp.Channel
-	connection          *amqp.Connection
-	config              amqp.Config
-	channelMux          *sync.RWMutex
-	notifyCancelOrClose chan error
+	logger   fieldLogger
+	observer Observer
+	// urls are the addresses of the nodes of the cluster, url is the one currently connected to
+	urls       []string
+	url        string
+	channel    *amqp.Channel
+	connection *amqp.Connection
+	// shared is the connection the channel is opened on if it's shared with other managers,
+	// in which case it also dials the connection and urls and url aren't used
+	shared     *Connection
+	config     amqp.Config
+	channelMux *sync.RWMutex
+	// reconnectListeners receive the cause of every reconnection, guarded by reconnectMux
+	reconnectListeners map[chan error]struct{}
+	reconnectMux       *sync.Mutex
+	// notifyClosed receives the error that made the manager give up reconnecting
+	notifyClosed chan error
+	// notifyReconnected is closed and replaced every time a new channel is obtained
+	notifyReconnected chan struct{}
+	// closed is closed once the manager won't reconnect anymore
+	closed    chan struct{}
+	closeOnce *sync.Once
+	// connected is false while the channel is being re-established, guarded by channelMux
+	connected            bool
+	backoff              BackoffOptions
+	maxReconnectAttempts int
+	// clock waits for the backoff, of the manager and of the consumers using it
+	clock clock
+	// blocking tells whether the server blocked blockedConnection, usually because of a resource alarm.
+	// The listeners receive the changes, they're guarded by blockedMux along with blocking
+	blocking          amqp.Blocking
+	blockedConnection *amqp.Connection
+	blockedListeners  []chan amqp.Blocking
+	blockedMux        *sync.Mutex
+	hooks             lifecycleHooks
+	// setupChannel prepares every new channel before it replaces the current one, a failure
+	// fails the reconnection attempt. It's guarded by channelMux and may be nil
+	setupChannel func(channel *amqp.Channel) error
 }
 
-func newChannelManager(url string, conf amqp.Config, log Logger) (*channelManager, error) {
-	conn, ch, err := getNewChannel(url, conf)
-	if err != nil {
-		return nil, err
+// lifecycleHooks are the callbacks of the options called at the transitions of the channel, any may be nil
+type lifecycleHooks struct {
+	onConnect    func()
+	onDisconnect func(err error)
+	onReconnect  func(attempt int)
+}
+
+func (hooks lifecycleHooks) connect() {
+	if hooks.onConnect != nil {
+		hooks.onConnect()
+	}
+}
+
+func (hooks lifecycleHooks) disconnect(err error) {
+	if hooks.onDisconnect != nil {
+		hooks.onDisconnect(err)
+	}
+}
+
+func (hooks lifecycleHooks) reconnect(attempt int) {
+	if hooks.onReconnect != nil {
+		hooks.onReconnect(attempt)
 	}
+}
 
-	chManager := channelManager{
-		logger:              log,
-		url:                 url,
-		connection:          conn,
-		channel:             ch,
-		channelMux:          &sync.RWMutex{},
-		notifyCancelOrClose: make(chan error),
+func newChannelManager(urls []string, conf amqp.Config, log fieldLogger, observer Observer, backoff BackoffOptions, maxReconnectAttempts int, hooks lifecycleHooks) (*channelManager, error) {
+	url, conn, ch, err := dialAny(shuffledURLs(urls, ""), conf, log)
+	if err != nil {
+		return nil, wrapError(err)
 	}
-	go chManager.startNotifyCancelOrClosed()
-	return &chManager, nil
+	chManager := newChannelManagerOf(conn, ch, log, observer, backoff, maxReconnectAttempts, hooks)
+	chManager.urls = urls
+	chManager.url = url
+	chManager.config = conf
+	chManager.start()
+	chManager.hooks.connect()
+	return chManager, nil
 }
 
-func newChannelManagerTLS(url string, conf *tls.Config, log Logger) (*channelManager, error) {
-	conn, ch, err := getNewChannelTLS(url, conf)
+// newSharedChannelManager returns a manager of a channel opened on the shared connection
+func newSharedChannelManager(shared *Connection, log fieldLogger, observer Observer, backoff BackoffOptions, maxReconnectAttempts int, hooks lifecycleHooks) (*channelManager, error) {
+	conn, err := shared.current()
 	if err != nil {
 		return nil, err
 	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	chManager := newChannelManagerOf(conn, ch, log, observer, backoff, maxReconnectAttempts, hooks)
+	chManager.shared = shared
+	chManager.start()
+	chManager.hooks.connect()
+	return chManager, nil
+}
+
+// newChannelManagerOf returns a manager of the channel opened on the connection, it must be started
+func newChannelManagerOf(conn *amqp.Connection, ch *amqp.Channel, log fieldLogger, observer Observer, backoff BackoffOptions, maxReconnectAttempts int, hooks lifecycleHooks) *channelManager {
+	backoff = backoff.withDefaults()
+	return &channelManager{
+		logger:               log,
+		observer:             observer,
+		connection:           conn,
+		channel:              ch,
+		channelMux:           &sync.RWMutex{},
+		reconnectListeners:   map[chan error]struct{}{},
+		reconnectMux:         &sync.Mutex{},
+		notifyClosed:         make(chan error, 1),
+		notifyReconnected:    make(chan struct{}),
+		closed:               make(chan struct{}),
+		closeOnce:            &sync.Once{},
+		connected:            true,
+		backoff:              backoff,
+		maxReconnectAttempts: maxReconnectAttempts,
+		clock:                backoff.clock,
+		blockedMux:           &sync.Mutex{},
+		hooks:                hooks,
+	}
+}
+
+// start watches the channel and the connection to reconnect when they're lost
+func (chManager *channelManager) start() {
+	chManager.watchChannel()
+	go chManager.startNotifyBlocked(chManager.connection)
+}
 
-	chManager := channelManager{
-		logger:              log,
-		url:                 url,
-		connection:          conn,
-		channel:             ch,
-		channelMux:          &sync.RWMutex{},
-		notifyCancelOrClose: make(chan error),
+// dialAny dials the urls in order until a channel is obtained from one of them,
+// which is returned along with the connection and the channel. The error of the last url is returned if none works
+func dialAny(urls []string, conf amqp.Config, log fieldLogger) (string, *amqp.Connection, *amqp.Channel, error) {
+	var err error
+	for i, url := range urls {
+		var conn *amqp.Connection
+		var ch *amqp.Channel
+		conn, ch, err = getNewChannel(url, conf)
+		if err == nil {
+			return url, conn, ch, nil
+		}
+		if len(urls) > 1 {
+			log.Log(LogLevelWarn, "couldn't connect to node", map[string]interface{}{
+				"node":  i + 1,
+				"nodes": len(urls),
+				"error": err,
+			})
+		}
+	}
+	return "", nil, nil, err
+}
+
+// shuffledURLs returns the urls in random order, so clients spread over the nodes.
+// The url that was connected to last is tried last, since it likely just went down
+func shuffledURLs(urls []string, last string) []string {
+	shuffled := make([]string, len(urls))
+	copy(shuffled, urls)
+	jitterRandMux.Lock()
+	jitterRand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	jitterRandMux.Unlock()
+	for i, url := range shuffled {
+		if url == last {
+			shuffled = append(append(shuffled[:i:i], shuffled[i+1:]...), url)
+			break
+		}
 	}
-	go chManager.startNotifyCancelOrClosed()
-	return &chManager, nil
+	return shuffled
 }
 
+// getNewChannel dials a connection with the given config and opens a channel on it
 func getNewChannel(url string, conf amqp.Config) (*amqp.Connection, *amqp.Channel, error) {
+	// amqp adds to the client properties while dialing,
+	// copy them so the config can be reused when reconnecting
+	conf.Properties = copyTable(Table(conf.Properties))
 	amqpConn, err := amqp.DialConfig(url, conf)
 	if err != nil {
 		return nil, nil, err
@@ -67,87 +198,416 @@ func getNewChannel(url string, conf amqp.Config) (*amqp.Connection, *amqp.Channe
 	return amqpConn, ch, err
 }
 
-func getNewChannelTLS(url string, conf *tls.Config) (*amqp.Connection, *amqp.Channel, error) {
-	amqpConn, err := amqp.DialTLS(url, conf)
-	if err != nil {
-		return nil, nil, err
+// defaultHeartbeat is the heartbeat interval used when none is configured, the same as amqp.Dial
+const defaultHeartbeat = 10 * time.Second
+
+// withTimeouts returns the config with the given heartbeat interval and dial timeout,
+// zero values keep the ones of the config. The heartbeat defaults to defaultHeartbeat
+// instead of the server's suggestion, so dead connections are detected quickly
+func withTimeouts(conf amqp.Config, heartbeat, dialTimeout time.Duration) amqp.Config {
+	if heartbeat > 0 {
+		conf.Heartbeat = heartbeat
 	}
-	ch, err := amqpConn.Channel()
+	if conf.Heartbeat == 0 {
+		conf.Heartbeat = defaultHeartbeat
+	}
+	if dialTimeout > 0 {
+		conf.Dial = amqp.DefaultDial(dialTimeout)
+	}
+	return conf
+}
+
+// getTLSConfig returns the config used to dial with TLS, with the same
+// defaults as amqp.DialTLS
+func getTLSConfig(conf *tls.Config) amqp.Config {
+	return amqp.Config{
+		Heartbeat:       defaultHeartbeat,
+		TLSClientConfig: conf,
+		Locale:          "en_US",
+	}
+}
+
+// checkTLSURL returns an error unless the url uses the amqps scheme,
+// since amqp only dials with TLS for that scheme and would silently ignore the TLS config
+func checkTLSURL(url string) error {
+	uri, err := amqp.ParseURI(url)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	return amqpConn, ch, err
+	if uri.Scheme != "amqps" {
+		return fmt.Errorf("connecting with TLS requires an amqps:// url, got %s://", uri.Scheme)
+	}
+	return nil
+}
+
+// withClientProperties returns the config with the given properties added to the
+// properties the client advertises to the server
+func withClientProperties(conf amqp.Config, properties Table) amqp.Config {
+	if len(properties) == 0 {
+		return conf
+	}
+	merged := copyTable(Table(conf.Properties))
+	for key, value := range properties {
+		merged[key] = value
+	}
+	conf.Properties = merged
+	return conf
 }
 
-// startNotifyCancelOrClosed listens on the channel's cancelled and closed
-// notifiers. When it detects a problem, it attempts to reconnect with an exponential
-// backoff. Once reconnected, it sends an error back on the manager's notifyCancelOrClose
-// channel
-func (chManager *channelManager) startNotifyCancelOrClosed() {
-	notifyCloseChan := make(chan *amqp.Error)
-	notifyCloseChan = chManager.channel.NotifyClose(notifyCloseChan)
-	notifyCancelChan := make(chan string)
-	notifyCancelChan = chManager.channel.NotifyCancel(notifyCancelChan)
+// watchChannel registers the connection's closed notifier and the channel's cancelled and closed
+// notifiers before returning, so a loss right after obtaining the channel isn't mistaken for a close
+// by the client, and starts listening on them. The caller must hold the channel lock or not share
+// the manager yet
+func (chManager *channelManager) watchChannel() {
+	notifyConnectionCloseChan := chManager.connection.NotifyClose(make(chan *amqp.Error, 1))
+	notifyCloseChan := chManager.channel.NotifyClose(make(chan *amqp.Error, 1))
+	notifyCancelChan := chManager.channel.NotifyCancel(make(chan string, 1))
+	go chManager.startNotifyCancelOrClosed(notifyConnectionCloseChan, notifyCloseChan, notifyCancelChan)
+}
+
+// startNotifyCancelOrClosed listens on the notifiers of watchChannel. When it detects a problem,
+// it attempts to reconnect with an exponential backoff. Once reconnected, the cause is sent to the
+// listeners of notifyReconnect, as a *CloseError or a *CancelError. If it gives up reconnecting,
+// the error is sent on the notifyClosed channel instead
+func (chManager *channelManager) startNotifyCancelOrClosed(notifyConnectionCloseChan, notifyCloseChan <-chan *amqp.Error, notifyCancelChan <-chan string) {
+	// amqp closes the notifiers once the channel is closed, which happens at the latest when
+	// reconnecting, and blocks until they're drained in the meantime
+	defer func() {
+		go drain(notifyConnectionCloseChan)
+		go drain(notifyCloseChan)
+		go drain(notifyCancelChan)
+	}()
+
 	select {
+	case err := <-notifyConnectionCloseChan:
+		// a nil error means the connection was closed by the client, which doesn't reconnect
+		if err != nil {
+			chManager.reconnectAndNotify("connection close", &CloseError{Connection: true, Err: err})
+		}
 	case err := <-notifyCloseChan:
-		// If the connection close is triggered by the Server, a reconnection takes place
-		if err != nil && err.Server {
-			chManager.logger.Printf("attempting to reconnect to amqp server after close")
-			chManager.reconnectWithBackoff()
-			chManager.logger.Printf("successfully reconnected to amqp server after close")
-			chManager.notifyCancelOrClose <- err
+		if err == nil {
+			return
+		}
+		// the connection notifies its closing before its channels do
+		select {
+		case connectionErr := <-notifyConnectionCloseChan:
+			if connectionErr != nil {
+				chManager.reconnectAndNotify("connection close", &CloseError{Connection: true, Err: connectionErr})
+				return
+			}
+		default:
 		}
-	case err := <-notifyCancelChan:
-		chManager.logger.Printf("attempting to reconnect to amqp server after cancel")
-		chManager.reconnectWithBackoff()
-		chManager.logger.Printf("successfully reconnected to amqp server after cancel")
-		chManager.notifyCancelOrClose <- errors.New(err)
+		chManager.reconnectAndNotify("channel close", &CloseError{Connection: false, Err: err})
+	case consumerTag := <-notifyCancelChan:
+		chManager.reconnectAndNotify("cancel", &CancelError{ConsumerTag: consumerTag})
 	}
+}
 
-	// these channels can be closed by amqp
-	select {
-	case <-notifyCloseChan:
-	default:
-		close(notifyCloseChan)
+// drain receives from the channel until it's closed
+func drain[T any](notifyChan <-chan T) {
+	for range notifyChan {
 	}
-	select {
-	case <-notifyCancelChan:
-	default:
-		close(notifyCancelChan)
+}
+
+// notifyReconnect returns a channel that receives the cause of every reconnection, until stop
+// is called. If the channel isn't drained only the latest cause is kept
+func (chManager *channelManager) notifyReconnect() (notifyChan <-chan error, stop func()) {
+	chManager.reconnectMux.Lock()
+	defer chManager.reconnectMux.Unlock()
+	listener := make(chan error, 1)
+	chManager.reconnectListeners[listener] = struct{}{}
+	return listener, func() {
+		chManager.reconnectMux.Lock()
+		defer chManager.reconnectMux.Unlock()
+		delete(chManager.reconnectListeners, listener)
 	}
 }
 
-// reconnectWithBackoff continuously attempts to reconnect with an
-// exponential backoff strategy
-func (chManager *channelManager) reconnectWithBackoff() {
-	backoffTime := time.Second
-	for {
-		chManager.logger.Printf("waiting %s seconds to attempt to reconnect to amqp server", backoffTime)
-		time.Sleep(backoffTime)
-		backoffTime *= 2
-		err := chManager.reconnect()
+// reconnectAndNotify reconnects after the channel was cancelled or closed by the given cause
+// and notifies the listeners of the outcome
+func (chManager *channelManager) reconnectAndNotify(reason string, cause error) {
+	chManager.setConnected(false)
+	chManager.logger.Log(LogLevelWarn, "attempting to reconnect to amqp server", map[string]interface{}{
+		"reason": reason,
+		"error":  cause,
+	})
+	chManager.hooks.disconnect(cause)
+	err := chManager.reconnectWithBackoff()
+	if err != nil {
+		chManager.logger.Log(LogLevelError, "giving up reconnecting to amqp server", map[string]interface{}{
+			"error": err,
+		})
+		chManager.markClosed()
+		chManager.notifyClosed <- err
+		close(chManager.notifyClosed)
+		return
+	}
+	chManager.logger.Log(LogLevelInfo, "successfully reconnected to amqp server", map[string]interface{}{
+		"reason": reason,
+	})
+	chManager.hooks.connect()
+	chManager.reconnectMux.Lock()
+	defer chManager.reconnectMux.Unlock()
+	for listener := range chManager.reconnectListeners {
+		sendLatest(listener, cause)
+	}
+}
+
+// reconnectWithBackoff attempts to reconnect with the manager's backoff strategy
+// until it succeeds, the maximum number of attempts is reached or the error isn't retryable.
+// A maximum of zero means it never gives up
+func (chManager *channelManager) reconnectWithBackoff() error {
+	var err error
+	for attempt := 1; chManager.maxReconnectAttempts == 0 || attempt <= chManager.maxReconnectAttempts; attempt++ {
+		backoffTime := chManager.backoff.duration(attempt)
+		chManager.logger.Log(LogLevelDebug, "waiting to attempt to reconnect to amqp server", map[string]interface{}{
+			"attempt": attempt,
+			"backoff": backoffTime,
+		})
+		select {
+		case <-chManager.closed:
+			return errManagerClosed
+		case <-chManager.clock.After(backoffTime):
+		}
+		// the backoff may have elapsed as the manager was closed
+		if chManager.isClosed() {
+			return errManagerClosed
+		}
+		chManager.hooks.reconnect(attempt)
+		err = chManager.reconnect()
 		if err != nil {
-			chManager.logger.Printf("error reconnecting to amqp server: %v", err)
+			chManager.logger.Log(LogLevelWarn, "error reconnecting to amqp server", map[string]interface{}{
+				"attempt": attempt,
+				"error":   err,
+			})
+			if !IsRetryable(err) {
+				return fmt.Errorf("can't reconnect: %w", err)
+			}
 		} else {
-			return
+			return nil
 		}
 	}
+	return fmt.Errorf("couldn't reconnect after %d attempts: %w", chManager.maxReconnectAttempts, err)
 }
 
 // reconnect safely closes the current channel and obtains a new one
 func (chManager *channelManager) reconnect() error {
 	chManager.channelMux.Lock()
 	defer chManager.channelMux.Unlock()
-	newConn, newChannel, err := getNewChannel(chManager.url, chManager.config)
+	// close may have been called while waiting for the lock
+	if chManager.isClosed() {
+		return errManagerClosed
+	}
+	if chManager.shared != nil {
+		return chManager.reconnectShared()
+	}
+	newURL, newConn, newChannel, err := dialAny(shuffledURLs(chManager.urls, chManager.url), chManager.config, chManager.logger)
 	if err != nil {
 		return err
 	}
+	err = chManager.setup(newChannel)
+	if err != nil {
+		newConn.Close()
+		return err
+	}
 
 	chManager.channel.Close()
 	chManager.connection.Close()
 
+	chManager.url = newURL
+	chManager.replaceChannel(newConn, newChannel)
+	return nil
+}
+
+// reconnectShared opens a new channel on the shared connection, which is dialed again
+// if it's closed. The caller must hold the channel lock
+func (chManager *channelManager) reconnectShared() error {
+	newConn, err := chManager.shared.current()
+	if err != nil {
+		return err
+	}
+	newChannel, err := newConn.Channel()
+	if err != nil {
+		return err
+	}
+	err = chManager.setup(newChannel)
+	if err != nil {
+		newChannel.Close()
+		return err
+	}
+	// the connection is closed by its owner
+	chManager.channel.Close()
+	chManager.replaceChannel(newConn, newChannel)
+	return nil
+}
+
+// setup runs setupChannel on the new channel if it's set. The caller must hold the channel lock
+func (chManager *channelManager) setup(newChannel *amqp.Channel) error {
+	if chManager.setupChannel == nil {
+		return nil
+	}
+	return chManager.setupChannel(newChannel)
+}
+
+// replaceChannel starts using the new channel and notifies that it's available.
+// The caller must hold the channel lock
+func (chManager *channelManager) replaceChannel(newConn *amqp.Connection, newChannel *amqp.Channel) {
 	chManager.connection = newConn
 	chManager.channel = newChannel
-	go chManager.startNotifyCancelOrClosed()
-	return nil
+	chManager.connected = true
+	chManager.observer.IncReconnect()
+	close(chManager.notifyReconnected)
+	chManager.notifyReconnected = make(chan struct{})
+	chManager.watchChannel()
+	go chManager.startNotifyBlocked(newConn)
+}
+
+// startNotifyBlocked records when the server blocks and unblocks the connection
+// and passes it on to the listeners, until the connection is closed
+func (chManager *channelManager) startNotifyBlocked(conn *amqp.Connection) {
+	for blocking := range conn.NotifyBlocked(make(chan amqp.Blocking, 1)) {
+		chManager.setBlocked(conn, blocking)
+	}
+	// a new connection isn't blocked until the server says so
+	chManager.setBlocked(conn, amqp.Blocking{Active: false})
+}
+
+// setBlocked records the blocking of the connection, unblocking a connection
+// that was replaced in the meantime is ignored
+func (chManager *channelManager) setBlocked(conn *amqp.Connection, blocking amqp.Blocking) {
+	chManager.blockedMux.Lock()
+	defer chManager.blockedMux.Unlock()
+	if !blocking.Active && (!chManager.blocking.Active || chManager.blockedConnection != conn) {
+		return
+	}
+	chManager.blocking = blocking
+	chManager.blockedConnection = conn
+	for _, listener := range chManager.blockedListeners {
+		sendLatest(listener, blocking)
+	}
+}
+
+// sendLatest sends the value on the listener, which must have a buffer of one and no other
+// sender, replacing the value it holds if it wasn't received yet so the latest one is never lost
+func sendLatest[T any](listener chan T, value T) {
+	select {
+	case listener <- value:
+	default:
+		select {
+		case <-listener:
+		default:
+		}
+		listener <- value
+	}
+}
+
+// notifyBlocked returns a channel that receives the blockings and unblockings of the connection,
+// starting with the current one if it's blocked. It's closed once the manager is closed
+func (chManager *channelManager) notifyBlocked() <-chan amqp.Blocking {
+	chManager.blockedMux.Lock()
+	defer chManager.blockedMux.Unlock()
+	listener := make(chan amqp.Blocking, 1)
+	select {
+	case <-chManager.closed:
+		close(listener)
+		return listener
+	default:
+	}
+	if chManager.blocking.Active {
+		listener <- chManager.blocking
+	}
+	chManager.blockedListeners = append(chManager.blockedListeners, listener)
+	return listener
+}
+
+// isBlocked reports whether the server is currently blocking the connection
+func (chManager *channelManager) isBlocked() bool {
+	chManager.blockedMux.Lock()
+	defer chManager.blockedMux.Unlock()
+	return chManager.blocking.Active
+}
+
+// waitForReconnect blocks until the given channel has been replaced by a new one.
+// It returns amqp.ErrClosed if the manager won't reconnect, or ctx.Err() when the context
+// is done first
+func (chManager *channelManager) waitForReconnect(ctx context.Context, staleChannel *amqp.Channel) error {
+	for {
+		chManager.channelMux.RLock()
+		channel := chManager.channel
+		notifyReconnected := chManager.notifyReconnected
+		chManager.channelMux.RUnlock()
+		if channel != staleChannel {
+			return nil
+		}
+
+		select {
+		case <-notifyReconnected:
+		case <-chManager.closed:
+			return amqp.ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// isConnected reports whether the manager currently holds an open channel
+func (chManager *channelManager) isConnected() bool {
+	chManager.channelMux.RLock()
+	defer chManager.channelMux.RUnlock()
+	return chManager.connected
+}
+
+// setConnected records whether the manager currently holds an open channel
+func (chManager *channelManager) setConnected(connected bool) {
+	chManager.channelMux.Lock()
+	defer chManager.channelMux.Unlock()
+	chManager.connected = connected
+}
+
+// withChannel calls fn with the current channel, which isn't replaced until fn returns
+func (chManager *channelManager) withChannel(fn func(*amqp.Channel) error) error {
+	chManager.channelMux.RLock()
+	defer chManager.channelMux.RUnlock()
+	return fn(chManager.channel)
+}
+
+// markClosed records that the manager won't reconnect anymore
+func (chManager *channelManager) markClosed() {
+	chManager.closeOnce.Do(func() {
+		chManager.blockedMux.Lock()
+		defer chManager.blockedMux.Unlock()
+		close(chManager.closed)
+		for _, listener := range chManager.blockedListeners {
+			close(listener)
+		}
+		chManager.blockedListeners = nil
+	})
+}
+
+// isClosed reports whether the manager was closed or gave up reconnecting
+func (chManager *channelManager) isClosed() bool {
+	select {
+	case <-chManager.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// close closes the channel and the connection, after which the manager won't reconnect
+func (chManager *channelManager) close() error {
+	chManager.markClosed()
+	chManager.setConnected(false)
+	chManager.channelMux.RLock()
+	defer chManager.channelMux.RUnlock()
+	channelErr := chManager.channel.Close()
+	if chManager.shared != nil {
+		// the connection is closed by its owner
+		return channelErr
+	}
+	connectionErr := chManager.connection.Close()
+	if channelErr != nil {
+		return channelErr
+	}
+	return connectionErr
 }
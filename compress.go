@@ -0,0 +1,71 @@
+package rabbitmq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// gzipEncoding is the content encoding of gzip-compressed bodies
+const gzipEncoding = "gzip"
+
+// WithPublishOptionsContentEncoding returns a function that sets the content encoding, i.e. "gzip",
+// which tells consumers how the body was encoded on top of its content type
+func WithPublishOptionsContentEncoding(encoding string) func(*PublishOptions) {
+	return func(options *PublishOptions) {
+		options.ContentEncoding = encoding
+	}
+}
+
+// WithPublishOptionsGzip compresses the body with gzip and sets the content encoding to "gzip",
+// consumers can decompress it with WithConsumeOptionsGunzip
+func WithPublishOptionsGzip(options *PublishOptions) {
+	options.Gzip = true
+	options.ContentEncoding = gzipEncoding
+}
+
+// gzipBody returns the body compressed with gzip
+func gzipBody(data []byte) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	writer := gzip.NewWriter(buffer)
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// WithConsumeOptionsGunzip makes the consumer decompress the body of the deliveries whose content
+// encoding is "gzip" before handling them, and clear the encoding. Deliveries that fail to decompress
+// are rejected without being requeued, so they're dead-lettered if the queue has a dead letter exchange
+func WithConsumeOptionsGunzip(options *ConsumeOptions) {
+	WithConsumeOptionsMiddleware(GunzipMiddleware)(options)
+}
+
+// GunzipMiddleware is the middleware WithConsumeOptionsGunzip adds,
+// to choose its position among the other middleware
+func GunzipMiddleware(next Handler) Handler {
+	return func(d Delivery) bool {
+		if d.ContentEncoding != gzipEncoding {
+			return next(d)
+		}
+		reader, err := gzip.NewReader(bytes.NewReader(d.Body))
+		if err != nil {
+			// the consumer won't settle the delivery again
+			_ = d.Reject(false)
+			return false
+		}
+		body, err := io.ReadAll(reader)
+		if err != nil {
+			_ = d.Reject(false)
+			return false
+		}
+		d.Body = body
+		d.ContentEncoding = ""
+		return next(d)
+	}
+}
@@ -0,0 +1,184 @@
+package rabbitmq
+
+import (
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// notifyPublishBuffer is how many confirmations a NotifyPublish listener can fall behind
+// before it's closed
+const notifyPublishBuffer = 128
+
+// publisherConfirms tracks the delivery tags of messages published on a channel
+// in confirm mode so the confirmations sent by the server can be correlated
+// to the publishings that caused them
+type publisherConfirms struct {
+	// publishMux serializes the publishings so delivery tags are assigned in the same order
+	// the server sees the messages. mux isn't held while publishing, since the confirmations
+	// of the previous messages can only be handled meanwhile if it's free
+	publishMux *sync.Mutex
+	mux        *sync.Mutex
+	logger     fieldLogger
+	// channel is the channel confirm mode is enabled on, delivery tags are
+	// only meaningful for this channel
+	channel     *amqp.Channel
+	deliveryTag uint64
+	pending     map[uint64]chan amqp.Confirmation
+	listeners   []chan amqp.Confirmation
+	// closed is set once the publisher is closed, the listeners are
+	// closed when the channel's confirmations stop
+	closed bool
+}
+
+func newPublisherConfirms(channel *amqp.Channel, logger fieldLogger) (*publisherConfirms, error) {
+	confirms := &publisherConfirms{
+		publishMux:  &sync.Mutex{},
+		mux:         &sync.Mutex{},
+		logger:      logger,
+		deliveryTag: 0,
+		pending:     map[uint64]chan amqp.Confirmation{},
+	}
+	err := confirms.setup(channel)
+	if err != nil {
+		return nil, err
+	}
+	return confirms, nil
+}
+
+// setup puts the channel in confirm mode and starts over with the delivery tags.
+// Publishings still waiting on a confirmation from a previous channel are reported
+// as nacked, since that channel is gone and the server won't confirm them anymore.
+// The caller must hold publishMux if the confirms are already in use
+func (confirms *publisherConfirms) setup(channel *amqp.Channel) error {
+	err := channel.Confirm(false)
+	if err != nil {
+		return err
+	}
+	confirms.mux.Lock()
+	defer confirms.mux.Unlock()
+	for deliveryTag, confirmChan := range confirms.pending {
+		confirmChan <- amqp.Confirmation{DeliveryTag: deliveryTag, Ack: false}
+	}
+	confirms.pending = map[uint64]chan amqp.Confirmation{}
+	confirms.deliveryTag = 0
+	confirms.channel = channel
+	go confirms.startNotifyPublishHandler(channel, channel.NotifyPublish(make(chan amqp.Confirmation, 1)))
+	return nil
+}
+
+// publish calls publishFunc and assigns the next delivery tag to the publishing
+// if it succeeds. If wait is true the returned channel will receive the confirmation
+// for the publishing, it's registered beforehand since the server may confirm the message
+// before publishFunc returns. The channel is put in confirm mode first if it's a new one
+func (confirms *publisherConfirms) publish(channel *amqp.Channel, publishFunc func() error, wait bool) (<-chan amqp.Confirmation, error) {
+	confirms.publishMux.Lock()
+	defer confirms.publishMux.Unlock()
+
+	if channel != confirms.channel {
+		err := confirms.setup(channel)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	confirms.mux.Lock()
+	deliveryTag := confirms.deliveryTag + 1
+	var confirmChan chan amqp.Confirmation
+	if wait {
+		confirmChan = make(chan amqp.Confirmation, 1)
+		confirms.pending[deliveryTag] = confirmChan
+	}
+	confirms.mux.Unlock()
+
+	err := publishFunc()
+	confirms.mux.Lock()
+	defer confirms.mux.Unlock()
+	if err != nil {
+		delete(confirms.pending, deliveryTag)
+		return nil, err
+	}
+	confirms.deliveryTag = deliveryTag
+	if !wait {
+		return nil, nil
+	}
+	return confirmChan, nil
+}
+
+// listen registers a channel that will receive every confirmation
+func (confirms *publisherConfirms) listen(confirmChan chan amqp.Confirmation) {
+	confirms.mux.Lock()
+	defer confirms.mux.Unlock()
+	if confirms.closed {
+		close(confirmChan)
+		return
+	}
+	confirms.listeners = append(confirms.listeners, confirmChan)
+}
+
+// dropListener stops sending confirmations to the listener and closes it,
+// so that its receiver knows the next confirmations are missing
+func (confirms *publisherConfirms) dropListener(listener chan amqp.Confirmation) {
+	confirms.mux.Lock()
+	defer confirms.mux.Unlock()
+	for i, l := range confirms.listeners {
+		if l == listener {
+			// the handler may still range over the previous slice, it's copied rather than modified
+			confirms.listeners = append(confirms.listeners[:i:i], confirms.listeners[i+1:]...)
+			close(listener)
+			return
+		}
+	}
+}
+
+// startNotifyPublishHandler dispatches the server's confirmations for the given channel
+// to the publishings waiting on them and to the registered listeners
+func (confirms *publisherConfirms) startNotifyPublishHandler(channel *amqp.Channel, confirmAMQPChan <-chan amqp.Confirmation) {
+	for confirmation := range confirmAMQPChan {
+		confirms.mux.Lock()
+		if channel != confirms.channel {
+			// the delivery tags have been reset for a new channel
+			confirms.mux.Unlock()
+			continue
+		}
+		confirmChan, ok := confirms.pending[confirmation.DeliveryTag]
+		delete(confirms.pending, confirmation.DeliveryTag)
+		listeners := confirms.listeners
+		confirms.mux.Unlock()
+
+		if ok {
+			confirmChan <- confirmation
+		}
+		for _, listener := range listeners {
+			// the handler runs on the amqp reader, a listener that isn't drained mustn't block it
+			select {
+			case listener <- confirmation:
+			default:
+				confirms.logger.Warnf("closing a NotifyPublish channel that isn't drained, it misses the confirmation with delivery tag %d",
+					confirmation.DeliveryTag)
+				confirms.dropListener(listener)
+			}
+		}
+	}
+
+	confirms.mux.Lock()
+	defer confirms.mux.Unlock()
+	if confirms.closed && channel == confirms.channel {
+		for _, listener := range confirms.listeners {
+			close(listener)
+		}
+		confirms.listeners = nil
+	}
+}
+
+// close reports the publishings still waiting on a confirmation as nacked
+// and makes the listeners be closed once the channel is
+func (confirms *publisherConfirms) close() {
+	confirms.mux.Lock()
+	defer confirms.mux.Unlock()
+	for deliveryTag, confirmChan := range confirms.pending {
+		confirmChan <- amqp.Confirmation{DeliveryTag: deliveryTag, Ack: false}
+	}
+	confirms.pending = map[uint64]chan amqp.Confirmation{}
+	confirms.closed = true
+}
@@ -0,0 +1,213 @@
+package rabbitmq
+
+import (
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Connection is a connection to the server shared by several consumers and publishers,
+// each of them gets its own channel on it. When the connection is lost it's dialed again
+// by the first of them to reconnect, and the others open their new channel on that one.
+// The connection options of the consumers and publishers, such as the heartbeat or the
+// urls, don't apply since they don't dial
+type Connection struct {
+	urls   []string
+	config amqp.Config
+	logger fieldLogger
+
+	// mux guards the current connection, the url it's connected to and closed
+	mux        *sync.Mutex
+	connection *amqp.Connection
+	url        string
+	closed     bool
+}
+
+// ConnectionOptions are used to describe how a new connection will be created
+type ConnectionOptions struct {
+	Logger           Logger
+	LeveledLogger    LeveledLogger
+	LogLevel         LogLevel
+	StructuredLogger StructuredLogger
+	ClientProperties Table
+	Heartbeat        time.Duration
+	DialTimeout      time.Duration
+	URLs             []string
+}
+
+// WithConnectionOptionsConnectionName returns a function that sets the name the connection
+// is shown with in the management UI
+func WithConnectionOptionsConnectionName(name string) func(options *ConnectionOptions) {
+	return func(options *ConnectionOptions) {
+		if options.ClientProperties == nil {
+			options.ClientProperties = Table{}
+		}
+		options.ClientProperties["connection_name"] = name
+	}
+}
+
+// WithConnectionOptionsClientProperties returns a function that sets properties the client
+// advertises to the server when connecting
+func WithConnectionOptionsClientProperties(properties Table) func(options *ConnectionOptions) {
+	return func(options *ConnectionOptions) {
+		if options.ClientProperties == nil {
+			options.ClientProperties = Table{}
+		}
+		for key, value := range properties {
+			options.ClientProperties[key] = value
+		}
+	}
+}
+
+// WithConnectionOptionsHeartbeat returns a function that sets the heartbeat interval, it defaults to 10 seconds
+func WithConnectionOptionsHeartbeat(heartbeat time.Duration) func(options *ConnectionOptions) {
+	return func(options *ConnectionOptions) {
+		options.Heartbeat = heartbeat
+	}
+}
+
+// WithConnectionOptionsDialTimeout returns a function that sets how long dialing may take
+func WithConnectionOptionsDialTimeout(timeout time.Duration) func(options *ConnectionOptions) {
+	return func(options *ConnectionOptions) {
+		options.DialTimeout = timeout
+	}
+}
+
+// WithConnectionOptionsURLs returns a function that adds the urls of other nodes of the cluster,
+// which are tried in random order when dialing
+func WithConnectionOptionsURLs(urls ...string) func(options *ConnectionOptions) {
+	return func(options *ConnectionOptions) {
+		options.URLs = append(options.URLs, urls...)
+	}
+}
+
+// WithConnectionOptionsLogger returns a function that sets the logger of the connection
+func WithConnectionOptionsLogger(log Logger) func(options *ConnectionOptions) {
+	return func(options *ConnectionOptions) {
+		options.Logger = log
+	}
+}
+
+// WithConnectionOptionsLeveledLogger returns a function that sets the leveled logger of the connection
+func WithConnectionOptionsLeveledLogger(log LeveledLogger) func(options *ConnectionOptions) {
+	return func(options *ConnectionOptions) {
+		options.LeveledLogger = log
+	}
+}
+
+// WithConnectionOptionsStructuredLogger returns a function that sets the structured logger of the connection
+func WithConnectionOptionsStructuredLogger(log StructuredLogger) func(options *ConnectionOptions) {
+	return func(options *ConnectionOptions) {
+		options.StructuredLogger = log
+	}
+}
+
+// WithConnectionOptionsLogLevel returns a function that sets the minimum level logged through Logger
+func WithConnectionOptionsLogLevel(level LogLevel) func(options *ConnectionOptions) {
+	return func(options *ConnectionOptions) {
+		options.LogLevel = level
+	}
+}
+
+// NewConnection returns a new Connection connected to the given rabbitmq server
+func NewConnection(url string, config amqp.Config, optionFuncs ...func(*ConnectionOptions)) (*Connection, error) {
+	options := &ConnectionOptions{}
+	for _, optionFunc := range optionFuncs {
+		optionFunc(options)
+	}
+	if options.Logger == nil {
+		options.Logger = &noLogger{} // default no logging
+	}
+	options.LeveledLogger = getLeveledLogger(options.LeveledLogger, options.Logger, options.LogLevel)
+
+	conn := &Connection{
+		urls:   append([]string{url}, options.URLs...),
+		config: withTimeouts(withClientProperties(config, options.ClientProperties), options.Heartbeat, options.DialTimeout),
+		logger: fieldLogger{leveled: options.LeveledLogger, structured: options.StructuredLogger},
+		mux:    &sync.Mutex{},
+	}
+	conn.mux.Lock()
+	defer conn.mux.Unlock()
+	err := conn.dial()
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return conn, nil
+}
+
+// NewConnectionTLS works like NewConnection but connects over TLS with the given config,
+// which requires an amqps:// url. The connection uses the same defaults as amqp.DialTLS
+func NewConnectionTLS(url string, config *tls.Config, optionFuncs ...func(*ConnectionOptions)) (*Connection, error) {
+	err := checkTLSURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewConnection(url, getTLSConfig(config), optionFuncs...)
+}
+
+// NewConsumer returns a new Consumer with its own channel on the connection
+func (conn *Connection) NewConsumer(optionFuncs ...func(*ConsumerOptions)) (Consumer, error) {
+	options := getConsumerOptions(optionFuncs...)
+	chManager, err := newSharedChannelManager(conn, fieldLogger{leveled: options.LeveledLogger, structured: options.StructuredLogger}, options.Observer, options.ReconnectBackoff, options.MaxReconnectAttempts, options.lifecycleHooks())
+	if err != nil {
+		return Consumer{}, err
+	}
+	return newConsumer(chManager, options), nil
+}
+
+// NewPublisher returns a new Publisher with its own channel on the connection
+func (conn *Connection) NewPublisher(optionFuncs ...func(*PublisherOptions)) (*Publisher, <-chan Return, error) {
+	options, err := getPublisherOptions(optionFuncs...)
+	if err != nil {
+		return nil, nil, err
+	}
+	chManager, err := newSharedChannelManager(conn, fieldLogger{leveled: options.LeveledLogger, structured: options.StructuredLogger}, options.Observer, options.ReconnectBackoff, options.MaxReconnectAttempts, options.lifecycleHooks())
+	if err != nil {
+		return nil, nil, err
+	}
+	return newPublisher(chManager, options)
+}
+
+// Close closes the connection, which closes the channels of its consumers and publishers.
+// They should be stopped first, since they don't reconnect once the connection is closed
+func (conn *Connection) Close() error {
+	conn.mux.Lock()
+	defer conn.mux.Unlock()
+	conn.closed = true
+	return conn.connection.Close()
+}
+
+// current returns the connection, after dialing it again if it was lost
+func (conn *Connection) current() (*amqp.Connection, error) {
+	conn.mux.Lock()
+	defer conn.mux.Unlock()
+	if conn.closed {
+		return nil, ErrConnectionClosed
+	}
+	if conn.connection.IsClosed() {
+		err := conn.dial()
+		if err != nil {
+			return nil, wrapError(err)
+		}
+	}
+	return conn.connection, nil
+}
+
+// dial connects to one of the urls, the one connected to last is tried last.
+// The caller must hold the lock
+func (conn *Connection) dial() error {
+	url, newConn, ch, err := dialAny(shuffledURLs(conn.urls, conn.url), conn.config, conn.logger)
+	if err != nil {
+		return err
+	}
+	// the channel only checked the connection works, the managers open their own
+	ch.Close()
+	if conn.connection != nil {
+		conn.connection.Close()
+	}
+	conn.url = url
+	conn.connection = newConn
+	return nil
+}
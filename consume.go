@@ -1,8 +1,15 @@
 package rabbitmq
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"os"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/streadway/amqp"
@@ -10,27 +17,212 @@ import (
 
 // Consumer allows you to create and connect to queues for data consumption.
 type Consumer struct {
-	chManager *channelManager
-	logger    Logger
+	chManager  *channelManager
+	logger     fieldLogger
+	observer   Observer
+	propagator Propagator
+
+	shutdownTimeout      time.Duration
+	backoff              BackoffOptions
+	maxReconnectAttempts int
+
+	// closedChan receives the error that made the consumer give up, it's closed
+	// once the consumer won't recover anymore
+	closedChan chan error
+	// done is closed along with closedChan, for internal use
+	done      chan struct{}
+	closeOnce *sync.Once
+
+	reconnectCallback   func(attempt int, err error)
+	reconnectedCallback func()
+
+	// consumers maps the tag of every running amqp consumer to its state
+	consumers    map[string]*consumption
+	consumersMux *sync.Mutex
+
+	// startMux serializes the StartConsuming calls from checking the running consumers to
+	// registering the new one, so adaptive prefetch can't be combined with another consumer
+	startMux *sync.Mutex
+	// qosMux is held from setting the prefetch count of a StartConsuming to starting its amqp
+	// consumers, since a prefetch count that isn't global applies to the consumers started next
+	qosMux *sync.Mutex
+}
+
+// consumption is the state of an amqp consumer started by the consumer
+type consumption struct {
+	// seq orders the consumptions by the time they were started
+	seq uint64
+	// handlerWG tracks the handler goroutines
+	handlerWG *sync.WaitGroup
+	// cancel stops restarting the amqp consumer after a reconnection
+	cancel context.CancelFunc
+	// paused is set while the amqp consumer is cancelled by Pause,
+	// handler, queue and options are used to start it again
+	paused  bool
+	handler func(ctx context.Context, d Delivery) Action
+	queue   string
+	options ConsumeOptions
 }
 
 // ConsumerOptions are used to describe a consumer's configuration.
 // Logging set to true will enable the consumer to print to stdout
 // Logger specifies a custom Logger interface implementation overruling Logging.
+// LeveledLogger receives the level of every log and takes precedence over Logger
+// LogLevel is the minimum level of the logs sent to Logger
+// StructuredLogger receives the level and fields of every log and takes precedence over both
+// ShutdownTimeout bounds how long StopConsuming waits for running handlers, zero means no limit
+// ReconnectCallback and ReconnectedCallback are called on each reconnect attempt and once consuming resumes
+// ReconnectBackoff describes how long to wait between reconnect attempts
+// MaxReconnectAttempts is the number of failed reconnect attempts after which the consumer gives up, zero means no limit
+// ClientProperties are advertised to the server when connecting, in addition to the ones of the amqp.Config
+// Observer is notified of deliveries and reconnects, to expose metrics
+// Propagator extracts the trace context from the headers into the context given to the handler
+// Heartbeat and DialTimeout override the ones of the amqp.Config when not zero
+// URLs are the addresses of other nodes of the cluster, tried along with the url of the constructor
+// OnConnect, OnDisconnect and OnReconnect are called as the connection is made, lost and attempted again
 type ConsumerOptions struct {
-	Logging bool
-	Logger  Logger
+	Logging              bool
+	Logger               Logger
+	LeveledLogger        LeveledLogger
+	LogLevel             LogLevel
+	StructuredLogger     StructuredLogger
+	ShutdownTimeout      time.Duration
+	ReconnectCallback    func(attempt int, err error)
+	ReconnectedCallback  func()
+	ReconnectBackoff     BackoffOptions
+	MaxReconnectAttempts int
+	ClientProperties     Table
+	Observer             Observer
+	Propagator           Propagator
+	Heartbeat            time.Duration
+	DialTimeout          time.Duration
+	URLs                 []string
+	OnConnect            func()
+	OnDisconnect         func(err error)
+	OnReconnect          func(attempt int)
 }
 
+// Action is the way a handler asks for its delivery to be settled
+type Action int
+
+const (
+	// Ack acks the delivery
+	Ack Action = iota
+	// NackRequeue nacks the delivery so it's requeued, it's what a handler returning false does.
+	// The delivery is retried instead with WithConsumeOptionsRetry, and isn't requeued
+	// with WithConsumeOptionsConsumerNoRequeue
+	NackRequeue
+	// NackDiscard nacks the delivery without requeueing it, so it's dropped or dead-lettered
+	NackDiscard
+	// Reject rejects the delivery without requeueing it, so it's dropped or dead-lettered
+	Reject
+)
+
+// The actions of the deliveries that were never given to the handler. The consumer settles them
+// even with WithConsumeOptionsConsumerManualAck, regardless of the retry and requeue options
+const (
+	// requeueUnhandled requeues a delivery received past WithConsumeOptionsMaxMessages
+	requeueUnhandled Action = -1 - iota
+	// ackUnhandled acks a delivery skipped by the middleware, like a duplicate
+	ackUnhandled
+)
+
 // Delivery captures the fields for a previously delivered message resident in
 // a queue to be delivered by the server to a consumer from Channel.Consume or
 // Channel.Get.
 type Delivery struct {
 	amqp.Delivery
+	// scope is set while the delivery goes through the middleware
+	scope *deliveryScope
+}
+
+// Ack acknowledges the delivery to the server. A delivery the handler settles itself
+// isn't acked or nacked again by the consumer. Handlers of consumers started with
+// WithConsumeOptionsConsumerManualAck must always settle their deliveries.
+func (d Delivery) Ack() error {
+	return d.Delivery.Ack(false)
+}
+
+// Nack negatively acknowledges the delivery to the server. If requeue is
+// true the server will attempt to requeue the message, otherwise it is
+// dropped or dead-lettered. A delivery the handler settles itself isn't
+// acked or nacked again by the consumer.
+func (d Delivery) Nack(requeue bool) error {
+	return d.Delivery.Nack(false, requeue)
+}
+
+// Reject rejects the delivery. If requeue is true the server will attempt
+// to requeue the message, otherwise it is dropped or dead-lettered. A delivery
+// the handler settles itself isn't acked or nacked again by the consumer.
+func (d Delivery) Reject(requeue bool) error {
+	return d.Delivery.Reject(requeue)
+}
+
+// AckMultiple acknowledges the delivery along with every delivery received before it on the same
+// channel and not settled yet, by their DeliveryTag, so a handler batching its work can ack a batch
+// at once. It's meant for WithConsumeOptionsConsumerManualAck, otherwise the consumer settles the
+// earlier deliveries again once their handlers return, which the server treats as a channel error.
+// With a concurrency above one the earlier deliveries may still be handled by other goroutines,
+// which then mustn't settle them. Settling is safe from concurrent goroutines.
+// Delivery tags belong to a channel: after a reconnection the deliveries that weren't acked are
+// redelivered with new tags, and settling the old ones fails
+func (d Delivery) AckMultiple() error {
+	return d.Delivery.Ack(true)
+}
+
+// NackMultiple negatively acknowledges the delivery along with every delivery received before
+// it on the same channel and not settled yet, the same way AckMultiple acks them
+func (d Delivery) NackMultiple(requeue bool) error {
+	return d.Delivery.Nack(true, requeue)
+}
+
+// settleOnceAcknowledger wraps a delivery's acknowledger and records whether the delivery
+// has already been acked, nacked or rejected, so the consumer doesn't settle it a second time
+// after the handler did, which the server treats as a channel error
+type settleOnceAcknowledger struct {
+	amqp.Acknowledger
+	settled int32
+}
+
+func (a *settleOnceAcknowledger) Ack(tag uint64, multiple bool) error {
+	atomic.StoreInt32(&a.settled, 1)
+	return a.Acknowledger.Ack(tag, multiple)
+}
+
+func (a *settleOnceAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	atomic.StoreInt32(&a.settled, 1)
+	return a.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (a *settleOnceAcknowledger) Reject(tag uint64, requeue bool) error {
+	atomic.StoreInt32(&a.settled, 1)
+	return a.Acknowledger.Reject(tag, requeue)
+}
+
+// newDelivery wraps the amqp delivery so that it keeps track of being settled
+func newDelivery(msg amqp.Delivery) Delivery {
+	msg.Acknowledger = &settleOnceAcknowledger{Acknowledger: msg.Acknowledger}
+	return Delivery{Delivery: msg}
+}
+
+// isSettled returns true if the delivery has already been acked, nacked or rejected
+func (d Delivery) isSettled() bool {
+	acknowledger, ok := d.Acknowledger.(*settleOnceAcknowledger)
+	return ok && atomic.LoadInt32(&acknowledger.settled) == 1
 }
 
 // NewConsumer returns a new Consumer connected to the given rabbitmq server
 func NewConsumer(url string, config amqp.Config, optionFuncs ...func(*ConsumerOptions)) (Consumer, error) {
+	options := getConsumerOptions(optionFuncs...)
+	chManager, err := newChannelManager(append([]string{url}, options.URLs...), withTimeouts(withClientProperties(config, options.ClientProperties), options.Heartbeat, options.DialTimeout), fieldLogger{leveled: options.LeveledLogger, structured: options.StructuredLogger}, options.Observer, options.ReconnectBackoff, options.MaxReconnectAttempts, options.lifecycleHooks())
+	if err != nil {
+		return Consumer{}, err
+	}
+	return newConsumer(chManager, options), nil
+}
+
+// getConsumerOptions applies the option funcs and fills in the defaults
+func getConsumerOptions(optionFuncs ...func(*ConsumerOptions)) *ConsumerOptions {
 	options := &ConsumerOptions{}
 	for _, optionFunc := range optionFuncs {
 		optionFunc(options)
@@ -38,36 +230,159 @@ func NewConsumer(url string, config amqp.Config, optionFuncs ...func(*ConsumerOp
 	if options.Logger == nil {
 		options.Logger = &noLogger{} // default no logging
 	}
+	options.LeveledLogger = getLeveledLogger(options.LeveledLogger, options.Logger, options.LogLevel)
+	if options.Observer == nil {
+		options.Observer = &noObserver{}
+	}
+	return options
+}
 
-	chManager, err := newChannelManager(url, config, options.Logger)
+// NewConsumerTLS works like NewConsumer but connects over TLS with the given config,
+// which requires an amqps:// url. The connection uses the same defaults as amqp.DialTLS
+func NewConsumerTLS(url string, config *tls.Config, optionFuncs ...func(*ConsumerOptions)) (Consumer, error) {
+	return NewConsumerTLSWithConfig(url, getTLSConfig(config), config, optionFuncs...)
+}
+
+// NewConsumerTLSWithConfig works like NewConsumerTLS but dials with the given amqp config,
+// so the heartbeat, locale, dialer or channel max can be set. tlsConfig is used as its TLSClientConfig
+func NewConsumerTLSWithConfig(url string, config amqp.Config, tlsConfig *tls.Config, optionFuncs ...func(*ConsumerOptions)) (Consumer, error) {
+	err := checkTLSURL(url)
 	if err != nil {
 		return Consumer{}, err
 	}
+	config.TLSClientConfig = tlsConfig
+	return NewConsumer(url, config, optionFuncs...)
+}
+
+func newConsumer(chManager *channelManager, options *ConsumerOptions) Consumer {
 	consumer := Consumer{
-		chManager: chManager,
-		logger:    options.Logger,
+		chManager:            chManager,
+		logger:               chManager.logger,
+		observer:             options.Observer,
+		propagator:           options.Propagator,
+		shutdownTimeout:      options.ShutdownTimeout,
+		backoff:              options.ReconnectBackoff.withDefaults(),
+		maxReconnectAttempts: options.MaxReconnectAttempts,
+		closedChan:           make(chan error, 1),
+		done:                 make(chan struct{}),
+		closeOnce:            &sync.Once{},
+		reconnectCallback:    options.ReconnectCallback,
+		reconnectedCallback:  options.ReconnectedCallback,
+		consumers:            map[string]*consumption{},
+		consumersMux:         &sync.Mutex{},
+		startMux:             &sync.Mutex{},
+		qosMux:               &sync.Mutex{},
 	}
-	return consumer, nil
+	go func() {
+		err, ok := <-chManager.notifyClosed
+		if ok {
+			consumer.closeWithError(err)
+		}
+	}()
+	return consumer
 }
 
-func NewConsumerTLS(url string, config *tls.Config, optionFuncs ...func(*ConsumerOptions)) (Consumer, error) {
-	options := &ConsumerOptions{}
-	for _, optionFunc := range optionFuncs {
-		optionFunc(options)
+// NotifyClosed returns a channel that receives the error that made the consumer give up
+// reconnecting, after which it is closed. The consumer gives up right away on the errors
+// IsRetryable reports as permanent. It's also closed without an error by StopConsuming
+func (consumer Consumer) NotifyClosed() <-chan error {
+	return consumer.closedChan
+}
+
+// Channel returns the channel the consumer currently uses. The channel is replaced when
+// reconnecting, so it may be closed by the time it's used and shouldn't be kept around.
+// Closing it or changing its mode interferes with the consumer, WithChannel should be preferred
+func (consumer Consumer) Channel() *amqp.Channel {
+	consumer.chManager.channelMux.RLock()
+	defer consumer.chManager.channelMux.RUnlock()
+	return consumer.chManager.channel
+}
+
+// WithChannel calls fn with the channel the consumer currently uses and returns its error.
+// The channel isn't replaced by a reconnection while fn runs, fn shouldn't keep it around
+func (consumer Consumer) WithChannel(fn func(*amqp.Channel) error) error {
+	return consumer.chManager.withChannel(fn)
+}
+
+// IsConnected reports whether the consumer currently has an open channel to the server,
+// it's false while reconnecting and after the consumer was closed
+func (consumer Consumer) IsConnected() bool {
+	return consumer.chManager.isConnected()
+}
+
+// closeWithError notifies the listeners of NotifyClosed, err is only sent when not nil
+func (consumer Consumer) closeWithError(err error) {
+	consumer.closeOnce.Do(func() {
+		if err != nil {
+			consumer.logger.Log(LogLevelError, "consumer closed", map[string]interface{}{
+				"error": err,
+			})
+			consumer.closedChan <- err
+		}
+		close(consumer.closedChan)
+		close(consumer.done)
+	})
+}
+
+// giveUp closes the consumer with the error that keeps it from consuming, along with its
+// channel manager so that nothing reconnects or consumes anymore
+func (consumer Consumer) giveUp(err error) {
+	consumer.closeWithError(err)
+	err = consumer.chManager.close()
+	if err != nil {
+		consumer.logger.Log(LogLevelWarn, "couldn't close the connection after giving up", map[string]interface{}{
+			"error": err,
+		})
 	}
-	if options.Logger == nil {
-		options.Logger = &noLogger{} // default no logging
+}
+
+// WithConsumerOptionsConnectionName returns a function that sets the name of the connection,
+// which is shown in the RabbitMQ management UI
+func WithConsumerOptionsConnectionName(name string) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		if options.ClientProperties == nil {
+			options.ClientProperties = Table{}
+		}
+		options.ClientProperties["connection_name"] = name
 	}
+}
 
-	chManager, err := newChannelManagerTLS(url, config, options.Logger)
-	if err != nil {
-		return Consumer{}, err
+// WithConsumerOptionsClientProperties returns a function that adds properties
+// the client advertises to the server when connecting
+func WithConsumerOptionsClientProperties(properties Table) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		if options.ClientProperties == nil {
+			options.ClientProperties = Table{}
+		}
+		for key, value := range properties {
+			options.ClientProperties[key] = value
+		}
 	}
-	consumer := Consumer{
-		chManager: chManager,
-		logger:    options.Logger,
+}
+
+// WithConsumerOptionsHeartbeat returns a function that sets the heartbeat interval of the connection,
+// which overrides the one of the amqp.Config. It defaults to 10 seconds
+func WithConsumerOptionsHeartbeat(heartbeat time.Duration) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		options.Heartbeat = heartbeat
+	}
+}
+
+// WithConsumerOptionsDialTimeout returns a function that sets how long dialing the server may take,
+// which overrides the dialer of the amqp.Config. It defaults to 30 seconds
+func WithConsumerOptionsDialTimeout(timeout time.Duration) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		options.DialTimeout = timeout
+	}
+}
+
+// WithConsumerOptionsURLs returns a function that adds the urls of other nodes of the cluster.
+// The nodes are tried in random order when connecting, and again when reconnecting,
+// starting with the ones that weren't connected to last
+func WithConsumerOptionsURLs(urls ...string) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		options.URLs = append(options.URLs, urls...)
 	}
-	return consumer, nil
 }
 
 // WithConsumerOptionsLogging sets a logger to log to stdout
@@ -85,182 +400,1468 @@ func WithConsumerOptionsLogger(log Logger) func(options *ConsumerOptions) {
 	}
 }
 
-// StartConsuming starts n goroutines where n="ConsumeOptions.QosOptions.Concurrency".
-// Each goroutine spawns a handler that consumes off of the qiven queue which binds to the routing key(s).
-// The provided handler is called once for each message. If the provided queue doesn't exist, it
-// will be created on the cluster
-func (consumer Consumer) StartConsuming(
-	handler func(d Delivery) bool,
-	queue string,
-	routingKeys []string,
-	optionFuncs ...func(*ConsumeOptions),
-) error {
-	defaultOptions := getDefaultConsumeOptions()
-	options := &ConsumeOptions{}
-	for _, optionFunc := range optionFuncs {
-		optionFunc(options)
+// WithConsumerOptionsLeveledLogger sets logging to a custom interface that receives
+// the level of every log, it takes precedence over the Logger
+func WithConsumerOptionsLeveledLogger(log LeveledLogger) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		options.Logging = true
+		options.LeveledLogger = log
+	}
+}
+
+// WithConsumerOptionsStructuredLogger sets logging to a custom interface that receives
+// the level and fields of every log, it takes precedence over the other loggers
+func WithConsumerOptionsStructuredLogger(log StructuredLogger) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		options.Logging = true
+		options.StructuredLogger = log
+	}
+}
+
+// WithConsumerOptionsLogLevel sets the minimum level of the logs sent to the Logger,
+// the default is LogLevelDebug which logs everything
+func WithConsumerOptionsLogLevel(level LogLevel) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		options.LogLevel = level
+	}
+}
+
+// WithConsumerOptionsObserver sets the observer notified of deliveries and reconnects
+func WithConsumerOptionsObserver(observer Observer) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		options.Observer = observer
+	}
+}
+
+// WithConsumerOptionsPropagator sets the propagator used to extract trace contexts from the message
+// headers, the resulting context is given to handlers started with StartConsumingContextHandler
+func WithConsumerOptionsPropagator(propagator Propagator) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		options.Propagator = propagator
+	}
+}
+
+// WithConsumerOptionsShutdownTimeout returns a function that sets how long StopConsuming
+// waits for running handlers to finish before forcing the connection closed
+func WithConsumerOptionsShutdownTimeout(timeout time.Duration) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		options.ShutdownTimeout = timeout
+	}
+}
+
+// WithConsumerOptionsReconnectCallback returns a function that sets a callback invoked before each
+// attempt to resume consuming after the channel was cancelled or closed. It receives the attempt number,
+// starting at 1, and the error that caused the reconnection or made the previous attempt fail.
+// The cause is a *CloseError when the channel or the connection was closed, telling which,
+// and a *CancelError when the server cancelled the consumer, for instance because its queue was deleted.
+// The callback runs on the reconnect loop so it should return quickly
+func WithConsumerOptionsReconnectCallback(callback func(attempt int, err error)) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		options.ReconnectCallback = callback
+	}
+}
+
+// WithConsumerOptionsOnConnect returns a function that sets a callback invoked once the channel is open,
+// before the constructor returns and after every reconnection, for instance to declare topology.
+// After a reconnection it's called before consuming resumes. The callbacks run on the reconnect loop
+// so they should return quickly
+func WithConsumerOptionsOnConnect(callback func()) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		options.OnConnect = callback
+	}
+}
+
+// WithConsumerOptionsOnDisconnect returns a function that sets a callback invoked when the channel is
+// lost, with the cause of the reconnection, a *CloseError or a *CancelError
+func WithConsumerOptionsOnDisconnect(callback func(err error)) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		options.OnDisconnect = callback
+	}
+}
+
+// WithConsumerOptionsOnReconnect returns a function that sets a callback invoked before each attempt
+// to open the channel again, with the attempt number starting at 1
+func WithConsumerOptionsOnReconnect(callback func(attempt int)) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		options.OnReconnect = callback
+	}
+}
+
+// lifecycleHooks returns the callbacks the channel manager calls
+func (options ConsumerOptions) lifecycleHooks() lifecycleHooks {
+	return lifecycleHooks{
+		onConnect:    options.OnConnect,
+		onDisconnect: options.OnDisconnect,
+		onReconnect:  options.OnReconnect,
+	}
+}
+
+// WithConsumerOptionsReconnectedCallback returns a function that sets a callback invoked once consuming
+// successfully resumes after the channel was cancelled or closed.
+// The callback runs on the reconnect loop so it should return quickly
+func WithConsumerOptionsReconnectedCallback(callback func()) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		options.ReconnectedCallback = callback
+	}
+}
+
+// WithConsumerOptionsReconnectBackoff returns a function that sets the backoff used between reconnect
+// attempts, both for the connection and for resuming consumption. The first attempt waits initial, and every
+// following attempt waits multiplier times longer than the previous one, up to max. A max of zero means
+// there is no limit. By default the backoff starts at one second and doubles on every attempt
+func WithConsumerOptionsReconnectBackoff(initial, max time.Duration, multiplier float64) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		options.ReconnectBackoff.Initial = initial
+		options.ReconnectBackoff.Max = max
+		options.ReconnectBackoff.Multiplier = multiplier
+	}
+}
+
+// WithConsumerOptionsReconnectJitter randomizes the wait between reconnect attempts, which prevents
+// many consumers from reconnecting at the same time after an outage
+func WithConsumerOptionsReconnectJitter(options *ConsumerOptions) {
+	options.ReconnectBackoff.Jitter = true
+}
+
+// withConsumerOptionsClock returns a function that sets the clock waiting for the backoff
+// between reconnect attempts, so the tests don't have to wait for it
+func withConsumerOptionsClock(c clock) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		options.ReconnectBackoff.clock = c
+	}
+}
+
+// WithConsumerOptionsMaxReconnectAttempts returns a function that sets the number of failed reconnect
+// attempts after which the consumer gives up and sends the last error on NotifyClosed.
+// Zero, the default, means the consumer never gives up
+func WithConsumerOptionsMaxReconnectAttempts(n int) func(options *ConsumerOptions) {
+	return func(options *ConsumerOptions) {
+		options.MaxReconnectAttempts = n
+	}
+}
+
+// StartConsuming starts n goroutines where n="ConsumeOptions.QosOptions.Concurrency".
+// Each goroutine spawns a handler that consumes off of the qiven queue which binds to the routing key(s).
+// The provided handler is called once for each message. If the provided queue doesn't exist, it
+// will be created on the cluster. When WithConsumeOptionsConsumerManualAck is used the handler's
+// return value is ignored and the handler is responsible for acking the delivery itself
+func (consumer Consumer) StartConsuming(
+	handler func(d Delivery) bool,
+	queue string,
+	routingKeys []string,
+	optionFuncs ...func(*ConsumeOptions),
+) error {
+	options := getConsumeOptions(optionFuncs...)
+	_, err := consumer.startConsuming(
+		context.Background(),
+		contextHandler(handler),
+		queue,
+		routingKeys,
+		options,
+		&sync.WaitGroup{},
+	)
+	return wrapError(err)
+}
+
+// StartConsumingActionHandler works like StartConsuming but the handler returns the action to
+// settle the delivery with, which can nack it without requeueing or reject it
+func (consumer Consumer) StartConsumingActionHandler(
+	handler func(d Delivery) Action,
+	queue string,
+	routingKeys []string,
+	optionFuncs ...func(*ConsumeOptions),
+) error {
+	options := getConsumeOptions(optionFuncs...)
+	_, err := consumer.startConsuming(
+		context.Background(),
+		func(_ context.Context, d Delivery) Action {
+			return handler(d)
+		},
+		queue,
+		routingKeys,
+		options,
+		&sync.WaitGroup{},
+	)
+	return wrapError(err)
+}
+
+// StartConsumingContextHandler works like StartConsuming but the handler receives a context.
+// The context is cancelled once the timeout set by WithConsumeOptionsHandlerTimeout elapses,
+// in which case the delivery is nacked whatever the handler returns
+func (consumer Consumer) StartConsumingContextHandler(
+	handler func(ctx context.Context, d Delivery) bool,
+	queue string,
+	routingKeys []string,
+	optionFuncs ...func(*ConsumeOptions),
+) error {
+	options := getConsumeOptions(optionFuncs...)
+	_, err := consumer.startConsuming(
+		context.Background(),
+		boolHandler(handler),
+		queue,
+		routingKeys,
+		options,
+		&sync.WaitGroup{},
+	)
+	return wrapError(err)
+}
+
+// StartConsumingTempQueue works like StartConsuming but consumes from a new exclusive, auto-delete
+// queue, whose name is returned so it can be handed out, for instance as the ReplyTo of requests.
+// The name is generated by the consumer rather than the server, since the queue is deleted when the
+// connection is lost and names generated by the server can't be declared again after a reconnection.
+// Messages sent to the queue while the consumer is reconnecting are lost
+func (consumer Consumer) StartConsumingTempQueue(
+	handler func(d Delivery) bool,
+	routingKeys []string,
+	optionFuncs ...func(*ConsumeOptions),
+) (string, error) {
+	options := getConsumeOptions(optionFuncs...)
+	options.QueueExclusive = true
+	options.QueueAutoDelete = true
+	queue := "temp-" + randomID()
+	_, err := consumer.startConsuming(
+		context.Background(),
+		contextHandler(handler),
+		queue,
+		routingKeys,
+		options,
+		&sync.WaitGroup{},
+	)
+	if err != nil {
+		return "", wrapError(err)
+	}
+	return queue, nil
+}
+
+// Deliveries declares and binds the queue as StartConsuming does, but returns a channel the deliveries
+// are sent on instead of calling a handler. Every delivery must be acked, nacked or rejected by the
+// caller, unless ConsumerAutoAck is set. The channel keeps receiving deliveries
+// after a reconnection and is closed once the consumer is closed.
+// Only the options related to topology and the amqp consumer apply, there is no handler to wrap
+func (consumer Consumer) Deliveries(
+	queue string,
+	routingKeys []string,
+	optionFuncs ...func(*ConsumeOptions),
+) (<-chan Delivery, error) {
+	options := getConsumeOptions(optionFuncs...)
+	if !options.ConsumerAutoAck {
+		options.ConsumerManualAck = true
+	}
+	deliveries := make(chan Delivery)
+	handlerWG := &sync.WaitGroup{}
+	_, err := consumer.startConsuming(
+		context.Background(),
+		func(_ context.Context, d Delivery) Action {
+			select {
+			case deliveries <- d:
+			case <-consumer.done:
+			}
+			return Ack
+		},
+		queue,
+		routingKeys,
+		options,
+		handlerWG,
+	)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	go func() {
+		<-consumer.done
+		// the handlers can't send anymore once they're done
+		handlerWG.Wait()
+		close(deliveries)
+	}()
+	return deliveries, nil
+}
+
+// contextHandler adapts a handler that doesn't use a context
+func contextHandler(handler func(d Delivery) bool) func(ctx context.Context, d Delivery) Action {
+	return func(_ context.Context, d Delivery) Action {
+		return actionOf(handler(d))
+	}
+}
+
+// boolHandler adapts a handler that tells whether to ack the delivery
+func boolHandler(handler func(ctx context.Context, d Delivery) bool) func(ctx context.Context, d Delivery) Action {
+	return func(ctx context.Context, d Delivery) Action {
+		return actionOf(handler(ctx, d))
+	}
+}
+
+// actionOf returns the action a handler returning ack means
+func actionOf(ack bool) Action {
+	if ack {
+		return Ack
+	}
+	return NackRequeue
+}
+
+// StartConsumingWithContext works like StartConsuming but blocks until the given context is done.
+// Once the context is done the consumer stops receiving new deliveries, waits for the handlers
+// that are still running to finish, and then returns. Reconnection attempts are abandoned
+// when the context is done. An error is only returned if consuming couldn't be started
+func (consumer Consumer) StartConsumingWithContext(
+	ctx context.Context,
+	handler func(d Delivery) bool,
+	queue string,
+	routingKeys []string,
+	optionFuncs ...func(*ConsumeOptions),
+) error {
+	options := getConsumeOptions(optionFuncs...)
+	handlerWG := &sync.WaitGroup{}
+	reconnectDone, err := consumer.startConsuming(
+		ctx,
+		contextHandler(handler),
+		queue,
+		routingKeys,
+		options,
+		handlerWG,
+	)
+	if err != nil {
+		return wrapError(err)
+	}
+
+	<-ctx.Done()
+	<-reconnectDone
+	consumer.cancelConsumer(options)
+	handlerWG.Wait()
+	consumer.forgetConsumer(options.ConsumerName)
+	return nil
+}
+
+// getConsumeOptions applies the option funcs and fills in the defaults
+// for values that weren't provided
+func getConsumeOptions(optionFuncs ...func(*ConsumeOptions)) ConsumeOptions {
+	defaultOptions := getDefaultConsumeOptions()
+	options := &ConsumeOptions{}
+	for _, optionFunc := range optionFuncs {
+		optionFunc(options)
+	}
+	if options.Concurrency < 1 {
+		options.Concurrency = defaultOptions.Concurrency
+	}
+	if options.ConsumerName == "" {
+		// a known consumer tag is needed to cancel the consumer
+		options.ConsumerName = uniqueConsumerTag()
+	}
+	return *options
+}
+
+// startConsuming starts the consumer goroutines and a goroutine that restarts them
+// whenever the channel is cancelled or closed, until the context is done.
+// The returned channel is closed once the restart goroutine has exited
+func (consumer Consumer) startConsuming(
+	ctx context.Context,
+	handler func(ctx context.Context, d Delivery) Action,
+	queue string,
+	routingKeys []string,
+	options ConsumeOptions,
+	handlerWG *sync.WaitGroup,
+) (<-chan struct{}, error) {
+	// the consumption can only be cancelled by the limit once it's registered
+	registered := make(chan struct{})
+	if options.MaxMessages > 0 {
+		handler = consumer.limitMessages(handler, options, handlerWG, registered)
+	}
+	if options.ValidateRoutingKeys {
+		err := validateRoutingKeys(getBindingDeclarations(options, routingKeys))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.ConsumerPerWorker && options.DispatchMode == PerMessage {
+		return nil, errors.New("a consumer per worker requires the WorkerPool dispatch mode")
+	}
+	if options.ConsumerPerWorker && options.BatchAckSize > 0 {
+		return nil, errors.New("batch acks can't be used with a consumer per worker")
+	}
+	err := validateQueueType(options)
+	if err != nil {
+		return nil, err
+	}
+	consumer.startMux.Lock()
+	defer consumer.startMux.Unlock()
+	err = consumer.checkAdaptivePrefetch(options)
+	if err != nil {
+		return nil, err
+	}
+	if options.AdaptivePrefetchMax == 0 && !options.ConsumerPerWorker &&
+		options.QOSPrefetch > 0 && options.Concurrency > options.QOSPrefetch {
+		consumer.logger.Log(LogLevelWarn, "concurrency is higher than the prefetch count, some goroutines will be idle", map[string]interface{}{
+			"queue":       queue,
+			"concurrency": options.Concurrency,
+			"prefetch":    options.QOSPrefetch,
+		})
+	}
+	if options.StallMaxInFlight > 0 || options.StallMaxAge > 0 {
+		options.stallDetector = newStallDetector(options)
+	}
+	if options.MaxConcurrentHandlers > 0 {
+		options.handlerSemaphore = make(chan struct{}, options.MaxConcurrentHandlers)
+	}
+	var prefetch *prefetchController
+	if options.AdaptivePrefetchMax > 0 {
+		if options.AdaptivePrefetchMin < 1 {
+			options.AdaptivePrefetchMin = 1
+		}
+		if options.AdaptivePrefetchMax < options.AdaptivePrefetchMin {
+			options.AdaptivePrefetchMax = options.AdaptivePrefetchMin
+		}
+		options.QOSPrefetch = options.AdaptivePrefetchMin
+		options.QOSGlobal = true
+		prefetch = newPrefetchController(consumer, options)
+		handler = prefetch.wrap(handler)
+	}
+	// the middleware is set up once, not every time consuming starts again
+	handler = applyMiddleware(handler, options.Middleware)
+	consumingOn, err := consumer.startGoroutines(
+		handler,
+		queue,
+		routingKeys,
+		options,
+		handlerWG,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	consumer.consumersMux.Lock()
+	consumer.consumers[options.ConsumerName] = &consumption{
+		seq:       atomic.AddUint64(&consumptionSeq, 1),
+		handlerWG: handlerWG,
+		cancel:    cancel,
+		handler:   handler,
+		queue:     queue,
+		options:   options,
+	}
+	consumer.consumersMux.Unlock()
+	close(registered)
+	if prefetch != nil {
+		go prefetch.run(ctx)
+	}
+	if options.stallDetector != nil {
+		go options.stallDetector.run(ctx, consumer, queue)
+	}
+
+	notifyReconnect, stopNotifyReconnect := consumer.chManager.notifyReconnect()
+	reconnectDone := make(chan struct{})
+	go func() {
+		defer close(reconnectDone)
+		defer stopNotifyReconnect()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-consumer.done:
+				return
+			case err := <-notifyReconnect:
+				if consumer.Channel() == consumingOn {
+					// the notification of a reconnection that happened while retrying to start
+					// consuming after an earlier one, consuming again would duplicate the goroutines
+					continue
+				}
+				var cancelErr *CancelError
+				if errors.As(err, &cancelErr) && isConsumerTag(options, cancelErr.ConsumerTag) {
+					if options.CancelHandler != nil {
+						options.CancelHandler(cancelErr.ConsumerTag)
+					}
+					if options.NoRecreateOnCancel {
+						consumer.logger.Log(LogLevelWarn, "consumer cancelled by the server, not consuming again", map[string]interface{}{
+							"queue":        queue,
+							"consumer_tag": cancelErr.ConsumerTag,
+						})
+						consumer.forgetConsumer(options.ConsumerName)
+						return
+					}
+				}
+				if IsConsumerTimeout(err) {
+					consumer.logger.Log(LogLevelError, "the server closed the channel because a delivery wasn't acked within its consumer timeout, "+
+						"handlers that take longer need a longer timeout, see WithConsumeOptionsConsumerTimeout", map[string]interface{}{
+						"queue": queue,
+						"error": err,
+					})
+				}
+				consumer.logger.Log(LogLevelInfo, "consume cancel/close handler triggered", map[string]interface{}{
+					"queue": queue,
+					"error": err,
+				})
+				channel, err := consumer.startGoroutinesWithRetries(
+					ctx,
+					err,
+					handler,
+					queue,
+					routingKeys,
+					options,
+					handlerWG,
+				)
+				if err != nil {
+					consumer.giveUp(err)
+					return
+				}
+				consumingOn = channel
+			}
+		}
+	}()
+	return reconnectDone, nil
+}
+
+// limitMessages wraps the handler so it's invoked at most MaxMessages times, after which the
+// consumption is cancelled. Deliveries received past the limit are requeued without being handled
+func (consumer Consumer) limitMessages(
+	handler func(ctx context.Context, d Delivery) Action,
+	options ConsumeOptions,
+	handlerWG *sync.WaitGroup,
+	registered <-chan struct{},
+) func(ctx context.Context, d Delivery) Action {
+	var handled int64
+	stopOnce := &sync.Once{}
+	return func(ctx context.Context, d Delivery) Action {
+		n := atomic.AddInt64(&handled, 1)
+		if n > int64(options.MaxMessages) {
+			return requeueUnhandled
+		}
+		action := handler(ctx, d)
+		if n == int64(options.MaxMessages) {
+			stopOnce.Do(func() {
+				consumer.logger.Infof("handled %d messages, cancelling consumer %s", options.MaxMessages, options.ConsumerName)
+				// the handlers are waited for, this one included, so it can't be done synchronously
+				go consumer.stopAfterLimit(options, handlerWG, registered)
+			})
+		}
+		return action
+	}
+}
+
+// stopAfterLimit cancels the consumption that reached its MaxMessages, waits for its handlers
+// and closes its MaxMessagesDone channel
+func (consumer Consumer) stopAfterLimit(options ConsumeOptions, handlerWG *sync.WaitGroup, registered <-chan struct{}) {
+	select {
+	case <-registered:
+		err := consumer.Cancel(options.ConsumerName)
+		if err != nil {
+			consumer.logger.Log(LogLevelWarn, "couldn't cancel consumer after its last message", map[string]interface{}{
+				"consumer_tag": options.ConsumerName,
+				"error":        err,
+			})
+		}
+	case <-consumer.done:
+	}
+	handlerWG.Wait()
+	if options.MaxMessagesDone != nil {
+		close(options.MaxMessagesDone)
+	}
+}
+
+// StopConsuming stops the consumption of messages.
+// The consumers are cancelled so no new deliveries are received, then the running handlers
+// are given the chance to finish and ack their messages before the channel and connection are closed.
+// The consumer should be discarded as it's not safe for re-use
+func (consumer Consumer) StopConsuming() {
+	consumer.consumersMux.Lock()
+	handlerWGs := []*sync.WaitGroup{}
+	for _, c := range consumer.consumers {
+		c.cancel()
+		consumer.cancelConsumer(c.options)
+		handlerWGs = append(handlerWGs, c.handlerWG)
+	}
+	consumer.consumersMux.Unlock()
+
+	handlersDone := make(chan struct{})
+	go func() {
+		for _, handlerWG := range handlerWGs {
+			handlerWG.Wait()
+		}
+		close(handlersDone)
+	}()
+	if consumer.shutdownTimeout > 0 {
+		select {
+		case <-handlersDone:
+		case <-time.After(consumer.shutdownTimeout):
+			consumer.logger.Warnf("handlers didn't finish within %s, closing the connection", consumer.shutdownTimeout)
+		}
+	} else {
+		<-handlersDone
+	}
+
+	consumer.chManager.close()
+	consumer.closeWithError(nil)
+}
+
+// InspectQueue returns the number of messages ready to be delivered and the number of consumers of the queue.
+// It declares the queue passively so it's never created, if the queue doesn't exist an error is returned
+// and the server closes the channel, which makes the consumer reconnect
+func (consumer Consumer) InspectQueue(name string) (messages int, consumers int, err error) {
+	consumer.chManager.channelMux.RLock()
+	defer consumer.chManager.channelMux.RUnlock()
+	queue, err := consumer.chManager.channel.QueueDeclarePassive(name, false, false, false, false, nil)
+	if err != nil {
+		return 0, 0, wrapError(err)
+	}
+	return queue.Messages, queue.Consumers, nil
+}
+
+// WaitForEmpty polls the queue every pollInterval until it has no messages ready to be delivered,
+// or returns the context's error once it's done. Messages delivered but not acked yet aren't counted,
+// so consumers may still be handling some when it returns. It returns right away on errors IsRetryable
+// reports as permanent, such as the queue not existing, and keeps polling through reconnections.
+// A zero pollInterval defaults to 1 second
+func (consumer Consumer) WaitForEmpty(ctx context.Context, queue string, pollInterval time.Duration) error {
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		messages, _, err := consumer.InspectQueue(queue)
+		if err != nil && !IsRetryable(err) {
+			return err
+		}
+		if err == nil && messages == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// PurgeQueue removes all messages from the queue that aren't waiting to be acknowledged
+// and returns the number of messages that were purged
+func (consumer Consumer) PurgeQueue(name string) (int, error) {
+	consumer.chManager.channelMux.RLock()
+	defer consumer.chManager.channelMux.RUnlock()
+	purged, err := consumer.chManager.channel.QueuePurge(name, false)
+	return purged, wrapError(err)
+}
+
+// DeleteQueue deletes the queue and returns the number of messages it held.
+// When ifUnused is true the queue is only deleted if it has no consumers, and when
+// ifEmpty is true only if it has no messages. When noWait is true the server's
+// confirmation isn't awaited
+func (consumer Consumer) DeleteQueue(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	consumer.chManager.channelMux.RLock()
+	defer consumer.chManager.channelMux.RUnlock()
+	deleted, err := consumer.chManager.channel.QueueDelete(name, ifUnused, ifEmpty, noWait)
+	return deleted, wrapError(err)
+}
+
+// BindExchange binds the destination exchange to the source exchange, so messages published to
+// the source with a matching routing key are routed to the destination as well.
+// When noWait is true the server's confirmation isn't awaited
+func (consumer Consumer) BindExchange(destination, source, routingKey string, noWait bool, args Table) error {
+	amqpArgs, err := tableToAMQPTable(args)
+	if err != nil {
+		return fmt.Errorf("invalid binding arguments: %w", err)
+	}
+	consumer.chManager.channelMux.RLock()
+	defer consumer.chManager.channelMux.RUnlock()
+	err = consumer.chManager.channel.ExchangeBind(destination, routingKey, source, noWait, amqpArgs)
+	return wrapError(err)
+}
+
+// UnbindExchange removes a binding created with BindExchange
+func (consumer Consumer) UnbindExchange(destination, source, routingKey string, noWait bool, args Table) error {
+	amqpArgs, err := tableToAMQPTable(args)
+	if err != nil {
+		return fmt.Errorf("invalid binding arguments: %w", err)
+	}
+	consumer.chManager.channelMux.RLock()
+	defer consumer.chManager.channelMux.RUnlock()
+	err = consumer.chManager.channel.ExchangeUnbind(destination, routingKey, source, noWait, amqpArgs)
+	return wrapError(err)
+}
+
+// ConsumerTag returns the tag of the first amqp consumer started with StartConsuming
+// that is still running, or an empty string if there is none.
+// The tag is either the one given with WithConsumeOptionsConsumerName or a generated one,
+// it's kept when the consumer is restarted after a reconnection
+func (consumer Consumer) ConsumerTag() string {
+	tags := consumer.ConsumerTags()
+	if len(tags) == 0 {
+		return ""
+	}
+	return tags[0]
+}
+
+// ConsumerTags returns the tags of all the running amqp consumers in the order they were started
+func (consumer Consumer) ConsumerTags() []string {
+	consumer.consumersMux.Lock()
+	defer consumer.consumersMux.Unlock()
+	tags := make([]string, 0, len(consumer.consumers))
+	for tag := range consumer.consumers {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return consumer.consumers[tags[i]].seq < consumer.consumers[tags[j]].seq
+	})
+	return tags
+}
+
+// Cancel cancels the amqp consumer with the given tag without closing the connection,
+// so no new deliveries are received and it isn't restarted after a reconnection.
+// Handlers that are still running can ack their deliveries
+func (consumer Consumer) Cancel(consumerTag string) error {
+	consumer.consumersMux.Lock()
+	c, ok := consumer.consumers[consumerTag]
+	delete(consumer.consumers, consumerTag)
+	consumer.consumersMux.Unlock()
+	if !ok {
+		return fmt.Errorf("no consumer with tag %s", consumerTag)
+	}
+	c.cancel()
+
+	consumer.chManager.channelMux.RLock()
+	defer consumer.chManager.channelMux.RUnlock()
+	for _, tag := range amqpConsumerTags(c.options) {
+		err := consumer.chManager.channel.Cancel(tag, false)
+		if err != nil {
+			return wrapError(err)
+		}
+	}
+	return nil
+}
+
+// Pause cancels the running amqp consumers so no new deliveries are received, the connection
+// and the topology are kept. Deliveries that were already received are still handled and acked.
+// The consumers aren't restarted after a reconnection until Resume is called
+func (consumer Consumer) Pause() error {
+	consumer.consumersMux.Lock()
+	tags := []string{}
+	for _, c := range consumer.consumers {
+		if !c.paused {
+			c.paused = true
+			tags = append(tags, amqpConsumerTags(c.options)...)
+		}
 	}
-	if options.Concurrency < 1 {
-		options.Concurrency = defaultOptions.Concurrency
+	consumer.consumersMux.Unlock()
+
+	consumer.chManager.channelMux.RLock()
+	defer consumer.chManager.channelMux.RUnlock()
+	for _, tag := range tags {
+		err := consumer.chManager.channel.Cancel(tag, false)
+		if err != nil {
+			return wrapError(fmt.Errorf("couldn't pause consumer %s: %w", tag, err))
+		}
 	}
+	return nil
+}
 
-	err := consumer.startGoroutines(
-		handler,
-		queue,
-		routingKeys,
-		*options,
-	)
-	if err != nil {
-		return err
+// Resume starts the amqp consumers cancelled by Pause again, with the same tags and options
+func (consumer Consumer) Resume() error {
+	consumer.consumersMux.Lock()
+	paused := []*consumption{}
+	for _, c := range consumer.consumers {
+		if c.paused {
+			c.paused = false
+			paused = append(paused, c)
+		}
 	}
+	consumer.consumersMux.Unlock()
 
-	go func() {
-		for err := range consumer.chManager.notifyCancelOrClose {
-			consumer.logger.Printf("consume cancel/close handler triggered. err: %v", err)
-			consumer.startGoroutinesWithRetries(
-				handler,
-				queue,
-				routingKeys,
-				*options,
-			)
+	consumer.chManager.channelMux.RLock()
+	defer consumer.chManager.channelMux.RUnlock()
+	for _, c := range paused {
+		err := consumer.consume(c.handler, c.queue, c.options, c.handlerWG)
+		if err != nil {
+			return wrapError(fmt.Errorf("couldn't resume consumer %s: %w", c.options.ConsumerName, err))
 		}
-	}()
+	}
 	return nil
 }
 
-// StopConsuming stops the consumption of messages.
-// The consumer should be discarded as it's not safe for re-use
-func (consumer Consumer) StopConsuming() {
-	consumer.chManager.channel.Close()
-	consumer.chManager.connection.Close()
+// isPaused reports whether the amqp consumer with the given tag is paused
+func (consumer Consumer) isPaused(consumerTag string) bool {
+	consumer.consumersMux.Lock()
+	defer consumer.consumersMux.Unlock()
+	c, ok := consumer.consumers[consumerTag]
+	return ok && c.paused
+}
+
+// forgetConsumer removes the amqp consumer from the running ones
+func (consumer Consumer) forgetConsumer(consumerTag string) {
+	consumer.consumersMux.Lock()
+	defer consumer.consumersMux.Unlock()
+	c, ok := consumer.consumers[consumerTag]
+	if ok {
+		c.cancel()
+		delete(consumer.consumers, consumerTag)
+	}
+}
+
+// cancelConsumer stops the server from sending new deliveries to the amqp consumers started for the options
+func (consumer Consumer) cancelConsumer(consumeOptions ConsumeOptions) {
+	consumer.chManager.channelMux.RLock()
+	defer consumer.chManager.channelMux.RUnlock()
+	for _, consumerTag := range amqpConsumerTags(consumeOptions) {
+		err := consumer.chManager.channel.Cancel(consumerTag, false)
+		if err != nil {
+			consumer.logger.Log(LogLevelWarn, "couldn't cancel consumer", map[string]interface{}{
+				"consumer_tag": consumerTag,
+				"error":        err,
+			})
+		}
+	}
 }
 
 // startGoroutinesWithRetries attempts to start consuming on a channel
-// with an exponential backoff
+// with an exponential backoff, giving up when the context is done.
+// cause is the error that made the consumer reconnect.
+// It returns the channel it started consuming on, nil if it gave up, along with
+// the error the consumer must be closed with when it ran out of attempts or the
+// error isn't retryable
 func (consumer Consumer) startGoroutinesWithRetries(
-	handler func(d Delivery) bool,
+	ctx context.Context,
+	cause error,
+	handler func(ctx context.Context, d Delivery) Action,
 	queue string,
 	routingKeys []string,
 	consumeOptions ConsumeOptions,
-) {
-	backoffTime := time.Second
-	for {
-		consumer.logger.Printf("waiting %s seconds to attempt to start consumer goroutines", backoffTime)
-		time.Sleep(backoffTime)
-		backoffTime *= 2
-		err := consumer.startGoroutines(
+	handlerWG *sync.WaitGroup,
+) (*amqp.Channel, error) {
+	err := cause
+	var channel *amqp.Channel
+	for attempt := 1; ; attempt++ {
+		if consumer.maxReconnectAttempts > 0 && attempt > consumer.maxReconnectAttempts {
+			return nil, fmt.Errorf("couldn't resume consuming after %d attempts: %w", consumer.maxReconnectAttempts, err)
+		}
+		backoffTime := consumer.backoff.duration(attempt)
+		consumer.logger.Log(LogLevelDebug, "waiting to attempt to start consumer goroutines", map[string]interface{}{
+			"queue":   queue,
+			"attempt": attempt,
+			"backoff": backoffTime,
+		})
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-consumer.done:
+			return nil, nil
+		case <-consumer.chManager.clock.After(backoffTime):
+		}
+		if consumer.reconnectCallback != nil {
+			consumer.reconnectCallback(attempt, err)
+		}
+		channel, err = consumer.startGoroutines(
 			handler,
 			queue,
 			routingKeys,
 			consumeOptions,
+			handlerWG,
 		)
 		if err != nil {
-			consumer.logger.Printf("couldn't start consumer goroutines. err: %v", err)
+			consumer.logger.Log(LogLevelWarn, "couldn't start consumer goroutines", map[string]interface{}{
+				"queue":   queue,
+				"attempt": attempt,
+				"error":   err,
+			})
+			if !IsRetryable(err) {
+				return nil, fmt.Errorf("can't resume consuming: %w", err)
+			}
 			continue
 		}
 		break
 	}
+	if consumer.reconnectedCallback != nil {
+		consumer.reconnectedCallback()
+	}
+	return channel, nil
 }
 
 // startGoroutines declares the queue if it doesn't exist,
 // binds the queue to the routing key(s), and starts the goroutines
-// that will consume from the queue
+// that will consume from the queue unless the consumer is paused.
+// The goroutines are tracked by handlerWG, they return once the channel they
+// consume from, which is returned, is closed or the amqp consumer is cancelled
 func (consumer Consumer) startGoroutines(
-	handler func(d Delivery) bool,
+	handler func(ctx context.Context, d Delivery) Action,
 	queue string,
 	routingKeys []string,
 	consumeOptions ConsumeOptions,
-) error {
+	handlerWG *sync.WaitGroup,
+) (*amqp.Channel, error) {
+	paused := consumer.isPaused(consumeOptions.ConsumerName)
 	consumer.chManager.channelMux.RLock()
 	defer consumer.chManager.channelMux.RUnlock()
+	channel := consumer.chManager.channel
+
+	err := consumer.declareTopology(queue, routingKeys, consumeOptions)
+	if err != nil {
+		return nil, err
+	}
+	if paused {
+		return channel, nil
+	}
+	err = consumer.consume(handler, queue, consumeOptions, handlerWG)
+	if err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+// declareQueue declares the queue and its retry queue. The caller must hold the channel lock
+func (consumer Consumer) declareQueue(queue string, consumeOptions ConsumeOptions) error {
+	queueArgs, err := tableToAMQPTable(consumeOptions.QueueArgs)
+	if err != nil {
+		return fmt.Errorf("invalid arguments for queue %s: %w", queue, err)
+	}
+	declareQueue := consumer.chManager.channel.QueueDeclare
+	if consumeOptions.QueuePassive {
+		declareQueue = consumer.chManager.channel.QueueDeclarePassive
+	}
+	if consumeOptions.Retry != nil && consumeOptions.Retry.DelayedExchange == "" {
+		err := consumer.declareRetryQueue(queue, consumeOptions)
+		if err != nil {
+			return err
+		}
+	}
+
+	if consumeOptions.QueuePassiveOnMismatch && !consumeOptions.QueuePassive {
+		err := consumer.declareQueueOnOwnChannel(queue, queueArgs, consumeOptions)
+		if !isPreconditionFailed(err) {
+			return err
+		}
+		consumer.logger.Log(LogLevelWarn, "queue exists with other arguments, consuming from it as it is", map[string]interface{}{
+			"queue": queue,
+			"error": err,
+		})
+		if consumeOptions.QueueDeclareErrorHandler != nil {
+			consumeOptions.QueueDeclareErrorHandler(queue, err)
+		}
+		declareQueue = consumer.chManager.channel.QueueDeclarePassive
+	}
+
+	_, err = declareQueue(
+		queue,
+		consumeOptions.QueueDurable,
+		consumeOptions.QueueAutoDelete,
+		consumeOptions.QueueExclusive,
+		consumeOptions.QueueNoWait,
+		queueArgs,
+	)
+	if err != nil {
+		if consumeOptions.QueuePassive {
+			return fmt.Errorf("queue %s doesn't exist: %w", queue, err)
+		}
+		if isPreconditionFailed(err) && consumeOptions.QueueDeclareErrorHandler != nil {
+			consumeOptions.QueueDeclareErrorHandler(queue, err)
+		}
+		return err
+	}
+	return nil
+}
 
-	_, err := consumer.chManager.channel.QueueDeclare(
+// declareQueueOnOwnChannel declares the queue on a new channel of the connection,
+// so the consumer's channel isn't closed if the declare fails
+func (consumer Consumer) declareQueueOnOwnChannel(queue string, queueArgs amqp.Table, consumeOptions ConsumeOptions) error {
+	channel, err := consumer.chManager.connection.Channel()
+	if err != nil {
+		return err
+	}
+	_, err = channel.QueueDeclare(
 		queue,
 		consumeOptions.QueueDurable,
 		consumeOptions.QueueAutoDelete,
 		consumeOptions.QueueExclusive,
 		consumeOptions.QueueNoWait,
-		tableToAMQPTable(consumeOptions.QueueArgs),
+		queueArgs,
 	)
 	if err != nil {
 		return err
 	}
+	return channel.Close()
+}
+
+// declareTopology declares the dead letter exchange, the queue, the binding exchanges
+// and the bindings. The caller must hold the channel lock
+func (consumer Consumer) declareTopology(
+	queue string,
+	routingKeys []string,
+	consumeOptions ConsumeOptions,
+) error {
+	if consumeOptions.DeadLetterKind != "" {
+		deadLetterExchange, _ := consumeOptions.QueueArgs["x-dead-letter-exchange"].(string)
+		if deadLetterExchange == "" {
+			return fmt.Errorf("declaring dead letter exchange but name not specified")
+		}
+		err := consumer.chManager.channel.ExchangeDeclare(
+			deadLetterExchange,
+			consumeOptions.DeadLetterKind,
+			true,
+			false,
+			false,
+			false,
+			nil,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !consumeOptions.QueueNoDeclare {
+		err := consumer.declareQueue(queue, consumeOptions)
+		if err != nil {
+			return err
+		}
+	}
 
-	if consumeOptions.BindingExchange != nil {
-		exchange := consumeOptions.BindingExchange
+	var err error
+	for _, binding := range getBindingDeclarations(consumeOptions, routingKeys) {
+		exchange := binding.Exchange
 		if exchange.Name == "" {
 			return fmt.Errorf("binding to exchange but name not specified")
 		}
-		err = consumer.chManager.channel.ExchangeDeclare(
+		exchangeArgs := exchange.ExchangeArgs
+		if exchange.AlternateExchange != "" {
+			if exchange.DeclareAlternateExchange {
+				err = declareAlternateExchange(consumer.chManager.channel, exchange.AlternateExchange, exchange.Durable)
+				if err != nil {
+					return err
+				}
+			}
+			exchangeArgs = alternateExchangeArgs(exchangeArgs, exchange.AlternateExchange)
+		}
+		amqpExchangeArgs, err := tableToAMQPTable(exchangeArgs)
+		if err != nil {
+			return fmt.Errorf("invalid arguments for exchange %s: %w", exchange.Name, err)
+		}
+		declareExchange := consumer.chManager.channel.ExchangeDeclare
+		if exchange.Passive {
+			declareExchange = consumer.chManager.channel.ExchangeDeclarePassive
+		}
+		err = declareExchange(
 			exchange.Name,
 			exchange.Kind,
 			exchange.Durable,
 			exchange.AutoDelete,
 			exchange.Internal,
 			exchange.NoWait,
-			tableToAMQPTable(exchange.ExchangeArgs),
+			amqpExchangeArgs,
 		)
 		if err != nil {
+			if exchange.Passive {
+				return fmt.Errorf("exchange %s doesn't exist: %w", exchange.Name, err)
+			}
 			return err
 		}
-		for _, routingKey := range routingKeys {
+		bindingArgs, err := tableToAMQPTable(binding.Args)
+		if err != nil {
+			return fmt.Errorf("invalid arguments for binding to exchange %s: %w", exchange.Name, err)
+		}
+		bindingRoutingKeys := binding.RoutingKeys
+		if exchange.Kind == amqp.ExchangeHeaders {
+			// headers exchanges ignore routing keys, a single binding is enough
+			bindingRoutingKeys = []string{""}
+		}
+		for _, routingKey := range bindingRoutingKeys {
 			err = consumer.chManager.channel.QueueBind(
 				queue,
 				routingKey,
 				exchange.Name,
-				consumeOptions.BindingNoWait,
-				tableToAMQPTable(consumeOptions.BindingArgs),
+				binding.NoWait,
+				bindingArgs,
 			)
 			if err != nil {
+				if consumeOptions.QueueNoDeclare && isNotFound(err) {
+					return fmt.Errorf("queue %s doesn't exist: %w", queue, err)
+				}
 				return err
 			}
 		}
 	}
+	return nil
+}
 
+// consume starts the goroutines that will consume from the queue, tracked by handlerWG.
+// The caller must hold the channel lock
+func (consumer Consumer) consume(
+	handler func(ctx context.Context, d Delivery) Action,
+	queue string,
+	consumeOptions ConsumeOptions,
+	handlerWG *sync.WaitGroup,
+) error {
+	consumerArgs, err := tableToAMQPTable(consumeOptions.ConsumerArgs)
+	if err != nil {
+		return fmt.Errorf("invalid consumer arguments: %w", err)
+	}
+	// the channel is shared by every StartConsuming, their prefetch counts
+	// mustn't be interleaved with the consumers started by the others
+	consumer.qosMux.Lock()
+	defer consumer.qosMux.Unlock()
 	err = consumer.chManager.channel.Qos(
 		consumeOptions.QOSPrefetch,
-		0,
+		consumeOptions.QOSPrefetchSize,
 		consumeOptions.QOSGlobal,
 	)
 	if err != nil {
 		return err
 	}
 
-	msgs, err := consumer.chManager.channel.Consume(
-		queue,
-		consumeOptions.ConsumerName,
-		consumeOptions.ConsumerAutoAck,
-		consumeOptions.ConsumerExclusive,
-		consumeOptions.ConsumerNoLocal, // no-local is not supported by RabbitMQ
-		consumeOptions.ConsumerNoWait,
-		tableToAMQPTable(consumeOptions.ConsumerArgs),
-	)
-	if err != nil {
-		return err
+	tags := amqpConsumerTags(consumeOptions)
+	msgChans := make([]<-chan receivedDelivery, 0, len(tags))
+	for i, tag := range tags {
+		msgs, err := consumer.chManager.channel.Consume(
+			queue,
+			tag,
+			consumeOptions.ConsumerAutoAck,
+			consumeOptions.ConsumerExclusive,
+			consumeOptions.ConsumerNoLocal, // no-local is not supported by RabbitMQ
+			consumeOptions.ConsumerNoWait,
+			consumerArgs,
+		)
+		if err != nil {
+			for _, started := range tags[:i] {
+				// the consumers are all started again when retrying
+				_ = consumer.chManager.channel.Cancel(started, false)
+			}
+			if consumeOptions.QueueNoDeclare && isNotFound(err) {
+				return fmt.Errorf("queue %s doesn't exist: %w", queue, err)
+			}
+			return err
+		}
+		if consumeOptions.BatchAckSize > 0 && !consumeOptions.ConsumerAutoAck {
+			msgs = newBatchAcknowledger(consumer.chManager.channel, consumer.logger, consumeOptions).track(msgs)
+		}
+		msgChans = append(msgChans, receive(msgs, consumeOptions))
+	}
+
+	if consumeOptions.ConsumerPerWorker {
+		for _, msgs := range msgChans {
+			consumer.startWorkers(handler, queue, msgs, 1, consumeOptions, handlerWG)
+		}
+		consumer.logger.Debugf("Processing messages on %v goroutines with a consumer each", consumeOptions.Concurrency)
+		return nil
+	}
+	msgs := msgChans[0]
+	if consumeOptions.DispatchMode == PerMessage {
+		handlerWG.Add(1)
+		go consumer.dispatchPerMessage(handler, queue, msgs, consumeOptions, handlerWG)
+		consumer.logger.Debugf("Processing messages on up to %v goroutines", consumeOptions.Concurrency)
+		return nil
+	}
+	consumer.startWorkers(handler, queue, msgs, consumeOptions.Concurrency, consumeOptions, handlerWG)
+	consumer.logger.Debugf("Processing messages on %v goroutines", consumeOptions.Concurrency)
+	return nil
+}
+
+// checkAdaptivePrefetch returns an error if adaptive prefetch would share the channel with another
+// running consumer, since it sets a global prefetch count that would throttle the other one too
+func (consumer Consumer) checkAdaptivePrefetch(options ConsumeOptions) error {
+	consumer.consumersMux.Lock()
+	defer consumer.consumersMux.Unlock()
+	for _, c := range consumer.consumers {
+		if options.AdaptivePrefetchMax > 0 || c.options.AdaptivePrefetchMax > 0 {
+			return errors.New("adaptive prefetch sets the prefetch count of the whole channel, " +
+				"it can't be combined with other StartConsuming on the same Consumer")
+		}
+	}
+	return nil
+}
+
+// receivedDelivery is a delivery along with the time it was received from the server,
+// and its id for the stall detector
+type receivedDelivery struct {
+	msg      amqp.Delivery
+	received time.Time
+	id       uint64
+}
+
+// receive takes the deliveries from msgs as soon as they arrive and records when, so the time they
+// wait for a handler can be observed. They're buffered up to the prefetch count, which is how many
+// the server sends before some are acked, the returned channel is closed with msgs
+func receive(msgs <-chan amqp.Delivery, consumeOptions ConsumeOptions) <-chan receivedDelivery {
+	size := consumeOptions.QOSPrefetch
+	if consumeOptions.AdaptivePrefetchMax > size {
+		size = consumeOptions.AdaptivePrefetchMax
 	}
+	received := make(chan receivedDelivery, size)
+	go func() {
+		defer close(received)
+		for msg := range msgs {
+			delivery := receivedDelivery{msg: msg, received: time.Now()}
+			if consumeOptions.stallDetector != nil {
+				delivery.id = consumeOptions.stallDetector.add(delivery.received)
+			}
+			received <- delivery
+		}
+	}()
+	return received
+}
 
-	for i := 0; i < consumeOptions.Concurrency; i++ {
+// startWorkers starts n goroutines that handle the deliveries of msgs one at a time
+func (consumer Consumer) startWorkers(
+	handler func(ctx context.Context, d Delivery) Action,
+	queue string,
+	msgs <-chan receivedDelivery,
+	n int,
+	consumeOptions ConsumeOptions,
+	handlerWG *sync.WaitGroup,
+) {
+	for i := 0; i < n; i++ {
+		handlerWG.Add(1)
 		go func() {
+			defer handlerWG.Done()
 			for msg := range msgs {
-				if consumeOptions.ConsumerAutoAck {
-					handler(Delivery{msg})
-					continue
-				}
-				if handler(Delivery{msg}) {
-					err := msg.Ack(false)
-					if err != nil {
-						consumer.logger.Printf("can't ack message: %v", err)
-					}
-				} else {
-					err := msg.Nack(false, true)
-					if err != nil {
-						consumer.logger.Printf("can't nack message: %v", err)
-					}
-				}
+				consumer.handleDelivery(handler, queue, msg, consumeOptions)
 			}
-			consumer.logger.Printf("rabbit consumer goroutine closed")
+			consumer.logger.Debugf("rabbit consumer goroutine closed")
 		}()
 	}
-	consumer.logger.Printf("Processing messages on %v goroutines", consumeOptions.Concurrency)
-	return nil
+}
+
+// amqpConsumerTags returns the tags of the amqp consumers started for the options,
+// a single one with the consumer name unless there is a consumer per worker
+func amqpConsumerTags(consumeOptions ConsumeOptions) []string {
+	if !consumeOptions.ConsumerPerWorker {
+		return []string{consumeOptions.ConsumerName}
+	}
+	tags := make([]string, 0, consumeOptions.Concurrency)
+	for i := 1; i <= consumeOptions.Concurrency; i++ {
+		tags = append(tags, fmt.Sprintf("%s-%d", consumeOptions.ConsumerName, i))
+	}
+	return tags
+}
+
+// dispatchPerMessage handles every delivery in its own goroutine,
+// with at most Concurrency of them running at once
+func (consumer Consumer) dispatchPerMessage(
+	handler func(ctx context.Context, d Delivery) Action,
+	queue string,
+	msgs <-chan receivedDelivery,
+	consumeOptions ConsumeOptions,
+	handlerWG *sync.WaitGroup,
+) {
+	defer handlerWG.Done()
+	semaphore := make(chan struct{}, consumeOptions.Concurrency)
+	for msg := range msgs {
+		semaphore <- struct{}{}
+		handlerWG.Add(1)
+		go func(msg receivedDelivery) {
+			defer handlerWG.Done()
+			defer func() { <-semaphore }()
+			consumer.handleDelivery(handler, queue, msg, consumeOptions)
+		}(msg)
+	}
+	consumer.logger.Debugf("rabbit consumer goroutine closed")
+}
+
+// settleFailed logs an error settling the delivery with the queue and consumer tag it's from
+// and passes it on to the AckErrorHandler
+func (consumer Consumer) settleFailed(msg string, queue string, d Delivery, err error, consumeOptions ConsumeOptions) {
+	consumer.logger.Log(LogLevelError, msg, map[string]interface{}{
+		"queue":        queue,
+		"consumer_tag": d.ConsumerTag,
+		"error":        err,
+	})
+	if consumeOptions.AckErrorHandler != nil {
+		consumeOptions.AckErrorHandler(d, err)
+	}
+}
+
+// handleDelivery calls the handler with the delivery and acks or nacks it based on the outcome
+func (consumer Consumer) handleDelivery(
+	handler func(ctx context.Context, d Delivery) Action,
+	queue string,
+	received receivedDelivery,
+	consumeOptions ConsumeOptions,
+) {
+	if consumeOptions.stallDetector != nil {
+		defer consumeOptions.stallDetector.remove(received.id)
+	}
+	d := newDelivery(received.msg)
+	consumer.observer.IncConsumed(queue)
+	consumer.observer.ObserveDeliveryWait(queue, time.Since(received.received))
+	if consumeOptions.Filter != nil && !consumeOptions.Filter(d) {
+		if !consumeOptions.ConsumerAutoAck {
+			consumer.settleFiltered(queue, d, consumeOptions)
+		}
+		return
+	}
+	if consumeOptions.PoisonLimit > 0 && !consumeOptions.ConsumerAutoAck && d.IsPoison(consumeOptions.PoisonLimit) {
+		consumer.logger.Log(LogLevelWarn, "dead-lettering poison message", map[string]interface{}{
+			"queue":        queue,
+			"consumer_tag": d.ConsumerTag,
+			"attempt":      d.RetryCount(),
+		})
+		err := d.Nack(false)
+		if err != nil {
+			consumer.settleFailed("can't nack message", queue, d, err, consumeOptions)
+			return
+		}
+		consumer.observer.IncNacked(queue)
+		return
+	}
+	if consumeOptions.MaxDeaths > 0 && d.DeathCount(queue) >= consumeOptions.MaxDeaths {
+		consumer.logger.Log(LogLevelWarn, "message died too many times, acking it without handling it", map[string]interface{}{
+			"queue":        queue,
+			"consumer_tag": d.ConsumerTag,
+			"deaths":       d.DeathCount(queue),
+		})
+		if consumeOptions.MaxDeathsHandler != nil {
+			consumeOptions.MaxDeathsHandler(d)
+		}
+		if consumeOptions.ConsumerAutoAck || d.isSettled() {
+			return
+		}
+		err := d.Ack()
+		if err != nil {
+			consumer.settleFailed("can't ack message", queue, d, err, consumeOptions)
+			return
+		}
+		consumer.observer.IncAcked(queue)
+		return
+	}
+	if consumeOptions.handlerSemaphore != nil {
+		// the slot is taken before the handler timeout starts, waiting for it isn't handling
+		consumeOptions.handlerSemaphore <- struct{}{}
+	}
+	ctx := context.Background()
+	if consumer.propagator != nil {
+		ctx = consumer.propagator.Extract(ctx, HeaderCarrier(d.Headers))
+	}
+	if consumeOptions.HandlerTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, consumeOptions.HandlerTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	action := consumer.runHandler(ctx, handler, d)
+	if consumeOptions.handlerSemaphore != nil {
+		<-consumeOptions.handlerSemaphore
+	}
+	duration := time.Since(start)
+	consumer.observer.ObserveHandlerDuration(queue, duration)
+	if consumeOptions.SlowHandlerThreshold > 0 && duration > consumeOptions.SlowHandlerThreshold {
+		if consumeOptions.SlowHandlerCallback != nil {
+			consumeOptions.SlowHandlerCallback(d, duration)
+		} else {
+			consumer.logger.Log(LogLevelWarn, "slow handler", map[string]interface{}{
+				"queue":        queue,
+				"consumer_tag": d.ConsumerTag,
+				"duration":     duration,
+				"threshold":    consumeOptions.SlowHandlerThreshold,
+			})
+		}
+	}
+	if action == requeueUnhandled || action == ackUnhandled {
+		if !consumeOptions.ConsumerAutoAck && !d.isSettled() {
+			consumer.settleUnhandled(queue, d, action, consumeOptions)
+		}
+		return
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		consumer.logger.Log(LogLevelWarn, "handler timed out", map[string]interface{}{
+			"queue":        queue,
+			"consumer_tag": d.ConsumerTag,
+			"timeout":      consumeOptions.HandlerTimeout,
+		})
+		action = NackRequeue
+	}
+
+	if consumeOptions.ConsumerAutoAck || consumeOptions.ConsumerManualAck || d.isSettled() {
+		return
+	}
+	consumer.settle(queue, d, action, consumeOptions)
+}
+
+// settleUnhandled acks or requeues a delivery the handler was never given
+func (consumer Consumer) settleUnhandled(queue string, d Delivery, action Action, consumeOptions ConsumeOptions) {
+	if action == ackUnhandled {
+		err := d.Ack()
+		if err != nil {
+			consumer.settleFailed("can't ack message", queue, d, err, consumeOptions)
+			return
+		}
+		consumer.observer.IncAcked(queue)
+		return
+	}
+	err := d.Nack(true)
+	if err != nil {
+		consumer.settleFailed("can't nack message", queue, d, err, consumeOptions)
+		return
+	}
+	consumer.observer.IncNacked(queue)
+}
+
+// settleFiltered settles a delivery left out by the filter with the filtered action. The retry
+// options don't apply, requeueing it isn't a failed attempt since no handler saw it
+func (consumer Consumer) settleFiltered(queue string, d Delivery, consumeOptions ConsumeOptions) {
+	if consumeOptions.FilteredAction != NackRequeue {
+		consumer.settle(queue, d, consumeOptions.FilteredAction, consumeOptions)
+		return
+	}
+	err := d.Nack(true)
+	if err != nil {
+		consumer.settleFailed("can't nack message", queue, d, err, consumeOptions)
+		return
+	}
+	consumer.observer.IncNacked(queue)
+}
+
+// settle acks, nacks, rejects or retries the delivery as the action asks
+func (consumer Consumer) settle(queue string, d Delivery, action Action, consumeOptions ConsumeOptions) {
+	switch {
+	case action == Ack:
+		err := d.Ack()
+		if err != nil {
+			consumer.settleFailed("can't ack message", queue, d, err, consumeOptions)
+			return
+		}
+		consumer.observer.IncAcked(queue)
+	case action == NackDiscard:
+		err := d.Nack(false)
+		if err != nil {
+			consumer.settleFailed("can't nack message", queue, d, err, consumeOptions)
+			return
+		}
+		consumer.observer.IncNacked(queue)
+	case action == Reject:
+		err := d.Reject(false)
+		if err != nil {
+			consumer.settleFailed("can't reject message", queue, d, err, consumeOptions)
+			return
+		}
+		consumer.observer.IncNacked(queue)
+	case consumeOptions.Retry != nil:
+		err := consumer.retry(queue, d, *consumeOptions.Retry)
+		if err != nil {
+			consumer.settleFailed("can't retry message", queue, d, err, consumeOptions)
+		}
+	default:
+		err := d.Nack(!consumeOptions.ConsumerNoRequeue)
+		if err != nil {
+			consumer.settleFailed("can't nack message", queue, d, err, consumeOptions)
+			return
+		}
+		consumer.observer.IncNacked(queue)
+	}
+}
+
+// runHandler calls the handler and recovers from a panic in it, in which case the delivery
+// is nacked so the goroutine can carry on with the next one
+func (consumer Consumer) runHandler(
+	ctx context.Context,
+	handler func(ctx context.Context, d Delivery) Action,
+	d Delivery,
+) (action Action) {
+	defer func() {
+		if r := recover(); r != nil {
+			consumer.logger.Errorf("recovered from panic in handler: %v\n%s", r, debug.Stack())
+			action = NackRequeue
+		}
+	}()
+	return handler(ctx, d)
+}
+
+var consumerTagSeq, consumptionSeq uint64
+
+// uniqueConsumerTag returns a consumer tag that is unique within the process,
+// in the same format the amqp library uses when no tag is given
+func uniqueConsumerTag() string {
+	return fmt.Sprintf("ctag-%s-%d", os.Args[0], atomic.AddUint64(&consumerTagSeq, 1))
 }
@@ -1,60 +1,165 @@
 package rabbitmq
 
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
 // getDefaultConsumeOptions descibes the options that will be used when a value isn't provided
 func getDefaultConsumeOptions() ConsumeOptions {
 	return ConsumeOptions{
-		QueueDurable:      false,
-		QueueAutoDelete:   false,
-		QueueExclusive:    false,
-		QueueNoWait:       false,
-		QueueArgs:         nil,
-		BindingExchange:   nil,
-		BindingNoWait:     false,
-		BindingArgs:       nil,
-		Concurrency:       1,
-		QOSPrefetch:       0,
-		QOSGlobal:         false,
-		ConsumerName:      "",
-		ConsumerAutoAck:   false,
-		ConsumerExclusive: false,
-		ConsumerNoWait:    false,
-		ConsumerNoLocal:   false,
-		ConsumerArgs:      nil,
+		QueueDurable:             false,
+		QueueAutoDelete:          false,
+		QueueExclusive:           false,
+		QueueNoWait:              false,
+		QueuePassive:             false,
+		QueueNoDeclare:           false,
+		QueuePassiveOnMismatch:   false,
+		QueueDeclareErrorHandler: nil,
+		QueueArgs:                nil,
+		DeadLetterKind:           "",
+		BindingExchange:          nil,
+		BindingNoWait:            false,
+		BindingArgs:              nil,
+		Bindings:                 nil,
+		Concurrency:              1,
+		MaxConcurrentHandlers:    0,
+		DispatchMode:             WorkerPool,
+		HandlerTimeout:           0,
+		SlowHandlerThreshold:     0,
+		SlowHandlerCallback:      nil,
+		MaxMessages:              0,
+		MaxMessagesDone:          nil,
+		Middleware:               nil,
+		Retry:                    nil,
+		PoisonLimit:              0,
+		MaxDeaths:                0,
+		MaxDeathsHandler:         nil,
+		Filter:                   nil,
+		FilteredAction:           Ack,
+		QOSPrefetch:              0,
+		QOSPrefetchSize:          0,
+		QOSGlobal:                false,
+		AdaptivePrefetchMin:      0,
+		AdaptivePrefetchMax:      0,
+		BatchAckSize:             0,
+		BatchAckInterval:         0,
+		ConsumerPerWorker:        false,
+		ValidateRoutingKeys:      false,
+		AckErrorHandler:          nil,
+		CancelHandler:            nil,
+		NoRecreateOnCancel:       false,
+		StallMaxInFlight:         0,
+		StallMaxAge:              0,
+		StallHandler:             nil,
+		ConsumerName:             "",
+		ConsumerAutoAck:          false,
+		ConsumerManualAck:        false,
+		ConsumerNoRequeue:        false,
+		ConsumerExclusive:        false,
+		ConsumerNoWait:           false,
+		ConsumerNoLocal:          false,
+		ConsumerArgs:             nil,
+	}
+}
+
+// DefaultConsumeOptions returns the options used for the values that aren't provided. The concurrency
+// is 1, so the deliveries are handled one at a time, and the prefetch count is 0, which lets the server
+// send as many unacknowledged deliveries as it wants. The returned options can be tweaked and passed
+// to StartConsuming with WithConsumeOptions
+func DefaultConsumeOptions() ConsumeOptions {
+	return getDefaultConsumeOptions()
+}
+
+// WithConsumeOptions returns a function that replaces all the options with the given ones, usually
+// a tweaked copy of DefaultConsumeOptions. It overrides the option funcs passed before it,
+// so it should be passed first
+func WithConsumeOptions(consumeOptions ConsumeOptions) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		*options = consumeOptions
 	}
 }
 
 // ConsumeOptions are used to describe how a new consumer will be created.
 type ConsumeOptions struct {
-	QueueDurable      bool
-	QueueAutoDelete   bool
-	QueueExclusive    bool
-	QueueNoWait       bool
-	QueueArgs         Table
-	BindingExchange   *BindingExchangeOptions
-	BindingNoWait     bool
-	BindingArgs       Table
-	Concurrency       int
-	QOSPrefetch       int
-	QOSGlobal         bool
-	ConsumerName      string
-	ConsumerAutoAck   bool
-	ConsumerExclusive bool
-	ConsumerNoWait    bool
-	ConsumerNoLocal   bool
-	ConsumerArgs      Table
+	QueueDurable             bool
+	QueueAutoDelete          bool
+	QueueExclusive           bool
+	QueueNoWait              bool
+	QueuePassive             bool
+	QueueNoDeclare           bool
+	QueuePassiveOnMismatch   bool
+	QueueDeclareErrorHandler func(queue string, err error)
+	QueueArgs                Table
+	DeadLetterKind           string
+	BindingExchange          *BindingExchangeOptions
+	BindingNoWait            bool
+	BindingArgs              Table
+	Bindings                 []BindingDeclaration
+	Concurrency              int
+	MaxConcurrentHandlers    int
+	DispatchMode             DispatchMode
+	HandlerTimeout           time.Duration
+	SlowHandlerThreshold     time.Duration
+	SlowHandlerCallback      func(d Delivery, duration time.Duration)
+	MaxMessages              int
+	MaxMessagesDone          chan<- struct{}
+	Middleware               []Middleware
+	Retry                    *RetryOptions
+	PoisonLimit              int
+	MaxDeaths                int
+	MaxDeathsHandler         func(d Delivery)
+	Filter                   func(d Delivery) bool
+	FilteredAction           Action
+	QOSPrefetch              int
+	QOSPrefetchSize          int
+	QOSGlobal                bool
+	AdaptivePrefetchMin      int
+	AdaptivePrefetchMax      int
+	BatchAckSize             int
+	BatchAckInterval         time.Duration
+	ConsumerPerWorker        bool
+	ValidateRoutingKeys      bool
+	AckErrorHandler          func(d Delivery, err error)
+	CancelHandler            func(consumerTag string)
+	NoRecreateOnCancel       bool
+	StallMaxInFlight         int
+	StallMaxAge              time.Duration
+	StallHandler             func(inFlight int, oldest time.Duration)
+	ConsumerName             string
+	ConsumerAutoAck          bool
+	ConsumerManualAck        bool
+	ConsumerNoRequeue        bool
+	ConsumerExclusive        bool
+	ConsumerNoWait           bool
+	ConsumerNoLocal          bool
+	ConsumerArgs             Table
+
+	// stallDetector tracks the deliveries in flight of the consumption when a stall limit is set
+	stallDetector *stallDetector
+	// handlerSemaphore holds a slot for every handler running when MaxConcurrentHandlers is set
+	handlerSemaphore chan struct{}
 }
 
 // getBindingExchangeOptionsOrSetDefault returns pointer to current BindingExchange options. if no BindingExchange options are set yet, it will set it with default values.
 func getBindingExchangeOptionsOrSetDefault(options *ConsumeOptions) *BindingExchangeOptions {
 	if options.BindingExchange == nil {
 		options.BindingExchange = &BindingExchangeOptions{
-			Name:         "",
-			Kind:         "direct",
-			Durable:      false,
-			AutoDelete:   false,
-			Internal:     false,
-			NoWait:       false,
-			ExchangeArgs: nil,
+			Name:                     "",
+			Kind:                     "direct",
+			Durable:                  false,
+			AutoDelete:               false,
+			Internal:                 false,
+			NoWait:                   false,
+			Passive:                  false,
+			ExchangeArgs:             nil,
+			AlternateExchange:        "",
+			DeclareAlternateExchange: false,
 		}
 	}
 	return options.BindingExchange
@@ -62,14 +167,76 @@ func getBindingExchangeOptionsOrSetDefault(options *ConsumeOptions) *BindingExch
 
 // BindingExchangeOptions are used when binding to an exchange.
 // it will verify the exchange is created before binding to it.
+// AlternateExchange is where the exchange routes the messages it can't route,
+// DeclareAlternateExchange declares it as a fanout exchange as durable as this one
 type BindingExchangeOptions struct {
-	Name         string
-	Kind         string
-	Durable      bool
-	AutoDelete   bool
-	Internal     bool
-	NoWait       bool
-	ExchangeArgs Table
+	Name                     string
+	Kind                     string
+	Durable                  bool
+	AutoDelete               bool
+	Internal                 bool
+	NoWait                   bool
+	Passive                  bool
+	ExchangeArgs             Table
+	AlternateExchange        string
+	DeclareAlternateExchange bool
+}
+
+// BindingDeclaration describes a binding of the queue to an exchange. The exchange
+// is declared if it doesn't exist and the queue is bound to it with each routing key
+type BindingDeclaration struct {
+	Exchange    BindingExchangeOptions
+	RoutingKeys []string
+	NoWait      bool
+	Args        Table
+}
+
+// getBindingDeclarations returns all the bindings the queue should have, the BindingExchange
+// options and the routing keys given to StartConsuming are mapped to the first binding
+func getBindingDeclarations(options ConsumeOptions, routingKeys []string) []BindingDeclaration {
+	bindings := []BindingDeclaration{}
+	if options.BindingExchange != nil {
+		bindings = append(bindings, BindingDeclaration{
+			Exchange:    *options.BindingExchange,
+			RoutingKeys: routingKeys,
+			NoWait:      options.BindingNoWait,
+			Args:        options.BindingArgs,
+		})
+	}
+	return append(bindings, options.Bindings...)
+}
+
+// validateRoutingKeys checks that the routing keys of the bindings can match messages
+// published to the kind of their exchange
+func validateRoutingKeys(bindings []BindingDeclaration) error {
+	for _, binding := range bindings {
+		for _, routingKey := range binding.RoutingKeys {
+			err := validateRoutingKey(binding.Exchange.Kind, routingKey)
+			if err != nil {
+				return fmt.Errorf("invalid routing key %q for %s exchange %s: %w", routingKey, binding.Exchange.Kind, binding.Exchange.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateRoutingKey(kind string, routingKey string) error {
+	if len(routingKey) > 255 {
+		return errors.New("routing keys can't be longer than 255 bytes")
+	}
+	switch kind {
+	case amqp.ExchangeTopic:
+		for _, word := range strings.Split(routingKey, ".") {
+			if word != "*" && word != "#" && strings.ContainsAny(word, "*#") {
+				return errors.New("wildcards must be whole words between dots")
+			}
+		}
+	case amqp.ExchangeDirect, amqp.ExchangeFanout:
+		if strings.ContainsAny(routingKey, "*#") {
+			return errors.New("wildcards are only matched by topic exchanges")
+		}
+	}
+	return nil
 }
 
 // WithConsumeOptionsQueueDurable sets the queue to durable, which means it won't
@@ -101,13 +268,268 @@ func WithConsumeOptionsQueueNoWait(options *ConsumeOptions) {
 	options.QueueNoWait = true
 }
 
+// WithConsumeOptionsQueuePassive makes the consumer check that the queue exists instead of
+// declaring it, an error is returned if it doesn't. The queue's arguments aren't compared,
+// so a queue managed outside of the application is never modified
+func WithConsumeOptionsQueuePassive(options *ConsumeOptions) {
+	options.QueuePassive = true
+}
+
+// WithConsumeOptionsQueuePassiveOnMismatch makes the consumer consume from the queue as it is when
+// it exists with other arguments, instead of failing to declare it. The declare is first tried on a
+// channel of its own, since the server closes the channel a declare fails on, then the queue is
+// declared passively. The QueueDeclareErrorHandler is still called with the error
+func WithConsumeOptionsQueuePassiveOnMismatch(options *ConsumeOptions) {
+	options.QueuePassiveOnMismatch = true
+}
+
+// WithConsumeOptionsQueueDeclareErrorHandler returns a function that sets a handler called when
+// the queue can't be declared because it exists with other arguments, the PRECONDITION_FAILED
+// error of the server. Consuming isn't retried after it, since the declare can't succeed
+// until the arguments or the queue change
+func WithConsumeOptionsQueueDeclareErrorHandler(handler func(queue string, err error)) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.QueueDeclareErrorHandler = handler
+	}
+}
+
+// WithConsumeOptionsNoDeclare makes the consumer bind and consume the queue without declaring it,
+// so nothing is created on the broker if it doesn't exist and starting to consume fails instead.
+// The retry queue of WithConsumeOptionsRetry isn't declared either and must exist too
+func WithConsumeOptionsNoDeclare(options *ConsumeOptions) {
+	options.QueueNoDeclare = true
+}
+
 // WithConsumeOptionsQuorum sets the queue a quorum type, which means multiple nodes
 // in the cluster will have the messages distributed amongst them for higher reliability
+//
+// Deprecated: use WithConsumeOptionsQuorumQueue, which it's now the same as
 func WithConsumeOptionsQuorum(options *ConsumeOptions) {
+	WithConsumeOptionsQuorumQueue(options)
+}
+
+// WithConsumeOptionsQuorumQueue declares the queue as a quorum queue, which replicates its messages
+// on several nodes of the cluster and is the recommended type for durable queues. Quorum queues are
+// durable and can't be exclusive or auto-deleted, starting to consume fails if either is set
+func WithConsumeOptionsQuorumQueue(options *ConsumeOptions) {
+	setQueueArg(options, "x-queue-type", "quorum")
+	options.QueueDurable = true
+}
+
+// WithConsumeOptionsDeliveryLimit returns a function that sets how many times a quorum queue delivers
+// a message that's returned to it before dropping it, or dead-lettering it if the queue has a dead letter
+// exchange. The number of earlier deliveries is given by Delivery.RetryCount. It requires a quorum queue
+func WithConsumeOptionsDeliveryLimit(n int) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		setQueueArg(options, "x-delivery-limit", n)
+	}
+}
+
+// WithConsumeOptionsSingleActiveConsumer declares the queue with single active consumer, so that only one
+// of the consumers of the queue gets messages at a time, the next one taking over when it's cancelled
+// or its channel closes. It keeps the messages in order across several consumer instances as long as
+// each handles them one at a time, with a concurrency of 1. With WithConsumeOptionsConsumerPerWorker
+// only one of the workers is active.
+// It can't be set on an existing queue declared without it, redeclaring it fails
+func WithConsumeOptionsSingleActiveConsumer(options *ConsumeOptions) {
+	setQueueArg(options, "x-single-active-consumer", true)
+}
+
+// validateQueueType returns an error if options that the type of the queue doesn't support are set
+func validateQueueType(options ConsumeOptions) error {
+	queueType := options.QueueArgs["x-queue-type"]
+	_, deliveryLimit := options.QueueArgs["x-delivery-limit"]
+	if deliveryLimit && queueType != "quorum" {
+		return errors.New("a delivery limit requires a quorum queue")
+	}
+	_, err := maxPriority(options.QueueArgs)
+	if err != nil {
+		return err
+	}
+	switch queueType {
+	case "quorum":
+		if options.QueueExclusive || options.QueueAutoDelete {
+			return errors.New("a quorum queue can't be exclusive or auto-deleted")
+		}
+	case "stream":
+		return validateStreamOptions(options)
+	}
+	return nil
+}
+
+// maxPriority returns the x-max-priority argument of a queue, zero if it isn't set, and an error
+// if it isn't an integer RabbitMQ supports
+func maxPriority(args Table) (int, error) {
+	value, ok := args["x-max-priority"]
+	if !ok {
+		return 0, nil
+	}
+	var max int64
+	switch v := value.(type) {
+	case int:
+		max = int64(v)
+	case int8:
+		max = int64(v)
+	case int16:
+		max = int64(v)
+	case int32:
+		max = int64(v)
+	case int64:
+		max = v
+	case uint8:
+		max = int64(v)
+	case uint16:
+		max = int64(v)
+	case uint32:
+		max = int64(v)
+	default:
+		return 0, fmt.Errorf("x-max-priority must be an integer, got %T", value)
+	}
+	if max < 0 || max > math.MaxUint8 {
+		return 0, fmt.Errorf("x-max-priority %d isn't between 0 and 255", max)
+	}
+	return int(max), nil
+}
+
+// WithConsumeOptionsPriority returns a function that declares the queue as a priority queue
+// supporting priorities from 0 up to max. RabbitMQ treats messages published with a higher
+// priority than max as if they had priority max. Zero means the queue doesn't support
+// priorities, and values above 10 are discouraged by RabbitMQ as each level has a cost
+func WithConsumeOptionsPriority(max uint8) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		if max == 0 {
+			delete(options.QueueArgs, "x-max-priority")
+			return
+		}
+		setQueueArg(options, "x-max-priority", int32(max))
+	}
+}
+
+// WithConsumeOptionsQueueTTL returns a function that sets how long messages can stay in
+// the queue before they expire and are discarded, or dead-lettered if the queue has a dead
+// letter exchange. The duration is truncated to milliseconds
+func WithConsumeOptionsQueueTTL(ttl time.Duration) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		setQueueArg(options, "x-message-ttl", ttl.Milliseconds())
+	}
+}
+
+// WithConsumeOptionsQueueExpires returns a function that sets how long the queue can be
+// unused, i.e. have no consumers and not be redeclared, before the server deletes it.
+// The duration is truncated to milliseconds
+func WithConsumeOptionsQueueExpires(expires time.Duration) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		setQueueArg(options, "x-expires", expires.Milliseconds())
+	}
+}
+
+// WithConsumeOptionsConsumerTimeout returns a function that sets how long a delivery may stay
+// unacknowledged before the server closes the channel, the consumer_timeout of RabbitMQ 3.12+
+// which defaults to 30 minutes. Handlers running longer need a longer timeout.
+// The duration is truncated to milliseconds
+func WithConsumeOptionsConsumerTimeout(timeout time.Duration) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		setQueueArg(options, "x-consumer-timeout", timeout.Milliseconds())
+	}
+}
+
+// WithConsumeOptionsDeadLetterExchange returns a function that sets the exchange messages
+// are republished to when they are dead-lettered, i.e. rejected or nacked without requeue,
+// expired, or dropped because the queue is full.
+// Use WithConsumeOptionsConsumerNoRequeue so that messages the handler fails on are dead-lettered
+// instead of requeued
+func WithConsumeOptionsDeadLetterExchange(name string) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		setQueueArg(options, "x-dead-letter-exchange", name)
+	}
+}
+
+// WithConsumeOptionsDeadLetterRoutingKey returns a function that sets the routing key dead-lettered
+// messages are republished with. If unset the message's original routing key is used
+func WithConsumeOptionsDeadLetterRoutingKey(key string) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		setQueueArg(options, "x-dead-letter-routing-key", key)
+	}
+}
+
+// WithConsumeOptionsDeclareDeadLetterExchange returns a function that makes the consumer declare
+// the exchange set by WithConsumeOptionsDeadLetterExchange as a durable exchange of the given kind
+// if it doesn't exist yet
+func WithConsumeOptionsDeclareDeadLetterExchange(kind string) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.DeadLetterKind = kind
+	}
+}
+
+// setQueueArg sets an argument used when declaring the queue
+func setQueueArg(options *ConsumeOptions, key string, value interface{}) {
 	if options.QueueArgs == nil {
 		options.QueueArgs = Table{}
 	}
-	options.QueueArgs["x-queue-type"] = "quorum"
+	options.QueueArgs[key] = value
+}
+
+// WithConsumeOptionsAckErrorHandler returns a function that sets a handler called when acking, nacking,
+// rejecting or retrying a delivery after the handler returns fails. The delivery is then redelivered
+// once the channel is replaced, so handle may mark the work it did as possibly duplicated.
+// It isn't called for the deliveries settled by the handler itself, which gets the error.
+// With WithConsumeOptionsBatchAck it's called for the delivery whose ack failed to flush the batch,
+// the other deliveries of the batch are redelivered too
+func WithConsumeOptionsAckErrorHandler(handle func(d Delivery, err error)) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.AckErrorHandler = handle
+	}
+}
+
+// WithConsumeOptionsCancelHandler returns a function that sets a handler called with the tag of the amqp
+// consumer when the server cancels it, which happens when the queue is deleted. The consumer then reconnects
+// and declares the queue again, unless WithConsumeOptionsNoRecreateOnCancel is set
+func WithConsumeOptionsCancelHandler(handle func(consumerTag string)) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.CancelHandler = handle
+	}
+}
+
+// WithConsumeOptionsNoRecreateOnCancel makes the consumer stop consuming the queue when the server
+// cancels the amqp consumer, instead of declaring the queue again, so a queue deleted by an operator
+// stays deleted. The cancellation is surfaced by the WithConsumeOptionsCancelHandler handler and by a log
+func WithConsumeOptionsNoRecreateOnCancel(options *ConsumeOptions) {
+	options.NoRecreateOnCancel = true
+}
+
+// isConsumerTag reports whether the tag is the one of an amqp consumer started for the options
+func isConsumerTag(options ConsumeOptions, tag string) bool {
+	for _, consumerTag := range amqpConsumerTags(options) {
+		if consumerTag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// WithConsumeOptionsConsumerArg returns a function that sets an argument of the amqp consumer,
+// keeping the ones set by other options, unlike setting ConsumerArgs
+func WithConsumeOptionsConsumerArg(key string, value interface{}) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		setConsumerArg(options, key, value)
+	}
+}
+
+// WithConsumeOptionsConsumerPriority returns a function that sets the priority of the consumer,
+// the server delivers to the consumers of a queue with the highest priority as long as they can take
+// more messages given their prefetch count, and to the others only then. The default priority is 0
+func WithConsumeOptionsConsumerPriority(priority int) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		setConsumerArg(options, "x-priority", priority)
+	}
+}
+
+// setConsumerArg sets an argument used when starting the amqp consumer
+func setConsumerArg(options *ConsumeOptions, key string, value interface{}) {
+	if options.ConsumerArgs == nil {
+		options.ConsumerArgs = Table{}
+	}
+	options.ConsumerArgs[key] = value
 }
 
 // WithConsumeOptionsBindingExchangeName returns a function that sets the exchange name the queue will be bound to
@@ -144,6 +566,12 @@ func WithConsumeOptionsBindingExchangeNoWait(options *ConsumeOptions) {
 	getBindingExchangeOptionsOrSetDefault(options).NoWait = true
 }
 
+// WithConsumeOptionsBindingExchangePassive makes the consumer check that the binding exchange
+// exists instead of declaring it, an error is returned if it doesn't
+func WithConsumeOptionsBindingExchangePassive(options *ConsumeOptions) {
+	getBindingExchangeOptionsOrSetDefault(options).Passive = true
+}
+
 // WithConsumeOptionsBindingExchangeArgs returns a function that sets the binding exchange arguments that are specific to the server's implementation of the exchange
 func WithConsumeOptionsBindingExchangeArgs(args Table) func(*ConsumeOptions) {
 	return func(options *ConsumeOptions) {
@@ -151,32 +579,271 @@ func WithConsumeOptionsBindingExchangeArgs(args Table) func(*ConsumeOptions) {
 	}
 }
 
+// WithConsumeOptionsAlternateExchange returns a function that sets the alternate exchange of the binding
+// exchange, which gets the messages published to it that no binding routes, instead of them being dropped
+// or returned to publishers. It only takes effect when the binding exchange is created
+func WithConsumeOptionsAlternateExchange(name string) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		getBindingExchangeOptionsOrSetDefault(options).AlternateExchange = name
+	}
+}
+
+// WithConsumeOptionsDeclareAlternateExchange makes the consumer declare the alternate exchange set by
+// WithConsumeOptionsAlternateExchange, as a fanout exchange so every queue bound to it gets the messages
+func WithConsumeOptionsDeclareAlternateExchange(options *ConsumeOptions) {
+	getBindingExchangeOptionsOrSetDefault(options).DeclareAlternateExchange = true
+}
+
+// WithConsumeOptionsDelayedExchange returns a function that makes the binding exchange a delayed
+// message exchange, which requires the rabbitmq_delayed_message_exchange plugin. Messages published
+// with WithPublishOptionsDelay are routed once their delay has elapsed, as the given kind of exchange would
+func WithConsumeOptionsDelayedExchange(kind string) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		exchange := getBindingExchangeOptionsOrSetDefault(options)
+		exchange.Kind = "x-delayed-message"
+		if exchange.ExchangeArgs == nil {
+			exchange.ExchangeArgs = Table{}
+		}
+		exchange.ExchangeArgs["x-delayed-type"] = kind
+	}
+}
+
 // WithConsumeOptionsBindingNoWait sets the bindings to nowait, which means if the queue can not be bound
 // the channel will not be closed with an error.
 func WithConsumeOptionsBindingNoWait(options *ConsumeOptions) {
 	options.BindingNoWait = true
 }
 
+// WithConsumeOptionsHeaderMatchAll returns a function that binds the queue to a headers exchange
+// so that messages are routed to it when all of the given headers match.
+// Routing keys are ignored when binding to a headers exchange
+func WithConsumeOptionsHeaderMatchAll(headers Table) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		setHeaderMatch(options, "all", headers)
+	}
+}
+
+// WithConsumeOptionsHeaderMatchAny returns a function that binds the queue to a headers exchange
+// so that messages are routed to it when any of the given headers match.
+// Routing keys are ignored when binding to a headers exchange
+func WithConsumeOptionsHeaderMatchAny(headers Table) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		setHeaderMatch(options, "any", headers)
+	}
+}
+
+// setHeaderMatch sets the binding exchange kind to headers and adds
+// the x-match argument and the headers to the binding arguments
+func setHeaderMatch(options *ConsumeOptions, match string, headers Table) {
+	getBindingExchangeOptionsOrSetDefault(options).Kind = amqp.ExchangeHeaders
+	if options.BindingArgs == nil {
+		options.BindingArgs = Table{}
+	}
+	options.BindingArgs["x-match"] = match
+	for key, value := range headers {
+		options.BindingArgs[key] = value
+	}
+}
+
 // WithConsumeOptionsConcurrency returns a function that sets the concurrency, which means that
-// many goroutines will be spawned to run the provided handler on messages
+// many goroutines will be spawned to run the provided handler on messages. It defaults to 1
 func WithConsumeOptionsConcurrency(concurrency int) func(*ConsumeOptions) {
 	return func(options *ConsumeOptions) {
 		options.Concurrency = concurrency
 	}
 }
 
+// WithConsumeOptionsMaxConcurrentHandlers returns a function that caps how many handlers run at once,
+// whatever the concurrency and dispatch mode. The deliveries beyond the cap wait in the prefetch
+// buffer, so a large prefetch count can avoid waiting on the server while the processing stays bounded
+func WithConsumeOptionsMaxConcurrentHandlers(n int) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.MaxConcurrentHandlers = n
+	}
+}
+
+// WithConsumeOptionsWorkers returns a function that sets both the concurrency and the prefetch
+// count to n, so every goroutine has a delivery to handle. With a concurrency higher than the prefetch
+// count the extra goroutines are idle, since no more deliveries than the prefetch count are in flight
+func WithConsumeOptionsWorkers(n int) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.Concurrency = n
+		options.QOSPrefetch = n
+	}
+}
+
+// DispatchMode describes how deliveries are dispatched to the handler
+type DispatchMode int
+
+const (
+	// WorkerPool starts Concurrency goroutines that each handle one delivery at a time
+	// for the lifetime of the consumer. Deliveries are spread across the goroutines,
+	// so they are acked in the order they're received only when Concurrency is 1
+	WorkerPool DispatchMode = iota
+	// PerMessage starts a goroutine for every delivery, with at most Concurrency of them
+	// running at once. Goroutines are only started when there's work, and acks happen
+	// in the order the handlers finish, which is unrelated to the order of the deliveries
+	PerMessage
+)
+
+// WithConsumeOptionsDispatchMode returns a function that sets how deliveries are dispatched
+// to the handler, WorkerPool by default
+func WithConsumeOptionsDispatchMode(mode DispatchMode) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.DispatchMode = mode
+	}
+}
+
+// WithConsumeOptionsHandlerTimeout returns a function that sets how long the handler may
+// run. Handlers started with StartConsumingContextHandler receive a context that is cancelled
+// once the timeout elapses. A delivery whose handler returns after the timeout is nacked,
+// and requeued unless WithConsumeOptionsConsumerNoRequeue is used
+func WithConsumeOptionsHandlerTimeout(timeout time.Duration) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.HandlerTimeout = timeout
+	}
+}
+
+// WithConsumeOptionsSlowHandlerThreshold returns a function that makes the consumer call callback
+// with the delivery and how long the handler took whenever it takes longer than threshold, or log
+// a warning if callback is nil. The callback is called before the delivery is settled
+func WithConsumeOptionsSlowHandlerThreshold(threshold time.Duration, callback func(d Delivery, duration time.Duration)) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.SlowHandlerThreshold = threshold
+		options.SlowHandlerCallback = callback
+	}
+}
+
+// WithConsumeOptionsMaxMessages returns a function that sets how many deliveries the handler
+// is invoked with before the consumption cancels itself, as Cancel would with its consumer tag.
+// The other consumptions of the consumer and its connection are kept.
+// Deliveries received past the limit are requeued without invoking the handler
+func WithConsumeOptionsMaxMessages(n int) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.MaxMessages = n
+	}
+}
+
+// WithConsumeOptionsMaxMessagesDone returns a function that sets the channel closed once the
+// consumption handled its WithConsumeOptionsMaxMessages deliveries, was cancelled and its
+// handlers returned
+func WithConsumeOptionsMaxMessagesDone(done chan<- struct{}) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.MaxMessagesDone = done
+	}
+}
+
+// WithConsumeOptionsMiddleware returns a function that adds middleware wrapping the handler,
+// they're applied in order so the first one is the outermost
+func WithConsumeOptionsMiddleware(middleware ...Middleware) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.Middleware = append(options.Middleware, middleware...)
+	}
+}
+
+// WithConsumeOptionsPoisonLimit returns a function that makes the consumer nack messages
+// without requeueing them, instead of handling them, once they've been delivered max times
+// according to Delivery.RetryCount. They're dead-lettered if the queue has a dead letter exchange
+// and discarded otherwise
+func WithConsumeOptionsPoisonLimit(max int) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.PoisonLimit = max
+	}
+}
+
+// WithConsumeOptionsMaxDeaths returns a function that makes the consumer ack messages instead of
+// handling them once they've been dead-lettered max times from the queue, according to
+// Delivery.DeathCount. handler is called with them first, for example to publish them to a
+// parking lot queue, it may be nil. This stops the retries of a queue whose dead letter exchange
+// routes the messages back to it, usually through a delay queue
+func WithConsumeOptionsMaxDeaths(max int, handler func(d Delivery)) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.MaxDeaths = max
+		options.MaxDeathsHandler = handler
+	}
+}
+
+// WithConsumeOptionsFilter returns a function that makes the consumer only call the handler with
+// the deliveries filter returns true for. The others are acked, or settled with the action set by
+// WithConsumeOptionsFilteredAction, which is useful when the bindings match more messages than
+// the handler wants, for instance with a # binding key
+func WithConsumeOptionsFilter(filter func(d Delivery) bool) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.Filter = filter
+	}
+}
+
+// WithConsumeOptionsFilteredAction returns a function that sets the action the deliveries left out by
+// WithConsumeOptionsFilter are settled with, NackDiscard or Reject dead-letter them instead of acking them.
+// NackRequeue requeues them, so they're delivered again to this consumer unless another one takes them.
+// They're settled directly, WithConsumeOptionsRetry and WithConsumeOptionsConsumerNoRequeue don't apply to them
+func WithConsumeOptionsFilteredAction(action Action) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.FilteredAction = action
+	}
+}
+
 // WithConsumeOptionsQOSPrefetch returns a function that sets the prefetch count, which means that
 // many messages will be fetched from the server in advance to help with throughput.
 // This doesn't affect the handler, messages are still processed one at a time.
+// The prefetch count applies to the amqp consumer, which all the goroutines of
+// WithConsumeOptionsConcurrency share unless WithConsumeOptionsConsumerPerWorker is set.
+// It defaults to 0, which doesn't limit how many deliveries the server sends in advance
 func WithConsumeOptionsQOSPrefetch(prefetchCount int) func(*ConsumeOptions) {
 	return func(options *ConsumeOptions) {
 		options.QOSPrefetch = prefetchCount
 	}
 }
 
+// WithConsumeOptionsValidateRoutingKeys makes the consumer check the routing keys of the bindings
+// against the kind of their exchange before declaring anything: wildcards must be whole words of
+// topic exchange keys and aren't allowed for direct and fanout exchanges, which would never
+// route anything to the queue with them. Mistakes that make valid keys are still not caught
+func WithConsumeOptionsValidateRoutingKeys(options *ConsumeOptions) {
+	options.ValidateRoutingKeys = true
+}
+
+// WithConsumeOptionsConsumerPerWorker starts an amqp consumer for each of the goroutines
+// of WithConsumeOptionsConcurrency instead of one they all share, so the prefetch count applies
+// to each goroutine and the server spreads the deliveries over them. The consumers are tagged with
+// the consumer name followed by -1, -2 and so on, the consumer name is still used by Cancel.
+// It requires the WorkerPool dispatch mode and can't be used with WithConsumeOptionsBatchAck
+func WithConsumeOptionsConsumerPerWorker(options *ConsumeOptions) {
+	options.ConsumerPerWorker = true
+}
+
+// WithConsumeOptionsQOSPrefetchSize returns a function that sets the prefetch size, which means that
+// the server won't send more deliveries in advance than fit in that many bytes.
+// Some versions of RabbitMQ don't implement prefetch sizes and ignore it, in which case only the
+// prefetch count applies
+func WithConsumeOptionsQOSPrefetchSize(bytes int) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.QOSPrefetchSize = bytes
+	}
+}
+
+// WithConsumeOptionsAdaptivePrefetch returns a function that makes the consumer adjust the prefetch
+// count between min and max while consuming, starting at min. It's raised when the handlers wait for
+// deliveries and lowered when they're always busy, so few deliveries sit unhandled in the buffer.
+// The prefetch count is set on the channel as WithConsumeOptionsQOSGlobal does, since only a global
+// prefetch count can be changed for consumers that are already running, and overrides WithConsumeOptionsQOSPrefetch.
+// Since the Consumer's channel is shared, a global prefetch count would throttle its other StartConsuming too,
+// so StartConsuming fails when adaptive prefetch is combined with another running one on the same Consumer.
+// A separate Consumer can be used for each queue that needs adaptive prefetch
+func WithConsumeOptionsAdaptivePrefetch(min, max int) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.AdaptivePrefetchMin = min
+		options.AdaptivePrefetchMax = max
+	}
+}
+
 // WithConsumeOptionsQOSGlobal sets the qos on the channel to global, which means
-// these QOS settings apply to ALL existing and future
-// consumers on all channels on the same connection
+// the prefetch count is shared by all the consumers of the channel.
+// By default RabbitMQ applies it to each amqp consumer started after it, so every StartConsuming
+// on a Consumer gets the prefetch count of its own options even though they share a channel.
+// A global prefetch count also limits the other StartConsuming of the Consumer,
+// on top of their own prefetch counts, so it's best used with a single one.
+// WithConsumeOptionsAdaptivePrefetch refuses to share the channel for that reason
 func WithConsumeOptionsQOSGlobal(options *ConsumeOptions) {
 	options.QOSGlobal = true
 }
@@ -204,3 +871,26 @@ func WithConsumeOptionsConsumerExclusive(options *ConsumeOptions) {
 func WithConsumeOptionsConsumerNoWait(options *ConsumeOptions) {
 	options.ConsumerNoWait = true
 }
+
+// WithConsumeOptionsConsumerManualAck disables the automatic ack/nack of deliveries,
+// which means the handler's return value is ignored and the handler must call
+// Ack, Nack or Reject on each delivery itself, or AckMultiple or NackMultiple to settle a range of them
+func WithConsumeOptionsConsumerManualAck(options *ConsumeOptions) {
+	options.ConsumerManualAck = true
+}
+
+// WithConsumeOptionsBindings returns a function that adds bindings of the queue to exchanges,
+// each with their own routing keys. They are declared in addition to the binding described by
+// the BindingExchange options and the routing keys passed to StartConsuming
+func WithConsumeOptionsBindings(bindings ...BindingDeclaration) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.Bindings = append(options.Bindings, bindings...)
+	}
+}
+
+// WithConsumeOptionsConsumerNoRequeue makes the consumer nack messages without requeueing them when
+// the handler returns false or panics, which means they are dead-lettered if the queue has a dead letter exchange
+// and discarded otherwise. By default they are requeued, and will likely be redelivered right away
+func WithConsumeOptionsConsumerNoRequeue(options *ConsumeOptions) {
+	options.ConsumerNoRequeue = true
+}
@@ -0,0 +1,356 @@
+package rabbitmq
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/samuelkuklis/go-rabbitmq/rabbitmqtest"
+	"github.com/streadway/amqp"
+)
+
+// waitFor polls the condition until it's true or the timeout elapses
+func waitFor(t *testing.T, timeout time.Duration, condition func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// publish publishes the body on the default exchange to the queue of the broker
+func publish(t *testing.T, broker *rabbitmqtest.Broker, queue string, body string) {
+	t.Helper()
+	_, err := broker.Publish("", queue, amqp.Publishing{Body: []byte(body)})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsumerReconnectDoesntLeakGoroutines(t *testing.T) {
+	broker := rabbitmqtest.NewBroker()
+	defer broker.Close()
+	reconnected := make(chan struct{}, 1)
+	consumer, err := NewConsumer(broker.URL(), broker.Config(),
+		withConsumerOptionsClock(newFakeClock()),
+		WithConsumerOptionsReconnectedCallback(func() {
+			reconnected <- struct{}{}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.StopConsuming()
+	handled := make(chan string, 10)
+	err = consumer.StartConsuming(func(d Delivery) bool {
+		handled <- string(d.Body)
+		return true
+	}, "reconnect", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish(t, broker, "reconnect", "before")
+	<-handled
+	// the ack could be lost with the first connection, which would deliver the message again
+	waitFor(t, 5*time.Second, func() bool {
+		state, _ := broker.Queue("reconnect")
+		return state.Ready == 0 && state.Unacked == 0
+	})
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 100; i++ {
+		broker.DropConnections()
+		select {
+		case <-reconnected:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("consumer didn't resume after reconnection %d", i+1)
+		}
+	}
+
+	publish(t, broker, "reconnect", "after")
+	timeout := time.After(5 * time.Second)
+	for body := ""; body != "after"; {
+		select {
+		case body = <-handled:
+		case <-timeout:
+			t.Fatal("consumer didn't consume after reconnecting")
+		}
+	}
+	ok := waitFor(t, 5*time.Second, func() bool {
+		return runtime.NumGoroutine() <= baseline
+	})
+	if !ok {
+		t.Errorf("got %d goroutines after 100 reconnections, want at most %d", runtime.NumGoroutine(), baseline)
+	}
+}
+
+func TestConsumerKeepsConsumingAfterPanic(t *testing.T) {
+	broker := rabbitmqtest.NewBroker()
+	defer broker.Close()
+	consumer, err := NewConsumer(broker.URL(), broker.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.StopConsuming()
+	handled := make(chan string, 10)
+	err = consumer.StartConsuming(func(d Delivery) bool {
+		// the first delivery of every message panics, its redelivery is handled
+		if !d.Redelivered {
+			panic("handler failed")
+		}
+		handled <- string(d.Body)
+		return true
+	}, "panics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"first", "second", "third"} {
+		publish(t, broker, "panics", body)
+		select {
+		case got := <-handled:
+			if got != body {
+				t.Errorf("got %q, want %q", got, body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q wasn't requeued and handled after the panic", body)
+		}
+	}
+	ok := waitFor(t, 5*time.Second, func() bool {
+		state, _ := broker.Queue("panics")
+		return state.Ready == 0 && state.Unacked == 0
+	})
+	if !ok {
+		t.Error("the handled messages weren't acked")
+	}
+}
+
+func TestConsumerDiscardsAfterPanicWithoutRequeue(t *testing.T) {
+	broker := rabbitmqtest.NewBroker()
+	defer broker.Close()
+	consumer, err := NewConsumer(broker.URL(), broker.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.StopConsuming()
+	handled := make(chan string, 10)
+	err = consumer.StartConsuming(func(d Delivery) bool {
+		if string(d.Body) == "panic" {
+			panic("handler failed")
+		}
+		handled <- string(d.Body)
+		return true
+	}, "panics", nil, WithConsumeOptionsConsumerNoRequeue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, broker, "panics", "panic")
+	publish(t, broker, "panics", "after")
+	select {
+	case got := <-handled:
+		if got != "after" {
+			t.Errorf("got %q, want %q", got, "after")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer stopped consuming after the panic")
+	}
+	ok := waitFor(t, 5*time.Second, func() bool {
+		state, _ := broker.Queue("panics")
+		return state.Ready == 0 && state.Unacked == 0
+	})
+	if !ok {
+		t.Error("the message the handler panicked on was requeued")
+	}
+}
+
+// deleteQueue deletes the queue from another connection to the broker
+func deleteQueue(t *testing.T, broker *rabbitmqtest.Broker, queue string) *amqp.Channel {
+	t.Helper()
+	conn, err := amqp.DialConfig(broker.URL(), broker.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	channel, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = channel.QueueDelete(queue, false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return channel
+}
+
+// countAttempts returns the options counting the attempts of the consumer to reconnect and resume
+func countAttempts(attempts *int32, optionFuncs ...func(*ConsumerOptions)) []func(*ConsumerOptions) {
+	return append(optionFuncs,
+		WithConsumerOptionsOnReconnect(func(int) {
+			atomic.AddInt32(attempts, 1)
+		}),
+		WithConsumerOptionsReconnectCallback(func(int, error) {
+			atomic.AddInt32(attempts, 1)
+		}),
+	)
+}
+
+// assertGaveUp waits for the consumer to be closed with an error and checks it doesn't attempt
+// to reconnect or resume afterwards
+func assertGaveUp(t *testing.T, consumer Consumer, attempts *int32) error {
+	t.Helper()
+	var err error
+	select {
+	case err = <-consumer.NotifyClosed():
+		if err == nil {
+			t.Fatal("consumer was closed without an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer didn't give up")
+	}
+	before := atomic.LoadInt32(attempts)
+	time.Sleep(200 * time.Millisecond)
+	if after := atomic.LoadInt32(attempts); after != before {
+		t.Errorf("got %d attempts after giving up, want none", after-before)
+	}
+	if consumer.IsConnected() {
+		t.Error("consumer is still connected after giving up")
+	}
+	return err
+}
+
+func TestConsumerGivesUpOnPermanentError(t *testing.T) {
+	broker := rabbitmqtest.NewBroker()
+	defer broker.Close()
+	var attempts int32
+	consumer, err := NewConsumer(broker.URL(), broker.Config(), countAttempts(&attempts, withConsumerOptionsClock(newFakeClock()))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.StopConsuming()
+	_, err = consumer.DeclareQueue(QueueOptions{Name: "passive"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = consumer.StartConsuming(func(d Delivery) bool {
+		return true
+	}, "passive", nil, WithConsumeOptionsQueuePassive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the consumer is cancelled, and resuming fails with NOT_FOUND
+	deleteQueue(t, broker, "passive")
+	err = assertGaveUp(t, consumer, &attempts)
+	if !isNotFound(err) {
+		t.Errorf("got error %v, want NOT_FOUND", err)
+	}
+}
+
+func TestConsumerGivesUpOnInequivalentQueue(t *testing.T) {
+	broker := rabbitmqtest.NewBroker()
+	defer broker.Close()
+	var attempts int32
+	// the backoff leaves the time to declare the queue again before the consumer resumes
+	consumer, err := NewConsumer(broker.URL(), broker.Config(),
+		countAttempts(&attempts, WithConsumerOptionsReconnectBackoff(50*time.Millisecond, 0, 1))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.StopConsuming()
+	var declareErrors int32
+	err = consumer.StartConsuming(func(d Delivery) bool {
+		return true
+	}, "inequivalent", nil, WithConsumeOptionsQueueDeclareErrorHandler(func(queue string, err error) {
+		atomic.AddInt32(&declareErrors, 1)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another client declares the queue durable, after which the consumer can't declare it
+	channel := deleteQueue(t, broker, "inequivalent")
+	_, err = channel.QueueDeclare("inequivalent", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertGaveUp(t, consumer, &attempts)
+	if !isPreconditionFailed(err) {
+		t.Errorf("got error %v, want PRECONDITION_FAILED", err)
+	}
+	if got := atomic.LoadInt32(&declareErrors); got != 1 {
+		t.Errorf("got %d calls of the declare error handler, want 1", got)
+	}
+}
+
+func TestConsumerMaxMessagesCancelsOnlyItsConsumption(t *testing.T) {
+	broker := rabbitmqtest.NewBroker()
+	defer broker.Close()
+	consumer, err := NewConsumer(broker.URL(), broker.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.StopConsuming()
+	var limitedHandled int32
+	done := make(chan struct{})
+	err = consumer.StartConsuming(func(d Delivery) bool {
+		atomic.AddInt32(&limitedHandled, 1)
+		return true
+	}, "limited", nil,
+		WithConsumeOptionsMaxMessages(2),
+		WithConsumeOptionsMaxMessagesDone(done),
+		// the deliveries past the limit are held by the consumer until it's cancelled
+		WithConsumeOptionsQOSPrefetch(5),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handled := make(chan string, 10)
+	err = consumer.StartConsuming(func(d Delivery) bool {
+		handled <- string(d.Body)
+		return true
+	}, "unlimited", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"first", "second", "third", "fourth"} {
+		publish(t, broker, "limited", body)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumption wasn't done after its last message")
+	}
+	if got := atomic.LoadInt32(&limitedHandled); got != 2 {
+		t.Errorf("got %d handled messages, want 2", got)
+	}
+	ok := waitFor(t, 5*time.Second, func() bool {
+		state, _ := broker.Queue("limited")
+		return state == rabbitmqtest.QueueState{Ready: 2}
+	})
+	if !ok {
+		state, _ := broker.Queue("limited")
+		t.Errorf("got queue state %+v after the limit, want the 2 messages past it ready and no consumer", state)
+	}
+
+	publish(t, broker, "unlimited", "after the limit")
+	select {
+	case body := <-handled:
+		if body != "after the limit" {
+			t.Errorf("got %q, want %q", body, "after the limit")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the other consumption stopped with the limited one")
+	}
+	if !consumer.IsConnected() {
+		t.Error("consumer isn't connected after the limit")
+	}
+}
@@ -0,0 +1,111 @@
+package rabbitmq
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// DedupStore records the ids of the messages that were handled, so redeliveries can be skipped.
+// It can be backed by a shared store like Redis when several consumers handle the same queue
+type DedupStore interface {
+	// Seen reports whether the message with the id was marked and hasn't expired yet
+	Seen(id string) (bool, error)
+	// Mark records that the message with the id was handled, for ttl
+	Mark(id string, ttl time.Duration) error
+}
+
+// WithConsumeOptionsDedup returns a function that makes the consumer skip the messages whose
+// MessageId the store has seen, they're acked without calling the handler. The id of a message
+// is marked for ttl once the handler acks it. The skipped messages are acked by the consumer
+// with WithConsumeOptionsConsumerManualAck too, since the handler never sees them. Messages
+// without a MessageId are always handled, as are the ones the store fails to look up. Copies
+// of a message handled at the same time are both handled, since the id is only marked once
+// the first one is done
+func WithConsumeOptionsDedup(store DedupStore, ttl time.Duration) func(*ConsumeOptions) {
+	return WithConsumeOptionsMiddleware(DedupMiddleware(store, ttl))
+}
+
+// DedupMiddleware returns the middleware WithConsumeOptionsDedup adds,
+// to choose its position among the other middleware
+func DedupMiddleware(store DedupStore, ttl time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(d Delivery) bool {
+			if d.MessageId == "" {
+				return next(d)
+			}
+			seen, err := store.Seen(d.MessageId)
+			if err == nil && seen {
+				if d.scope != nil {
+					d.scope.skipped = true
+				}
+				return true
+			}
+			ack := next(d)
+			if ack {
+				// a failure to mark only lets a redelivery be handled again
+				_ = store.Mark(d.MessageId, ttl)
+			}
+			return ack
+		}
+	}
+}
+
+// memoryDedupStore is a DedupStore holding the most recently marked ids in memory
+type memoryDedupStore struct {
+	mux  *sync.Mutex
+	size int
+	// entries holds the ids from the most to the least recently marked, ids indexes them
+	entries *list.List
+	ids     map[string]*list.Element
+}
+
+type memoryDedupEntry struct {
+	id      string
+	expires time.Time
+}
+
+// NewMemoryDedupStore returns a DedupStore that keeps up to size ids in memory, the least recently
+// marked one is forgotten to make room for a new one. It's only suited to a single consumer instance
+func NewMemoryDedupStore(size int) DedupStore {
+	return &memoryDedupStore{
+		mux:     &sync.Mutex{},
+		size:    size,
+		entries: list.New(),
+		ids:     map[string]*list.Element{},
+	}
+}
+
+func (store *memoryDedupStore) Seen(id string) (bool, error) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	element, ok := store.ids[id]
+	if !ok {
+		return false, nil
+	}
+	if time.Now().After(element.Value.(*memoryDedupEntry).expires) {
+		store.entries.Remove(element)
+		delete(store.ids, id)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (store *memoryDedupStore) Mark(id string, ttl time.Duration) error {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	expires := time.Now().Add(ttl)
+	element, ok := store.ids[id]
+	if ok {
+		element.Value.(*memoryDedupEntry).expires = expires
+		store.entries.MoveToFront(element)
+		return nil
+	}
+	store.ids[id] = store.entries.PushFront(&memoryDedupEntry{id: id, expires: expires})
+	for store.entries.Len() > store.size {
+		oldest := store.entries.Back()
+		store.entries.Remove(oldest)
+		delete(store.ids, oldest.Value.(*memoryDedupEntry).id)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	// ErrAccessRefused matches the ACCESS_REFUSED errors of the server, like wrong credentials or missing permissions
+	ErrAccessRefused = errors.New("access refused")
+	// ErrQueueNotFound matches the NOT_FOUND errors of the server about a queue, like consuming from a missing queue
+	ErrQueueNotFound = errors.New("queue not found")
+	// ErrExchangeNotFound matches the NOT_FOUND errors of the server about an exchange, like binding to a missing exchange
+	ErrExchangeNotFound = errors.New("exchange not found")
+	// ErrPreconditionFailed matches the PRECONDITION_FAILED errors of the server, like declaring a queue
+	// that exists with other arguments
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrConnectionClosed is returned when opening a channel on a Connection that was closed.
+	// It also matches the errors telling the connection or the channel to the server is closed
+	ErrConnectionClosed = errors.New("connection was closed")
+)
+
+// Error wraps an error holding an *amqp.Error, so errors.Is matches it against ErrAccessRefused,
+// ErrQueueNotFound, ErrExchangeNotFound, ErrPreconditionFailed and ErrConnectionClosed.
+// errors.As still finds the *amqp.Error for its code and reason
+type Error struct {
+	err     error
+	amqpErr *amqp.Error
+}
+
+func (err *Error) Error() string {
+	return err.err.Error()
+}
+
+func (err *Error) Unwrap() error {
+	return err.err
+}
+
+func (err *Error) Is(target error) bool {
+	return isKind(err.amqpErr, target)
+}
+
+// wrapError wraps err in an Error when it holds an *amqp.Error, so it's classified by errors.Is
+func wrapError(err error) error {
+	var classified *Error
+	if err == nil || errors.As(err, &classified) {
+		return err
+	}
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) {
+		return err
+	}
+	return &Error{err: err, amqpErr: amqpErr}
+}
+
+// isKind reports whether the amqp error is of the kind of the sentinel error
+func isKind(amqpErr *amqp.Error, target error) bool {
+	if amqpErr == nil {
+		return false
+	}
+	switch target {
+	case ErrAccessRefused:
+		return amqpErr.Code == amqp.AccessRefused
+	case ErrQueueNotFound:
+		return amqpErr.Code == amqp.NotFound && strings.Contains(amqpErr.Reason, "no queue")
+	case ErrExchangeNotFound:
+		return amqpErr.Code == amqp.NotFound && strings.Contains(amqpErr.Reason, "no exchange")
+	case ErrPreconditionFailed:
+		return amqpErr.Code == amqp.PreconditionFailed
+	case ErrConnectionClosed:
+		return amqpErr == amqp.ErrClosed || amqpErr.Code == amqp.ConnectionForced
+	}
+	return false
+}
+
+// CloseError is the cause of a reconnection after the server or the network closed the channel or
+// the connection, Connection tells which. The amqp error is unwrapped, its code tells why
+type CloseError struct {
+	Connection bool
+	Err        *amqp.Error
+}
+
+func (err *CloseError) Error() string {
+	if err.Connection {
+		return fmt.Sprintf("connection closed: %v", err.Err)
+	}
+	return fmt.Sprintf("channel closed: %v", err.Err)
+}
+
+func (err *CloseError) Unwrap() error {
+	return err.Err
+}
+
+func (err *CloseError) Is(target error) bool {
+	if err.Connection && target == ErrConnectionClosed {
+		return true
+	}
+	return isKind(err.Err, target)
+}
+
+// CancelError is the cause of a reconnection after the server cancelled a consumer,
+// which happens when its queue is deleted or, for a mirrored queue, fails over
+type CancelError struct {
+	ConsumerTag string
+}
+
+func (err *CancelError) Error() string {
+	return fmt.Sprintf("consumer %s cancelled by the server", err.ConsumerTag)
+}
+
+// IsRetryable reports whether an operation that failed with err may succeed if it's retried.
+// The errors the server sends because the request itself can't be satisfied aren't retryable:
+// NOT_FOUND, like a passive declare of a missing queue, ACCESS_REFUSED, like wrong credentials
+// or missing permissions, and PRECONDITION_FAILED, like declaring a queue that exists with
+// other arguments. Other errors, like a lost connection, are, except for ErrConnectionClosed
+// returned on a Connection that was closed
+func IsRetryable(err error) bool {
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) {
+		return !errors.Is(err, ErrConnectionClosed)
+	}
+	switch amqpErr.Code {
+	case amqp.NotFound, amqp.AccessRefused, amqp.PreconditionFailed:
+		return false
+	default:
+		return true
+	}
+}
+
+// IsConsumerTimeout reports whether err is the PRECONDITION_FAILED error the server closes the
+// channel with when a delivery wasn't acknowledged within the consumer timeout
+func IsConsumerTimeout(err error) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed &&
+		strings.Contains(amqpErr.Reason, "delivery acknowledgement") && strings.Contains(amqpErr.Reason, "timed out")
+}
+
+// isPreconditionFailed reports whether err is the PRECONDITION_FAILED error of the server
+func isPreconditionFailed(err error) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed
+}
+
+// isNotFound reports whether err is the NOT_FOUND error of the server
+func isNotFound(err error) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound
+}
@@ -25,7 +25,7 @@ func main() {
 		[]string{"routing_key", "routing_key_2"},
 		rabbitmq.WithConsumeOptionsConcurrency(10),
 		rabbitmq.WithConsumeOptionsQueueDurable,
-		rabbitmq.WithConsumeOptionsQuorum,
+		rabbitmq.WithConsumeOptionsQuorumQueue,
 		rabbitmq.WithConsumeOptionsBindingExchangeName("events"),
 		rabbitmq.WithConsumeOptionsBindingExchangeKind("topic"),
 		rabbitmq.WithConsumeOptionsBindingExchangeDurable,
@@ -1,5 +1,5 @@
 module github.com/samuelkuklis/go-rabbitmq
 
-go 1.16
+go 1.18
 
 require github.com/streadway/amqp v1.0.0
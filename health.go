@@ -0,0 +1,79 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// HealthCheckOptions are used to describe how a health check is performed
+// Queue is the name of a queue that is passively declared to confirm the server responds,
+// no queue is declared when empty
+type HealthCheckOptions struct {
+	Queue string
+}
+
+// WithHealthCheckOptionsQueue passively declares the given queue during the health check
+func WithHealthCheckOptionsQueue(name string) func(*HealthCheckOptions) {
+	return func(options *HealthCheckOptions) {
+		options.Queue = name
+	}
+}
+
+// HealthCheck returns an error if the consumer isn't connected to the server
+// or, when a queue is given, the server doesn't answer a passive declare of it before ctx is done
+func (consumer Consumer) HealthCheck(ctx context.Context, optionFuncs ...func(*HealthCheckOptions)) error {
+	return consumer.chManager.healthCheck(ctx, optionFuncs...)
+}
+
+// HealthCheck returns an error if the publisher isn't connected to the server
+// or, when a queue is given, the server doesn't answer a passive declare of it before ctx is done
+func (publisher *Publisher) HealthCheck(ctx context.Context, optionFuncs ...func(*HealthCheckOptions)) error {
+	return publisher.chManager.healthCheck(ctx, optionFuncs...)
+}
+
+func (chManager *channelManager) healthCheck(ctx context.Context, optionFuncs ...func(*HealthCheckOptions)) error {
+	options := &HealthCheckOptions{}
+	for _, optionFunc := range optionFuncs {
+		optionFunc(options)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	chManager.channelMux.RLock()
+	connected := chManager.connected
+	connection := chManager.connection
+	chManager.channelMux.RUnlock()
+	if !connected || connection.IsClosed() {
+		return errors.New("not connected to the amqp server")
+	}
+	if options.Queue == "" {
+		return nil
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		// a failing passive declare closes the channel, so it's done on a separate one
+		channel, err := connection.Channel()
+		if err != nil {
+			result <- fmt.Errorf("can't open channel: %w", err)
+			return
+		}
+		defer channel.Close()
+		_, err = channel.QueueDeclarePassive(options.Queue, false, false, false, false, nil)
+		if err != nil {
+			result <- fmt.Errorf("can't inspect queue %s: %w", options.Queue, err)
+			return
+		}
+		result <- nil
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,75 @@
+package rabbitmq
+
+import (
+	"context"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Consuming is implemented by Consumer, code can depend on it instead of the concrete type
+// so that a fake can be substituted in tests
+type Consuming interface {
+	StartConsuming(handler func(d Delivery) bool, queue string, routingKeys []string, optionFuncs ...func(*ConsumeOptions)) error
+	StartConsumingActionHandler(handler func(d Delivery) Action, queue string, routingKeys []string, optionFuncs ...func(*ConsumeOptions)) error
+	StartConsumingContextHandler(handler func(ctx context.Context, d Delivery) bool, queue string, routingKeys []string, optionFuncs ...func(*ConsumeOptions)) error
+	StartConsumingWithContext(ctx context.Context, handler func(d Delivery) bool, queue string, routingKeys []string, optionFuncs ...func(*ConsumeOptions)) error
+	StartConsumingTempQueue(handler func(d Delivery) bool, routingKeys []string, optionFuncs ...func(*ConsumeOptions)) (string, error)
+	Deliveries(queue string, routingKeys []string, optionFuncs ...func(*ConsumeOptions)) (<-chan Delivery, error)
+	StopConsuming()
+
+	ConsumerTag() string
+	ConsumerTags() []string
+	Cancel(consumerTag string) error
+	Pause() error
+	Resume() error
+
+	InspectQueue(name string) (messages int, consumers int, err error)
+	WaitForEmpty(ctx context.Context, queue string, pollInterval time.Duration) error
+	PurgeQueue(name string) (int, error)
+	DeleteQueue(name string, ifUnused, ifEmpty, noWait bool) (int, error)
+	BindExchange(destination, source, routingKey string, noWait bool, args Table) error
+	UnbindExchange(destination, source, routingKey string, noWait bool, args Table) error
+	DeclareExchange(options ExchangeOptions) error
+	DeclareQueue(options QueueOptions) (amqp.Queue, error)
+	DeclareBinding(options BindingOptions) error
+
+	NotifyClosed() <-chan error
+	Channel() *amqp.Channel
+	WithChannel(fn func(*amqp.Channel) error) error
+	IsConnected() bool
+	HealthCheck(ctx context.Context, optionFuncs ...func(*HealthCheckOptions)) error
+}
+
+// Publishing is implemented by *Publisher, code can depend on it instead of the concrete type
+// so that a fake can be substituted in tests
+type Publishing interface {
+	Publish(data []byte, routingKeys []string, optionFuncs ...func(*PublishOptions)) error
+	TryPublish(data []byte, routingKeys []string, optionFuncs ...func(*PublishOptions)) error
+	PublishToQueue(data []byte, queue string, optionFuncs ...func(*PublishOptions)) error
+	PublishWithContext(ctx context.Context, data []byte, routingKeys []string, optionFuncs ...func(*PublishOptions)) error
+	PublishWithConfirm(data []byte, routingKeys []string, timeout time.Duration, optionFuncs ...func(*PublishOptions)) error
+	NotifyPublish() <-chan amqp.Confirmation
+	NotifyReturn() <-chan Return
+	NotifyBlocked() <-chan amqp.Blocking
+	IsBlocked() bool
+
+	BeginTx() error
+	CommitTx() error
+	RollbackTx() error
+
+	DeclareExchange(options ExchangeOptions) error
+	DeclareQueue(options QueueOptions) (amqp.Queue, error)
+	DeclareBinding(options BindingOptions) error
+
+	Channel() *amqp.Channel
+	WithChannel(fn func(*amqp.Channel) error) error
+	IsConnected() bool
+	HealthCheck(ctx context.Context, optionFuncs ...func(*HealthCheckOptions)) error
+	Close() error
+}
+
+var (
+	_ Consuming  = Consumer{}
+	_ Publishing = &Publisher{}
+)
@@ -0,0 +1,57 @@
+package rabbitmq
+
+import "encoding/json"
+
+// JSONHandlerOptions are used to describe how a JSON handler deals with deliveries
+// RequeueMalformed set to true requeues deliveries whose body can't be unmarshaled
+type JSONHandlerOptions struct {
+	RequeueMalformed bool
+}
+
+// WithJSONHandlerOptionsRequeueMalformed makes the handler requeue deliveries whose body
+// can't be unmarshaled instead of rejecting them, which is only useful if another consumer
+// of the queue may be able to handle them
+func WithJSONHandlerOptionsRequeueMalformed(options *JSONHandlerOptions) {
+	options.RequeueMalformed = true
+}
+
+// PublishJSON marshals v to JSON and publishes it to the given routing keys
+// with the "application/json" content type, which the options can override
+func PublishJSON[T any](
+	publisher *Publisher,
+	v T,
+	routingKeys []string,
+	optionFuncs ...func(*PublishOptions),
+) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	optionFuncs = append([]func(*PublishOptions){WithPublishOptionsContentType("application/json")}, optionFuncs...)
+	return publisher.Publish(data, routingKeys, optionFuncs...)
+}
+
+// NewJSONHandler returns a handler for StartConsuming that unmarshals the body of each delivery
+// into a T before calling fn with it. Deliveries whose body can't be unmarshaled are rejected
+// without being requeued, so they're dead-lettered if the queue has a dead letter exchange
+// and discarded otherwise
+func NewJSONHandler[T any](
+	fn func(v T, d Delivery) bool,
+	optionFuncs ...func(*JSONHandlerOptions),
+) func(d Delivery) bool {
+	options := &JSONHandlerOptions{}
+	for _, optionFunc := range optionFuncs {
+		optionFunc(options)
+	}
+	return func(d Delivery) bool {
+		var v T
+		err := json.Unmarshal(d.Body, &v)
+		if err != nil {
+			// the error can't be handled here and the consumer
+			// won't settle the delivery again either way
+			_ = d.Reject(options.RequeueMalformed)
+			return false
+		}
+		return fn(v, d)
+	}
+}
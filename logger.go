@@ -3,6 +3,8 @@ package rabbitmq
 import (
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 )
 
 // Logger is the interface to send logs to. It can be set using
@@ -24,3 +26,150 @@ func (l stdLogger) Printf(format string, v ...interface{}) {
 type noLogger struct{}
 
 func (l noLogger) Printf(format string, v ...interface{}) {}
+
+// LogLevel is the severity of a log
+type LogLevel int
+
+const (
+	// LogLevelDebug is for details of the normal operation, like goroutines starting and stopping
+	LogLevelDebug LogLevel = iota
+	// LogLevelInfo is for noteworthy events of the normal operation, like reconnections succeeding
+	LogLevelInfo
+	// LogLevelWarn is for problems that are recovered from, like a lost connection
+	LogLevelWarn
+	// LogLevelError is for problems that lose or can't settle messages, or that can't be recovered from
+	LogLevelError
+)
+
+// String returns the name of the level
+func (level LogLevel) String() string {
+	switch level {
+	case LogLevelDebug:
+		return "DEBUG"
+	case LogLevelInfo:
+		return "INFO"
+	case LogLevelWarn:
+		return "WARN"
+	case LogLevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LogLevel(%d)", int(level))
+	}
+}
+
+// LeveledLogger is the interface to send logs to with their severity. It can be set using
+// WithPublisherOptionsLeveledLogger() or WithConsumerOptionsLeveledLogger().
+type LeveledLogger interface {
+	Debugf(string, ...interface{})
+	Infof(string, ...interface{})
+	Warnf(string, ...interface{})
+	Errorf(string, ...interface{})
+}
+
+// printfLogger adapts a Logger to a LeveledLogger, the logs below
+// the minimum level are dropped and the others are prefixed with their level
+type printfLogger struct {
+	logger Logger
+	level  LogLevel
+}
+
+// NewLeveledLogger returns a LeveledLogger that sends the logs of at least
+// the given level to the logger, prefixed with their level
+func NewLeveledLogger(logger Logger, level LogLevel) LeveledLogger {
+	return printfLogger{logger: logger, level: level}
+}
+
+func (l printfLogger) Debugf(format string, v ...interface{}) {
+	l.logf(LogLevelDebug, format, v...)
+}
+
+func (l printfLogger) Infof(format string, v ...interface{}) {
+	l.logf(LogLevelInfo, format, v...)
+}
+
+func (l printfLogger) Warnf(format string, v ...interface{}) {
+	l.logf(LogLevelWarn, format, v...)
+}
+
+func (l printfLogger) Errorf(format string, v ...interface{}) {
+	l.logf(LogLevelError, format, v...)
+}
+
+func (l printfLogger) logf(level LogLevel, format string, v ...interface{}) {
+	if level < l.level {
+		return
+	}
+	l.logger.Printf(fmt.Sprintf("%s %s", level, format), v...)
+}
+
+// getLeveledLogger returns the leveled logger if set, or else
+// the logger adapted to log from the given level
+func getLeveledLogger(leveled LeveledLogger, logger Logger, level LogLevel) LeveledLogger {
+	if leveled != nil {
+		return leveled
+	}
+	return NewLeveledLogger(logger, level)
+}
+
+// StructuredLogger is the interface to send logs to with their level and fields, like the queue
+// and consumer_tag they're about, the reconnect attempt or the error. It can be set using
+// WithPublisherOptionsStructuredLogger() or WithConsumerOptionsStructuredLogger().
+type StructuredLogger interface {
+	Log(level LogLevel, msg string, fields map[string]interface{})
+}
+
+// fieldLogger sends the logs to the structured logger if one is set, or else
+// to the leveled logger with the fields formatted after the message
+type fieldLogger struct {
+	leveled    LeveledLogger
+	structured StructuredLogger
+}
+
+func (l fieldLogger) Debugf(format string, v ...interface{}) {
+	l.Log(LogLevelDebug, fmt.Sprintf(format, v...), nil)
+}
+
+func (l fieldLogger) Infof(format string, v ...interface{}) {
+	l.Log(LogLevelInfo, fmt.Sprintf(format, v...), nil)
+}
+
+func (l fieldLogger) Warnf(format string, v ...interface{}) {
+	l.Log(LogLevelWarn, fmt.Sprintf(format, v...), nil)
+}
+
+func (l fieldLogger) Errorf(format string, v ...interface{}) {
+	l.Log(LogLevelError, fmt.Sprintf(format, v...), nil)
+}
+
+func (l fieldLogger) Log(level LogLevel, msg string, fields map[string]interface{}) {
+	if l.structured != nil {
+		l.structured.Log(level, msg, fields)
+		return
+	}
+	msg = formatFields(msg, fields)
+	switch level {
+	case LogLevelDebug:
+		l.leveled.Debugf("%s", msg)
+	case LogLevelInfo:
+		l.leveled.Infof("%s", msg)
+	case LogLevelWarn:
+		l.leveled.Warnf("%s", msg)
+	default:
+		l.leveled.Errorf("%s", msg)
+	}
+}
+
+// formatFields appends the fields to the message as key=value pairs sorted by key
+func formatFields(msg string, fields map[string]interface{}) string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	builder := &strings.Builder{}
+	builder.WriteString(msg)
+	for _, key := range keys {
+		fmt.Fprintf(builder, " %s=%v", key, fields[key])
+	}
+	return builder.String()
+}
@@ -0,0 +1,77 @@
+package rabbitmq
+
+import (
+	"context"
+	"runtime/debug"
+)
+
+// Handler processes a delivery and returns whether it should be acked
+type Handler func(d Delivery) bool
+
+// Middleware wraps a handler to add behaviour around it, such as logging or metrics
+type Middleware func(next Handler) Handler
+
+// deliveryScope carries what the middleware chain can't pass along with the delivery,
+// the context given to the handler and the action it returned
+type deliveryScope struct {
+	ctx    context.Context
+	action Action
+	// skipped is set by a middleware acking the delivery without passing it on
+	skipped bool
+}
+
+// applyMiddleware wraps the handler with the middleware, the first one being the outermost.
+// The chain is built once, the context given to the handler is passed through to the
+// wrapped handler in the scope of the delivery
+func applyMiddleware(
+	handler func(ctx context.Context, d Delivery) Action,
+	middleware []Middleware,
+) func(ctx context.Context, d Delivery) Action {
+	if len(middleware) == 0 {
+		return handler
+	}
+	next := Handler(func(d Delivery) bool {
+		if d.scope == nil {
+			// a middleware passed on a delivery of its own
+			return handler(context.Background(), d) == Ack
+		}
+		d.scope.action = handler(d.scope.ctx, d)
+		return d.scope.action == Ack
+	})
+	for i := len(middleware) - 1; i >= 0; i-- {
+		next = middleware[i](next)
+	}
+	return func(ctx context.Context, d Delivery) Action {
+		scope := &deliveryScope{ctx: ctx, action: NackRequeue}
+		d.scope = scope
+		ack := next(d)
+		if ack && scope.skipped {
+			// the consumer acks it even when the handler is the one acking
+			return ackUnhandled
+		}
+		if ack == (scope.action == Ack) {
+			// the middleware kept the handler's outcome
+			return scope.action
+		}
+		return actionOf(ack)
+	}
+}
+
+// RecoverMiddleware returns a middleware that recovers from panics in the handler,
+// logs them and nacks the delivery instead of crashing the consumer goroutine
+func RecoverMiddleware(logger Logger) Middleware {
+	if logger == nil {
+		logger = &noLogger{}
+	}
+	return func(next Handler) Handler {
+		return func(d Delivery) (ack bool) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Printf("recovered from panic in handler: %v\n%s", r, debug.Stack())
+					ack = false
+				}
+			}()
+			return next(d)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package rabbitmq
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/samuelkuklis/go-rabbitmq/rabbitmqtest"
+	"github.com/streadway/amqp"
+)
+
+func TestMiddlewareIsSetUpOnce(t *testing.T) {
+	broker := rabbitmqtest.NewBroker()
+	defer broker.Close()
+	reconnected := make(chan struct{}, 1)
+	consumer, err := NewConsumer(broker.URL(), broker.Config(),
+		withConsumerOptionsClock(newFakeClock()),
+		WithConsumerOptionsReconnectedCallback(func() {
+			reconnected <- struct{}{}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.StopConsuming()
+
+	var setUps, calls int32
+	counting := func(next Handler) Handler {
+		atomic.AddInt32(&setUps, 1)
+		// the state of the middleware lasts as long as the consumption
+		var seen int32
+		return func(d Delivery) bool {
+			atomic.StoreInt32(&calls, atomic.AddInt32(&seen, 1))
+			return next(d)
+		}
+	}
+	// the middleware overrides the handler, which acks everything, on the discarded messages
+	discarding := func(next Handler) Handler {
+		return func(d Delivery) bool {
+			return next(d) && string(d.Body) != "discarded"
+		}
+	}
+	handled := make(chan string, 10)
+	err = consumer.StartConsuming(func(d Delivery) bool {
+		handled <- string(d.Body)
+		return true
+	}, "middleware", nil,
+		WithConsumeOptionsMiddleware(counting, discarding),
+		WithConsumeOptionsConsumerNoRequeue,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, broker, "middleware", "first")
+	<-handled
+	// the ack could be lost with the connection, which would deliver the message again
+	waitFor(t, 5*time.Second, func() bool {
+		state, _ := broker.Queue("middleware")
+		return state.Ready == 0 && state.Unacked == 0
+	})
+	broker.DropConnections()
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer didn't resume")
+	}
+	for _, body := range []string{"discarded", "last"} {
+		publish(t, broker, "middleware", body)
+		<-handled
+	}
+	ok := waitFor(t, 5*time.Second, func() bool {
+		state, _ := broker.Queue("middleware")
+		return state.Ready == 0 && state.Unacked == 0
+	})
+	if !ok {
+		t.Error("the messages weren't settled")
+	}
+
+	if got := atomic.LoadInt32(&setUps); got != 1 {
+		t.Errorf("got the middleware set up %d times, want once", got)
+	}
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("got %d deliveries counted by the middleware, want 3", got)
+	}
+}
+
+func TestDedupAcksDuplicatesWithManualAck(t *testing.T) {
+	broker := rabbitmqtest.NewBroker()
+	defer broker.Close()
+	consumer, err := NewConsumer(broker.URL(), broker.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.StopConsuming()
+	handled := make(chan string, 10)
+	err = consumer.StartConsuming(func(d Delivery) bool {
+		handled <- d.MessageId
+		err := d.Ack()
+		if err != nil {
+			t.Error(err)
+		}
+		return true
+	}, "dedup", nil,
+		WithConsumeOptionsConsumerManualAck,
+		WithConsumeOptionsDedup(NewMemoryDedupStore(10), time.Minute),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"first", "first", "second"} {
+		_, err := broker.Publish("", "dedup", amqp.Publishing{MessageId: id, Body: []byte(id)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"first", "second"} {
+		select {
+		case got := <-handled:
+			if got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q wasn't handled", want)
+		}
+	}
+	ok := waitFor(t, 5*time.Second, func() bool {
+		state, _ := broker.Queue("dedup")
+		return state.Ready == 0 && state.Unacked == 0
+	})
+	if !ok {
+		state, _ := broker.Queue("dedup")
+		t.Errorf("got queue state %+v, want the duplicate acked", state)
+	}
+}
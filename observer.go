@@ -0,0 +1,40 @@
+package rabbitmq
+
+import "time"
+
+// Observer is the interface notified of publishing, consuming and reconnection events,
+// it can be implemented to expose metrics. It can be set using
+// WithPublisherOptionsObserver() or WithConsumerOptionsObserver().
+type Observer interface {
+	// IncPublished is called after a message was published, err is the result of the publishing
+	IncPublished(exchange, routingKey string, err error)
+	// IncConsumed is called when a delivery is received, before it's handled
+	IncConsumed(queue string)
+	// ObserveDeliveryWait is called with how long a delivery waited after being received for a handler
+	// to be free, a long wait means the concurrency is too low for the prefetch count
+	ObserveDeliveryWait(queue string, duration time.Duration)
+	// ObserveHandlerDuration is called with how long the handler took to process a delivery
+	ObserveHandlerDuration(queue string, duration time.Duration)
+	// IncAcked and IncNacked are called when the library settles a delivery
+	IncAcked(queue string)
+	IncNacked(queue string)
+	// IncReconnect is called every time a new channel was obtained after the previous one was lost
+	IncReconnect()
+}
+
+// noObserver ignores all events, this is the default.
+type noObserver struct{}
+
+func (o noObserver) IncPublished(exchange, routingKey string, err error) {}
+
+func (o noObserver) IncConsumed(queue string) {}
+
+func (o noObserver) ObserveDeliveryWait(queue string, duration time.Duration) {}
+
+func (o noObserver) ObserveHandlerDuration(queue string, duration time.Duration) {}
+
+func (o noObserver) IncAcked(queue string) {}
+
+func (o noObserver) IncNacked(queue string) {}
+
+func (o noObserver) IncReconnect() {}
@@ -0,0 +1,106 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// PublisherPool spreads publishings over several publishers so they don't contend
+// for a single channel. Every publisher of the pool has its own connection and channel,
+// which are reconnected and confirmed independently
+type PublisherPool struct {
+	// next is accessed atomically, it comes first to be 64-bit aligned
+	next       uint64
+	publishers []*Publisher
+}
+
+// NewPublisherPool returns a pool of size publishers connected to the given rabbitmq server,
+// all created with the same options. The returns of all the publishers are sent on the returned channel
+func NewPublisherPool(url string, config amqp.Config, size int, optionFuncs ...func(*PublisherOptions)) (*PublisherPool, <-chan Return, error) {
+	if size < 1 {
+		return nil, nil, errors.New("publisher pool size must be at least 1")
+	}
+
+	pool := &PublisherPool{}
+	returnChans := []<-chan Return{}
+	for i := 0; i < size; i++ {
+		publisher, returnChan, err := NewPublisher(url, config, optionFuncs...)
+		if err != nil {
+			pool.StopPublishing()
+			return nil, nil, err
+		}
+		pool.publishers = append(pool.publishers, publisher)
+		returnChans = append(returnChans, returnChan)
+	}
+	return pool, mergeReturns(returnChans), nil
+}
+
+// mergeReturns forwards the returns of every channel to a single one,
+// which is closed once all of them are closed
+func mergeReturns(returnChans []<-chan Return) <-chan Return {
+	merged := make(chan Return)
+	wg := &sync.WaitGroup{}
+	for _, returnChan := range returnChans {
+		wg.Add(1)
+		go func(returnChan <-chan Return) {
+			defer wg.Done()
+			for ret := range returnChan {
+				merged <- ret
+			}
+		}(returnChan)
+	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+	return merged
+}
+
+// Publish publishes the provided data to the given routing keys with the next publisher of the pool
+func (pool *PublisherPool) Publish(
+	data []byte,
+	routingKeys []string,
+	optionFuncs ...func(*PublishOptions),
+) error {
+	return pool.nextPublisher().Publish(data, routingKeys, optionFuncs...)
+}
+
+// PublishWithContext publishes the provided data to the given routing keys with the next publisher of the pool,
+// see Publisher.PublishWithContext
+func (pool *PublisherPool) PublishWithContext(
+	ctx context.Context,
+	data []byte,
+	routingKeys []string,
+	optionFuncs ...func(*PublishOptions),
+) error {
+	return pool.nextPublisher().PublishWithContext(ctx, data, routingKeys, optionFuncs...)
+}
+
+// PublishWithConfirm publishes the provided data to the given routing keys with the next publisher of the pool
+// and waits for the confirmations, see Publisher.PublishWithConfirm
+func (pool *PublisherPool) PublishWithConfirm(
+	data []byte,
+	routingKeys []string,
+	timeout time.Duration,
+	optionFuncs ...func(*PublishOptions),
+) error {
+	return pool.nextPublisher().PublishWithConfirm(data, routingKeys, timeout, optionFuncs...)
+}
+
+// StopPublishing stops all the publishers of the pool
+func (pool *PublisherPool) StopPublishing() {
+	for _, publisher := range pool.publishers {
+		publisher.StopPublishing()
+	}
+}
+
+// nextPublisher returns the publishers of the pool in turn
+func (pool *PublisherPool) nextPublisher() *Publisher {
+	n := atomic.AddUint64(&pool.next, 1)
+	return pool.publishers[(n-1)%uint64(len(pool.publishers))]
+}
@@ -0,0 +1,133 @@
+package rabbitmq
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// adaptivePrefetchInterval is how often the prefetch count is adjusted
+	adaptivePrefetchInterval = time.Second
+	// saturatedUtilization is the share of time the handlers must be busy
+	// for the prefetch count to be considered large enough
+	saturatedUtilization = 0.9
+)
+
+// prefetchController adjusts the prefetch count of the channel to keep the handlers busy
+// without holding more deliveries than they need. When the handlers wait for deliveries the
+// prefetch count is doubled, when they're always busy it's lowered a little
+type prefetchController struct {
+	// busy is the time spent in handlers and handled the number of deliveries handled
+	// since the last adjustment, they're accessed atomically so they come first to be 64-bit aligned
+	busy    int64
+	handled int64
+
+	consumer     Consumer
+	min          int
+	max          int
+	concurrency  int
+	prefetchSize int
+
+	current int
+	// applied and appliedChannel are the prefetch count last set and the channel it was set on
+	applied        int
+	appliedChannel *amqp.Channel
+}
+
+func newPrefetchController(consumer Consumer, options ConsumeOptions) *prefetchController {
+	return &prefetchController{
+		consumer:     consumer,
+		min:          options.AdaptivePrefetchMin,
+		max:          options.AdaptivePrefetchMax,
+		concurrency:  options.Concurrency,
+		prefetchSize: options.QOSPrefetchSize,
+		current:      options.AdaptivePrefetchMin,
+		applied:      options.AdaptivePrefetchMin,
+	}
+}
+
+// wrap returns a handler that records the time spent in the given one
+func (controller *prefetchController) wrap(
+	handler func(ctx context.Context, d Delivery) Action,
+) func(ctx context.Context, d Delivery) Action {
+	return func(ctx context.Context, d Delivery) Action {
+		start := time.Now()
+		defer func() {
+			atomic.AddInt64(&controller.busy, int64(time.Since(start)))
+			atomic.AddInt64(&controller.handled, 1)
+		}()
+		return handler(ctx, d)
+	}
+}
+
+// run adjusts the prefetch count periodically until the context is done
+func (controller *prefetchController) run(ctx context.Context) {
+	ticker := time.NewTicker(adaptivePrefetchInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			busy := time.Duration(atomic.SwapInt64(&controller.busy, 0))
+			handled := atomic.SwapInt64(&controller.handled, 0)
+			controller.adjust(busy, handled, now.Sub(last))
+			last = now
+			controller.apply()
+		}
+	}
+}
+
+// adjust computes the prefetch count from how busy the handlers were during the elapsed time
+func (controller *prefetchController) adjust(busy time.Duration, handled int64, elapsed time.Duration) {
+	if handled == 0 || elapsed <= 0 {
+		// nothing to learn from an empty queue
+		return
+	}
+	utilization := float64(busy) / float64(elapsed*time.Duration(controller.concurrency))
+	if utilization < saturatedUtilization {
+		controller.current *= 2
+	} else {
+		decrease := controller.current / 8
+		if decrease < 1 {
+			decrease = 1
+		}
+		controller.current -= decrease
+	}
+	if controller.current > controller.max {
+		controller.current = controller.max
+	}
+	if controller.current < controller.min {
+		controller.current = controller.min
+	}
+}
+
+// apply sets the prefetch count on the channel if it changed, or if the channel was replaced
+// since it's reset to the minimum when consuming restarts after a reconnection
+func (controller *prefetchController) apply() {
+	chManager := controller.consumer.chManager
+	chManager.channelMux.RLock()
+	defer chManager.channelMux.RUnlock()
+	if controller.appliedChannel == nil {
+		controller.appliedChannel = chManager.channel
+	}
+	if controller.appliedChannel != chManager.channel {
+		controller.appliedChannel = chManager.channel
+		controller.applied = controller.min
+	}
+	if controller.current == controller.applied {
+		return
+	}
+
+	err := chManager.channel.Qos(controller.current, controller.prefetchSize, true)
+	if err != nil {
+		controller.consumer.logger.Warnf("couldn't adjust prefetch count: %v", err)
+		return
+	}
+	controller.consumer.logger.Debugf("adjusted prefetch count from %d to %d", controller.applied, controller.current)
+	controller.applied = controller.current
+}
@@ -1,9 +1,14 @@
 package rabbitmq
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"math"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/streadway/amqp"
 )
@@ -22,29 +27,88 @@ const (
 	Persistent uint8 = amqp.Persistent
 )
 
+// ErrNotConnected is returned by TryPublish when the publisher has no open channel to the server
+var ErrNotConnected = errors.New("publisher is not connected")
+
+// ErrImmediateNotSupported is returned when publishing with the immediate flag, which RabbitMQ
+// removed in 3.0 and answers by closing the connection. Per-message TTLs of zero or consumer
+// timeouts are the alternatives, see https://www.rabbitmq.com/blog/2012/11/19/breaking-things-with-rabbitmq-3-0
+var ErrImmediateNotSupported = errors.New("the immediate flag isn't supported by RabbitMQ since 3.0, " +
+	"use a per-message TTL of 0 to drop messages no consumer can take right away")
+
 // Return captures a flattened struct of fields returned by the server when a
-// Publishing is unable to be delivered either due to the `mandatory` flag set
-// and no route found, or `immediate` flag set and no free consumer.
+// Publishing is unable to be delivered due to the `mandatory` flag set and no route found.
 type Return struct {
 	amqp.Return
 }
 
+// Unroutable returns whether the message was returned because no queue was bound to receive it
+func (r Return) Unroutable() bool {
+	return r.ReplyCode == amqp.NoRoute
+}
+
 // PublishOptions are used to control how data is published
 type PublishOptions struct {
 	Exchange string
 	// Mandatory fails to publish if there are no queues
 	// bound to the routing key
 	Mandatory bool
-	// Immediate fails to publish if there are no consumers
-	// that can ack bound to the queue on the routing key
+	// Immediate is rejected with ErrImmediateNotSupported when publishing,
+	// since RabbitMQ doesn't support it
 	Immediate   bool
 	ContentType string
+	// ContentEncoding tells how the body is encoded, Gzip compresses it and sets it to "gzip"
+	ContentEncoding string
+	Gzip            bool
 	// Transient or Persistent
 	DeliveryMode uint8
 	// Expiration time in ms that a message will expire from a queue.
 	// See https://www.rabbitmq.com/ttl.html#per-message-ttl-in-publishers
 	Expiration string
 	Headers    Table
+	// Priority of the message, it's only taken into account
+	// by queues declared with a maximum priority
+	Priority uint8
+	// ReplyTo is the name of the queue responses should be published to
+	ReplyTo string
+	// CorrelationID identifies the request a response belongs to
+	CorrelationID string
+	// MessageID identifies the message, for example to deduplicate it
+	MessageID string
+	// Type describes the message, it's only meaningful to the application
+	Type string
+	// AppID identifies the application that published the message
+	AppID string
+	// Timestamp of the message, AutoTimestamp sets it to the time of publishing
+	Timestamp     time.Time
+	AutoTimestamp bool
+	// Delay is how long the delayed message exchange plugin holds the message before routing it
+	Delay time.Duration
+	// TraceContext is injected into the headers by the publisher's propagator
+	TraceContext context.Context
+	// Routes are published to after the routing keys given to Publish, which are published to Exchange
+	Routes []Route
+	// Properties is called with every message after the other options were applied, to set any field
+	Properties func(message *amqp.Publishing)
+	// DeclareQueue is the queue PublishToQueue declares before publishing, other publishings ignore it
+	DeclareQueue *QueueOptions
+}
+
+// Route is an exchange and a routing key a message is published to
+type Route struct {
+	Exchange   string
+	RoutingKey string
+}
+
+// WithPublishOptionsRouting returns a function that adds a route the message is published to, in addition
+// to the routing keys given to Publish. It can be given several times to publish the same message to several
+// exchanges, for instance a primary and an audit one. A message is published to every routing key and every
+// route in turn, the first failure is returned and the message isn't published to the ones left.
+// The publishings that succeeded before aren't undone, unless the publisher is transactional and rolled back
+func WithPublishOptionsRouting(exchange, routingKey string) func(*PublishOptions) {
+	return func(options *PublishOptions) {
+		options.Routes = append(options.Routes, Route{Exchange: exchange, RoutingKey: routingKey})
+	}
 }
 
 // WithPublishOptionsExchange returns a function that sets the exchange to publish to
@@ -54,14 +118,24 @@ func WithPublishOptionsExchange(exchange string) func(*PublishOptions) {
 	}
 }
 
+// WithPublishOptionsDeclareQueue returns a function that makes PublishToQueue declare the queue with
+// the given options before publishing, the name of the queue replaces the one of the options.
+// The queue is declared on every call, declaring it once with DeclareQueue is cheaper at high rates
+func WithPublishOptionsDeclareQueue(queueOptions QueueOptions) func(*PublishOptions) {
+	return func(options *PublishOptions) {
+		options.DeclareQueue = &queueOptions
+	}
+}
+
 // WithPublishOptionsMandatory makes the publishing mandatory, which means when a queue is not
 // bound to the routing key a message will be sent back on the returns channel for you to handle
 func WithPublishOptionsMandatory(options *PublishOptions) {
 	options.Mandatory = true
 }
 
-// WithPublishOptionsImmediate makes the publishing immediate, which means when a consumer is not available
-// to immediately handle the new message, a message will be sent back on the returns channel for you to handle
+// WithPublishOptionsImmediate makes the publishing immediate, which AMQP defines as returning the message
+// when no consumer can take it right away. RabbitMQ removed it in 3.0, so publishing with it fails
+// with ErrImmediateNotSupported instead of having the server close the connection
 func WithPublishOptionsImmediate(options *PublishOptions) {
 	options.Immediate = true
 }
@@ -89,10 +163,118 @@ func WithPublishOptionsExpiration(expiration string) func(options *PublishOption
 	}
 }
 
-// WithPublishOptionsHeaders returns a function that sets message header values, i.e. "msg-id"
+// WithPublishOptionsPriority returns a function that sets the priority of a message. Messages with a
+// higher priority are delivered first by priority queues, see WithConsumeOptionsPriority. Publishing
+// through the default exchange to a queue the publisher declared fails if the priority exceeds the
+// queue's maximum, otherwise RabbitMQ treats priorities higher than the maximum as the maximum
+func WithPublishOptionsPriority(priority uint8) func(*PublishOptions) {
+	return func(options *PublishOptions) {
+		options.Priority = priority
+	}
+}
+
+// WithPublishOptionsTTL returns a function that sets the expiry/TTL of a message from a duration,
+// which is truncated to milliseconds. It's the same as WithPublishOptionsExpiration without having
+// to format the milliseconds yourself
+func WithPublishOptionsTTL(ttl time.Duration) func(*PublishOptions) {
+	return func(options *PublishOptions) {
+		if ttl < 0 {
+			ttl = 0
+		}
+		options.Expiration = strconv.FormatInt(ttl.Milliseconds(), 10)
+	}
+}
+
+// WithPublishOptionsDelay returns a function that sets the x-delay header, so an exchange declared
+// with WithConsumeOptionsDelayedExchange routes the message once the delay has elapsed.
+// Publishing fails if the delay is negative or too long to be expressed in the header
+func WithPublishOptionsDelay(delay time.Duration) func(*PublishOptions) {
+	return func(options *PublishOptions) {
+		options.Delay = delay
+	}
+}
+
+// WithPublishOptionsHeaders returns a function that sets message header values, i.e. "msg-id".
+// The headers are merged with the ones set by previous options, a header that is set
+// more than once keeps the last value
 func WithPublishOptionsHeaders(headers Table) func(*PublishOptions) {
 	return func(options *PublishOptions) {
-		options.Headers = headers
+		// the headers are copied so tables given by the caller aren't modified
+		merged := Table(copyTable(options.Headers))
+		for key, value := range headers {
+			merged[key] = value
+		}
+		options.Headers = merged
+	}
+}
+
+// WithPublishOptionsHeader returns a function that sets a single message header value,
+// which is merged with the headers set by other options
+func WithPublishOptionsHeader(key string, value interface{}) func(*PublishOptions) {
+	return WithPublishOptionsHeaders(Table{key: value})
+}
+
+// WithPublishOptionsReplyTo returns a function that sets the queue responses should be published to
+func WithPublishOptionsReplyTo(replyTo string) func(*PublishOptions) {
+	return func(options *PublishOptions) {
+		options.ReplyTo = replyTo
+	}
+}
+
+// WithPublishOptionsCorrelationID returns a function that sets the correlation id of the message
+func WithPublishOptionsCorrelationID(correlationID string) func(*PublishOptions) {
+	return func(options *PublishOptions) {
+		options.CorrelationID = correlationID
+	}
+}
+
+// WithPublishOptionsMessageID returns a function that sets the message id
+func WithPublishOptionsMessageID(messageID string) func(*PublishOptions) {
+	return func(options *PublishOptions) {
+		options.MessageID = messageID
+	}
+}
+
+// WithPublishOptionsType returns a function that sets the type of the message
+func WithPublishOptionsType(messageType string) func(*PublishOptions) {
+	return func(options *PublishOptions) {
+		options.Type = messageType
+	}
+}
+
+// WithPublishOptionsAppID returns a function that sets the id of the application publishing the message
+func WithPublishOptionsAppID(appID string) func(*PublishOptions) {
+	return func(options *PublishOptions) {
+		options.AppID = appID
+	}
+}
+
+// WithPublishOptionsTimestamp returns a function that sets the timestamp of the message
+func WithPublishOptionsTimestamp(timestamp time.Time) func(*PublishOptions) {
+	return func(options *PublishOptions) {
+		options.Timestamp = timestamp
+	}
+}
+
+// WithPublishOptionsAutoTimestamp sets the timestamp of the message to the time it's published
+func WithPublishOptionsAutoTimestamp(options *PublishOptions) {
+	options.AutoTimestamp = true
+}
+
+// WithPublishOptionsProperties returns a function that sets a function called with every message
+// before it's published, once the other options were applied, so it can set any field of the message
+// or override the other options. It's called once per routing key, with a message of its own
+func WithPublishOptionsProperties(properties func(message *amqp.Publishing)) func(*PublishOptions) {
+	return func(options *PublishOptions) {
+		options.Properties = properties
+	}
+}
+
+// WithPublishOptionsTraceContext returns a function that sets the context whose trace is
+// injected into the message headers, it's ignored unless the publisher has a propagator
+func WithPublishOptionsTraceContext(ctx context.Context) func(*PublishOptions) {
+	return func(options *PublishOptions) {
+		options.TraceContext = ctx
 	}
 }
 
@@ -100,12 +282,34 @@ func WithPublishOptionsHeaders(headers Table) func(*PublishOptions) {
 type Publisher struct {
 	chManager *channelManager
 
-	notifyFlowChan chan bool
-
 	disablePublishDueToFlow    bool
 	disablePublishDueToFlowMux *sync.RWMutex
 
-	logger Logger
+	// confirms is nil unless the publisher is in confirm mode
+	confirms *publisherConfirms
+	// tx is nil unless the publisher is transactional
+	tx *publisherTx
+	// declareExchanges are declared again on every new channel, before it's used
+	declareExchanges []ExchangeOptions
+	// queuePriorities are the maximum priorities of the queues declared with DeclareQueue
+	queuePriorities    map[string]int
+	queuePrioritiesMux *sync.Mutex
+
+	logger     fieldLogger
+	observer   Observer
+	propagator Propagator
+
+	shutdownTimeout time.Duration
+	// done is closed once Close is called, closeMux makes sure no publishing
+	// is added to inFlight after that
+	done     chan struct{}
+	closeMux *sync.Mutex
+	inFlight *sync.WaitGroup
+
+	// returns receives the returns of every channel the publisher uses,
+	// returnsWG tracks the goroutines forwarding them
+	returns   chan Return
+	returnsWG *sync.WaitGroup
 }
 
 // PublisherOptions are used to describe a publisher's configuration.
@@ -113,6 +317,169 @@ type Publisher struct {
 type PublisherOptions struct {
 	Logging bool
 	Logger  Logger
+	// LeveledLogger receives the level of every log and takes precedence over Logger
+	LeveledLogger LeveledLogger
+	// LogLevel is the minimum level of the logs sent to Logger
+	LogLevel LogLevel
+	// StructuredLogger receives the level and fields of every log and takes precedence over both
+	StructuredLogger StructuredLogger
+	// Confirm puts the channel in confirm mode so the server
+	// acks or nacks every publishing
+	Confirm bool
+	// Transactional lets the publisher use transactions, it can't be used with Confirm
+	Transactional bool
+	// ClientProperties are advertised to the server when connecting,
+	// in addition to the ones of the amqp.Config
+	ClientProperties Table
+	// Observer is notified of publishings and reconnects, to expose metrics
+	Observer Observer
+	// Propagator injects the trace context set by WithPublishOptionsTraceContext
+	Propagator Propagator
+	// ShutdownTimeout bounds how long Close waits for publishings in progress, zero means no limit
+	ShutdownTimeout time.Duration
+	// Heartbeat and DialTimeout override the ones of the amqp.Config when not zero
+	Heartbeat   time.Duration
+	DialTimeout time.Duration
+	// URLs are the addresses of other nodes of the cluster, tried along with the url of the constructor
+	URLs []string
+	// OnConnect, OnDisconnect and OnReconnect are called as the connection is made, lost and attempted again
+	OnConnect    func()
+	OnDisconnect func(err error)
+	OnReconnect  func(attempt int)
+	// ReconnectBackoff describes how long to wait between reconnect attempts
+	ReconnectBackoff BackoffOptions
+	// MaxReconnectAttempts is the number of failed reconnect attempts after which the publisher gives up,
+	// zero means no limit
+	MaxReconnectAttempts int
+	// DeclareExchanges are declared when the publisher is created and again after every reconnection
+	DeclareExchanges []ExchangeOptions
+}
+
+// WithPublisherOptionsDeclareExchange returns a function that makes the publisher declare the exchange
+// when it's created and again after every reconnection, so the exchange exists even if it was
+// auto-deleted or the server lost it. It can be passed several times to declare several exchanges
+func WithPublisherOptionsDeclareExchange(exchange ExchangeOptions) func(options *PublisherOptions) {
+	return func(options *PublisherOptions) {
+		options.DeclareExchanges = append(options.DeclareExchanges, exchange)
+	}
+}
+
+// WithPublisherOptionsOnConnect returns a function that sets a callback invoked once the channel is open,
+// before the constructor returns and after every reconnection, for instance to declare topology.
+// The callbacks run on the reconnect loop so they should return quickly
+func WithPublisherOptionsOnConnect(callback func()) func(options *PublisherOptions) {
+	return func(options *PublisherOptions) {
+		options.OnConnect = callback
+	}
+}
+
+// WithPublisherOptionsOnDisconnect returns a function that sets a callback invoked when the channel is
+// lost, with the cause of the reconnection, a *CloseError or a *CancelError
+func WithPublisherOptionsOnDisconnect(callback func(err error)) func(options *PublisherOptions) {
+	return func(options *PublisherOptions) {
+		options.OnDisconnect = callback
+	}
+}
+
+// WithPublisherOptionsOnReconnect returns a function that sets a callback invoked before each attempt
+// to open the channel again, with the attempt number starting at 1
+func WithPublisherOptionsOnReconnect(callback func(attempt int)) func(options *PublisherOptions) {
+	return func(options *PublisherOptions) {
+		options.OnReconnect = callback
+	}
+}
+
+// WithPublisherOptionsReconnectBackoff returns a function that sets the backoff used between reconnect
+// attempts. The first attempt waits initial, and every following attempt waits multiplier times longer
+// than the previous one, up to max. A max of zero means there is no limit. By default the backoff
+// starts at one second and doubles on every attempt
+func WithPublisherOptionsReconnectBackoff(initial, max time.Duration, multiplier float64) func(options *PublisherOptions) {
+	return func(options *PublisherOptions) {
+		options.ReconnectBackoff.Initial = initial
+		options.ReconnectBackoff.Max = max
+		options.ReconnectBackoff.Multiplier = multiplier
+	}
+}
+
+// WithPublisherOptionsReconnectJitter randomizes the wait between reconnect attempts, which prevents
+// many publishers from reconnecting at the same time after an outage
+func WithPublisherOptionsReconnectJitter(options *PublisherOptions) {
+	options.ReconnectBackoff.Jitter = true
+}
+
+// withPublisherOptionsClock returns a function that sets the clock waiting for the backoff
+// between reconnect attempts, so the tests don't have to wait for it
+func withPublisherOptionsClock(c clock) func(options *PublisherOptions) {
+	return func(options *PublisherOptions) {
+		options.ReconnectBackoff.clock = c
+	}
+}
+
+// WithPublisherOptionsMaxReconnectAttempts returns a function that sets the number of failed reconnect
+// attempts after which the publisher gives up, publishing then fails with amqp.ErrClosed.
+// Zero, the default, means the publisher never gives up
+func WithPublisherOptionsMaxReconnectAttempts(n int) func(options *PublisherOptions) {
+	return func(options *PublisherOptions) {
+		options.MaxReconnectAttempts = n
+	}
+}
+
+// lifecycleHooks returns the callbacks the channel manager calls
+func (options PublisherOptions) lifecycleHooks() lifecycleHooks {
+	return lifecycleHooks{
+		onConnect:    options.OnConnect,
+		onDisconnect: options.OnDisconnect,
+		onReconnect:  options.OnReconnect,
+	}
+}
+
+// WithPublisherOptionsConnectionName returns a function that sets the name of the connection,
+// which is shown in the RabbitMQ management UI
+func WithPublisherOptionsConnectionName(name string) func(options *PublisherOptions) {
+	return func(options *PublisherOptions) {
+		if options.ClientProperties == nil {
+			options.ClientProperties = Table{}
+		}
+		options.ClientProperties["connection_name"] = name
+	}
+}
+
+// WithPublisherOptionsClientProperties returns a function that adds properties
+// the client advertises to the server when connecting
+func WithPublisherOptionsClientProperties(properties Table) func(options *PublisherOptions) {
+	return func(options *PublisherOptions) {
+		if options.ClientProperties == nil {
+			options.ClientProperties = Table{}
+		}
+		for key, value := range properties {
+			options.ClientProperties[key] = value
+		}
+	}
+}
+
+// WithPublisherOptionsHeartbeat returns a function that sets the heartbeat interval of the connection,
+// which overrides the one of the amqp.Config. It defaults to 10 seconds
+func WithPublisherOptionsHeartbeat(heartbeat time.Duration) func(options *PublisherOptions) {
+	return func(options *PublisherOptions) {
+		options.Heartbeat = heartbeat
+	}
+}
+
+// WithPublisherOptionsDialTimeout returns a function that sets how long dialing the server may take,
+// which overrides the dialer of the amqp.Config. It defaults to 30 seconds
+func WithPublisherOptionsDialTimeout(timeout time.Duration) func(options *PublisherOptions) {
+	return func(options *PublisherOptions) {
+		options.DialTimeout = timeout
+	}
+}
+
+// WithPublisherOptionsURLs returns a function that adds the urls of other nodes of the cluster.
+// The nodes are tried in random order when connecting, and again when reconnecting,
+// starting with the ones that weren't connected to last
+func WithPublisherOptionsURLs(urls ...string) func(options *PublisherOptions) {
+	return func(options *PublisherOptions) {
+		options.URLs = append(options.URLs, urls...)
+	}
 }
 
 // WithPublisherOptionsLogging sets logging to true on the consumer options
@@ -130,100 +497,351 @@ func WithPublisherOptionsLogger(log Logger) func(options *PublisherOptions) {
 	}
 }
 
+// WithPublisherOptionsLeveledLogger sets logging to a custom interface that receives
+// the level of every log, it takes precedence over the Logger
+func WithPublisherOptionsLeveledLogger(log LeveledLogger) func(options *PublisherOptions) {
+	return func(options *PublisherOptions) {
+		options.Logging = true
+		options.LeveledLogger = log
+	}
+}
+
+// WithPublisherOptionsStructuredLogger sets logging to a custom interface that receives
+// the level and fields of every log, it takes precedence over the other loggers
+func WithPublisherOptionsStructuredLogger(log StructuredLogger) func(options *PublisherOptions) {
+	return func(options *PublisherOptions) {
+		options.Logging = true
+		options.StructuredLogger = log
+	}
+}
+
+// WithPublisherOptionsLogLevel sets the minimum level of the logs sent to the Logger,
+// the default is LogLevelDebug which logs everything
+func WithPublisherOptionsLogLevel(level LogLevel) func(options *PublisherOptions) {
+	return func(options *PublisherOptions) {
+		options.LogLevel = level
+	}
+}
+
+// WithPublisherOptionsObserver sets the observer notified of publishings and reconnects
+func WithPublisherOptionsObserver(observer Observer) func(options *PublisherOptions) {
+	return func(options *PublisherOptions) {
+		options.Observer = observer
+	}
+}
+
+// WithPublisherOptionsPropagator sets the propagator used to inject trace contexts into the message headers
+func WithPublisherOptionsPropagator(propagator Propagator) func(options *PublisherOptions) {
+	return func(options *PublisherOptions) {
+		options.Propagator = propagator
+	}
+}
+
+// WithPublisherOptionsShutdownTimeout sets how long Close waits for publishings in progress
+// before closing the channel anyway
+func WithPublisherOptionsShutdownTimeout(timeout time.Duration) func(options *PublisherOptions) {
+	return func(options *PublisherOptions) {
+		options.ShutdownTimeout = timeout
+	}
+}
+
+// WithPublisherOptionsConfirm puts the publisher's channel in confirm mode, which means
+// the server will ack or nack every message it receives. Confirmations can be received
+// with NotifyPublish or waited on with PublishWithConfirm
+func WithPublisherOptionsConfirm(options *PublisherOptions) {
+	options.Confirm = true
+}
+
 // NewPublisher returns a new publisher with an open channel to the cluster.
-// If you plan to enforce mandatory or immediate publishing, those failures will be reported
+// If you plan to enforce mandatory publishing, those failures will be reported
 // on the channel of Returns that you should setup a listener on.
+// The channel keeps receiving returns after a reconnection and is only closed by Close.
 // Flow controls are automatically handled as they are sent from the server, and publishing
 // will fail with an error when the server is requesting a slowdown
-func NewPublisher(url string, config amqp.Config, optionFuncs ...func(*PublisherOptions)) (Publisher, <-chan Return, error) {
+func NewPublisher(url string, config amqp.Config, optionFuncs ...func(*PublisherOptions)) (*Publisher, <-chan Return, error) {
+	options, err := getPublisherOptions(optionFuncs...)
+	if err != nil {
+		return nil, nil, err
+	}
+	chManager, err := newChannelManager(append([]string{url}, options.URLs...), withTimeouts(withClientProperties(config, options.ClientProperties), options.Heartbeat, options.DialTimeout), fieldLogger{leveled: options.LeveledLogger, structured: options.StructuredLogger}, options.Observer, options.ReconnectBackoff, options.MaxReconnectAttempts, options.lifecycleHooks())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return newPublisher(chManager, options)
+}
+
+// getPublisherOptions applies the option funcs and fills in the defaults
+func getPublisherOptions(optionFuncs ...func(*PublisherOptions)) (*PublisherOptions, error) {
 	options := &PublisherOptions{}
 	for _, optionFunc := range optionFuncs {
 		optionFunc(options)
 	}
+	if options.Confirm && options.Transactional {
+		return nil, errors.New("a publisher can't be both in confirm mode and transactional")
+	}
 	if options.Logger == nil {
 		options.Logger = &noLogger{} // default no logging
 	}
+	options.LeveledLogger = getLeveledLogger(options.LeveledLogger, options.Logger, options.LogLevel)
+	if options.Observer == nil {
+		options.Observer = &noObserver{}
+	}
+	return options, nil
+}
+
+// NewPublisherTLS works like NewPublisher but connects over TLS with the given config,
+// which requires an amqps:// url. The connection uses the same defaults as amqp.DialTLS
+func NewPublisherTLS(url string, config *tls.Config, optionFuncs ...func(*PublisherOptions)) (*Publisher, <-chan Return, error) {
+	return NewPublisherTLSWithConfig(url, getTLSConfig(config), config, optionFuncs...)
+}
 
-	chManager, err := newChannelManager(url, config, options.Logger)
+// NewPublisherTLSWithConfig works like NewPublisherTLS but dials with the given amqp config,
+// so the heartbeat, locale, dialer or channel max can be set. tlsConfig is used as its TLSClientConfig
+func NewPublisherTLSWithConfig(url string, config amqp.Config, tlsConfig *tls.Config, optionFuncs ...func(*PublisherOptions)) (*Publisher, <-chan Return, error) {
+	err := checkTLSURL(url)
 	if err != nil {
-		return Publisher{}, nil, err
+		return nil, nil, err
 	}
+	config.TLSClientConfig = tlsConfig
+	return NewPublisher(url, config, optionFuncs...)
+}
 
-	publisher := Publisher{
+// newPublisher sets up the notification handlers of a publisher on an already
+// established channel manager, which is closed if the publisher can't be set up
+func newPublisher(chManager *channelManager, options *PublisherOptions) (*Publisher, <-chan Return, error) {
+	publisher := &Publisher{
 		chManager:                  chManager,
-		notifyFlowChan:             make(chan bool),
 		disablePublishDueToFlow:    false,
 		disablePublishDueToFlowMux: &sync.RWMutex{},
-		logger:                     options.Logger,
+		logger:                     chManager.logger,
+		observer:                   options.Observer,
+		propagator:                 options.Propagator,
+		shutdownTimeout:            options.ShutdownTimeout,
+		done:                       make(chan struct{}),
+		closeMux:                   &sync.Mutex{},
+		inFlight:                   &sync.WaitGroup{},
+		returns:                    make(chan Return),
+		returnsWG:                  &sync.WaitGroup{},
+		queuePriorities:            map[string]int{},
+		queuePrioritiesMux:         &sync.Mutex{},
 	}
 
-	returnAMQPChan := make(chan amqp.Return)
-	returnChan := make(chan Return)
-	returnAMQPChan = publisher.chManager.channel.NotifyReturn(returnAMQPChan)
-	go func() {
-		for ret := range returnAMQPChan {
-			returnChan <- Return{
-				ret,
-			}
+	if options.Confirm {
+		confirms, err := newPublisherConfirms(publisher.chManager.channel, publisher.logger)
+		if err != nil {
+			chManager.close()
+			return nil, nil, err
 		}
+		publisher.confirms = confirms
+	}
+	if options.Transactional {
+		publisher.tx = &publisherTx{mux: &sync.Mutex{}}
+	}
+	publisher.declareExchanges = options.DeclareExchanges
+	publisher.chManager.channelMux.Lock()
+	publisher.chManager.setupChannel = publisher.declareExchangesOn
+	err := publisher.declareExchangesOn(publisher.chManager.channel)
+	publisher.chManager.channelMux.Unlock()
+	if err != nil {
+		chManager.close()
+		return nil, nil, err
+	}
+
+	publisher.returnsWG.Add(1)
+	go publisher.startNotifyReturnHandler(publisher.chManager.channel.NotifyReturn(make(chan amqp.Return)))
+	go func() {
+		<-publisher.done
+		publisher.returnsWG.Wait()
+		close(publisher.returns)
 	}()
 
-	publisher.notifyFlowChan = publisher.chManager.channel.NotifyFlow(publisher.notifyFlowChan)
+	go publisher.startNotifyFlowHandler(publisher.chManager.channel.NotifyFlow(make(chan bool)))
+	go publisher.startNotifyCancelOrCloseHandler()
 
-	go publisher.startNotifyFlowHandler()
+	return publisher, publisher.returns, nil
+}
 
-	return publisher, returnChan, nil
+// Publish publishes the provided data to the given routing keys over the connection
+func (publisher *Publisher) Publish(
+	data []byte,
+	routingKeys []string,
+	optionFuncs ...func(*PublishOptions),
+) error {
+	_, err := publisher.publish(context.Background(), data, routingKeys, false, optionFuncs...)
+	return wrapError(err)
 }
 
-func NewPublisherTLS(url string, config *tls.Config, optionFuncs ...func(*PublisherOptions)) (Publisher, <-chan Return, error) {
-	options := &PublisherOptions{}
+// TryPublish works like Publish but fails right away with ErrNotConnected while the publisher is
+// reconnecting, instead of attempting a write that waits for the new channel. It lets a caller
+// degrade gracefully when the server is down. IsBlocked tells whether the server blocks the
+// connection, in which case publishing waits even though the publisher is connected
+func (publisher *Publisher) TryPublish(
+	data []byte,
+	routingKeys []string,
+	optionFuncs ...func(*PublishOptions),
+) error {
+	if !publisher.IsConnected() {
+		return ErrNotConnected
+	}
+	return publisher.Publish(data, routingKeys, optionFuncs...)
+}
+
+// PublishToQueue publishes the provided data straight to the queue through the default exchange,
+// which routes a message to the queue its routing key names. The exchange and the routes
+// set by the options are ignored
+func (publisher *Publisher) PublishToQueue(
+	data []byte,
+	queue string,
+	optionFuncs ...func(*PublishOptions),
+) error {
+	options := &PublishOptions{}
 	for _, optionFunc := range optionFuncs {
 		optionFunc(options)
 	}
-	if options.Logger == nil {
-		options.Logger = &noLogger{} // default no logging
+	if options.DeclareQueue != nil {
+		queueOptions := *options.DeclareQueue
+		queueOptions.Name = queue
+		_, err := publisher.DeclareQueue(queueOptions)
+		if err != nil {
+			return err
+		}
 	}
+	optionFuncs = append(optionFuncs[:len(optionFuncs):len(optionFuncs)], func(options *PublishOptions) {
+		options.Exchange = ""
+		options.Routes = nil
+	})
+	return publisher.Publish(data, []string{queue}, optionFuncs...)
+}
 
-	chManager, err := newChannelManagerTLS(url, config, options.Logger)
-	if err != nil {
-		return Publisher{}, nil, err
-	}
+// PublishWithContext publishes the provided data to the given routing keys over the connection.
+// If the context is done before a message has been written to the channel ctx.Err() is returned.
+// A write that is already in progress can't be aborted, it will complete in the background
+func (publisher *Publisher) PublishWithContext(
+	ctx context.Context,
+	data []byte,
+	routingKeys []string,
+	optionFuncs ...func(*PublishOptions),
+) error {
+	_, err := publisher.publish(ctx, data, routingKeys, false, optionFuncs...)
+	return wrapError(err)
+}
 
-	publisher := Publisher{
-		chManager:                  chManager,
-		notifyFlowChan:             make(chan bool),
-		disablePublishDueToFlow:    false,
-		disablePublishDueToFlowMux: &sync.RWMutex{},
-		logger:                     options.Logger,
+// PublishWithConfirm publishes the provided data to the given routing keys over the connection
+// and blocks until the server has confirmed every message or the timeout elapses.
+// An error is returned if any of the messages is nacked by the server.
+// The publisher must have been created using WithPublisherOptionsConfirm
+func (publisher *Publisher) PublishWithConfirm(
+	data []byte,
+	routingKeys []string,
+	timeout time.Duration,
+	optionFuncs ...func(*PublishOptions),
+) error {
+	if publisher.confirms == nil {
+		return errors.New("publisher is not in confirm mode, use WithPublisherOptionsConfirm")
+	}
+	confirmChans, err := publisher.publish(context.Background(), data, routingKeys, true, optionFuncs...)
+	if err != nil {
+		return wrapError(err)
 	}
 
-	returnAMQPChan := make(chan amqp.Return)
-	returnChan := make(chan Return)
-	returnAMQPChan = publisher.chManager.channel.NotifyReturn(returnAMQPChan)
-	go func() {
-		for ret := range returnAMQPChan {
-			returnChan <- Return{
-				ret,
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for _, confirmChan := range confirmChans {
+		select {
+		case confirmation := <-confirmChan:
+			if !confirmation.Ack {
+				return fmt.Errorf("message with delivery tag %d was nacked by the server", confirmation.DeliveryTag)
 			}
+		case <-timer.C:
+			return fmt.Errorf("timed out after %s waiting for publisher confirms", timeout)
 		}
-	}()
+	}
+	return nil
+}
 
-	publisher.notifyFlowChan = publisher.chManager.channel.NotifyFlow(publisher.notifyFlowChan)
+// NotifyPublish registers a listener for publisher confirms. Delivery tags start at 1
+// and increase by one for every message sent, meaning a call to Publish with n routing
+// keys and routes consumes n delivery tags. They start over at 1 every time the publisher reconnects.
+// The channel must be drained: it buffers a few confirmations, and once it's full it's closed
+// instead of stalling the connection, so a closed channel means that the next confirmations
+// were missed unless the publisher was closed. Call NotifyPublish again to receive them from then on.
+// If the publisher isn't in confirm mode the returned channel is closed
+func (publisher *Publisher) NotifyPublish() <-chan amqp.Confirmation {
+	confirmChan := make(chan amqp.Confirmation, notifyPublishBuffer)
+	if publisher.confirms == nil {
+		close(confirmChan)
+		return confirmChan
+	}
+	publisher.confirms.listen(confirmChan)
+	return confirmChan
+}
 
-	go publisher.startNotifyFlowHandler()
+// NotifyReturn returns the channel of returns that NewPublisher also returns, the same
+// channel on every call. It's shared with the constructor's one, each return is received once
+func (publisher *Publisher) NotifyReturn() <-chan Return {
+	return publisher.returns
+}
 
-	return publisher, returnChan, nil
+// Channel returns the channel the publisher currently uses. The channel is replaced when
+// reconnecting, so it may be closed by the time it's used and shouldn't be kept around.
+// Closing it or changing its mode interferes with the publisher, WithChannel should be preferred
+func (publisher *Publisher) Channel() *amqp.Channel {
+	publisher.chManager.channelMux.RLock()
+	defer publisher.chManager.channelMux.RUnlock()
+	return publisher.chManager.channel
 }
 
-// Publish publishes the provided data to the given routing keys over the connection
-func (publisher *Publisher) Publish(
+// WithChannel calls fn with the channel the publisher currently uses and returns its error.
+// The channel isn't replaced by a reconnection while fn runs, fn shouldn't keep it around
+func (publisher *Publisher) WithChannel(fn func(*amqp.Channel) error) error {
+	return publisher.chManager.withChannel(fn)
+}
+
+// IsConnected reports whether the publisher currently has an open channel to the server,
+// it's false while reconnecting and after the publisher was stopped
+func (publisher *Publisher) IsConnected() bool {
+	return publisher.chManager.isConnected()
+}
+
+// NotifyBlocked returns a channel that receives a blocking when the server blocks the connection,
+// usually because of a memory or disk alarm, and another one once it's unblocked. Publishings
+// block while the connection is blocked, so they can be paused until then. The current state
+// is sent first if the connection is blocked. If the channel isn't drained only the latest
+// state is kept. It's closed once the publisher is closed
+func (publisher *Publisher) NotifyBlocked() <-chan amqp.Blocking {
+	return publisher.chManager.notifyBlocked()
+}
+
+// IsBlocked reports whether the server is currently blocking the connection
+func (publisher *Publisher) IsBlocked() bool {
+	return publisher.chManager.isBlocked()
+}
+
+// publish sends a message for each routing key. When wait is true and the publisher is
+// in confirm mode, the returned channels will receive the confirmation of each message
+func (publisher *Publisher) publish(
+	ctx context.Context,
 	data []byte,
 	routingKeys []string,
+	wait bool,
 	optionFuncs ...func(*PublishOptions),
-) error {
+) ([]<-chan amqp.Confirmation, error) {
+	publisher.closeMux.Lock()
+	select {
+	case <-publisher.done:
+		publisher.closeMux.Unlock()
+		return nil, errors.New("publisher is closed")
+	default:
+	}
+	publisher.inFlight.Add(1)
+	publisher.closeMux.Unlock()
+	defer publisher.inFlight.Done()
+
 	publisher.disablePublishDueToFlowMux.RLock()
 	if publisher.disablePublishDueToFlow {
-		return fmt.Errorf("publishing blocked due to high flow on the server")
+		publisher.disablePublishDueToFlowMux.RUnlock()
+		return nil, fmt.Errorf("publishing blocked due to high flow on the server")
 	}
 	publisher.disablePublishDueToFlowMux.RUnlock()
 
@@ -234,49 +852,294 @@ func (publisher *Publisher) Publish(
 	if options.DeliveryMode == 0 {
 		options.DeliveryMode = Transient
 	}
+	if options.AutoTimestamp {
+		options.Timestamp = time.Now()
+	}
+	if options.Immediate {
+		return nil, ErrImmediateNotSupported
+	}
+	if options.Delay < 0 || options.Delay.Milliseconds() > math.MaxInt32 {
+		return nil, fmt.Errorf("delay %s doesn't fit in the x-delay header", options.Delay)
+	}
+	if options.Gzip {
+		var err error
+		data, err = gzipBody(data)
+		if err != nil {
+			return nil, fmt.Errorf("can't compress body: %w", err)
+		}
+	}
+
+	headers, err := tableToAMQPTable(options.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid headers: %w", err)
+	}
 
+	routes := make([]Route, 0, len(routingKeys)+len(options.Routes))
 	for _, routingKey := range routingKeys {
+		routes = append(routes, Route{Exchange: options.Exchange, RoutingKey: routingKey})
+	}
+	routes = append(routes, options.Routes...)
+	err = publisher.checkPriority(routes, options.Priority)
+	if err != nil {
+		return nil, err
+	}
+
+	confirmChans := []<-chan amqp.Confirmation{}
+	for _, route := range routes {
 		var message = amqp.Publishing{}
 		message.ContentType = options.ContentType
+		message.ContentEncoding = options.ContentEncoding
 		message.DeliveryMode = options.DeliveryMode
 		message.Body = data
-		message.Headers = tableToAMQPTable(options.Headers)
+		message.Headers = copyTable(Table(headers))
+		if options.Delay > 0 {
+			message.Headers["x-delay"] = int32(options.Delay.Milliseconds())
+		}
+		if options.TraceContext != nil && publisher.propagator != nil {
+			publisher.propagator.Inject(options.TraceContext, HeaderCarrier(message.Headers))
+		}
 		message.Expiration = options.Expiration
+		message.Priority = options.Priority
+		message.ReplyTo = options.ReplyTo
+		message.CorrelationId = options.CorrelationID
+		message.MessageId = options.MessageID
+		message.Type = options.Type
+		message.AppId = options.AppID
+		message.Timestamp = options.Timestamp
+		if options.Properties != nil {
+			options.Properties(&message)
+		}
 
-		// Actual publish.
-		err := publisher.chManager.channel.Publish(
-			options.Exchange,
-			routingKey,
-			options.Mandatory,
-			options.Immediate,
-			message,
-		)
+		confirmChan, err := publisher.publishMessage(ctx, route, message, options, wait)
+		publisher.observer.IncPublished(route.Exchange, route.RoutingKey, err)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if confirmChan != nil {
+			confirmChans = append(confirmChans, confirmChan)
+		}
+	}
+	return confirmChans, nil
+}
+
+// checkPriority returns an error if the priority exceeds the maximum priority of a queue
+// declared by the publisher that one of the routes publishes to through the default exchange
+func (publisher *Publisher) checkPriority(routes []Route, priority uint8) error {
+	if priority == 0 {
+		return nil
+	}
+	publisher.queuePrioritiesMux.Lock()
+	defer publisher.queuePrioritiesMux.Unlock()
+	for _, route := range routes {
+		if route.Exchange != "" {
+			continue
+		}
+		max, ok := publisher.queuePriorities[route.RoutingKey]
+		if ok && int(priority) > max {
+			return fmt.Errorf("priority %d exceeds the maximum priority %d of queue %s", priority, max, route.RoutingKey)
 		}
 	}
 	return nil
 }
 
-// StopPublishing stops the publishing of messages.
+// publishMessage sends the message to the route. If the channel turns out to be closed
+// it waits for the channel manager to reconnect and retries on the new channel
+func (publisher *Publisher) publishMessage(
+	ctx context.Context,
+	route Route,
+	message amqp.Publishing,
+	options *PublishOptions,
+	wait bool,
+) (<-chan amqp.Confirmation, error) {
+	for {
+		publisher.chManager.channelMux.RLock()
+		channel := publisher.chManager.channel
+		publisher.chManager.channelMux.RUnlock()
+		if publisher.tx != nil && publisher.tx.lost(channel) {
+			// the new channel isn't in transaction mode, the message would be routed right away
+			return nil, ErrTxChannelLost
+		}
+
+		// Actual publish.
+		confirmChan, err := publisher.publishWithContext(ctx, func() (<-chan amqp.Confirmation, error) {
+			publishFunc := func() error {
+				return channel.Publish(
+					route.Exchange,
+					route.RoutingKey,
+					options.Mandatory,
+					options.Immediate,
+					message,
+				)
+			}
+			if publisher.confirms == nil {
+				return nil, publishFunc()
+			}
+			return publisher.confirms.publish(channel, publishFunc, wait)
+		})
+		if err != amqp.ErrClosed {
+			return confirmChan, err
+		}
+
+		publisher.logger.Warnf("channel closed while publishing, waiting for reconnection")
+		err = publisher.chManager.waitForReconnect(ctx, channel)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// publishWithContext runs publishFunc and returns its result, or ctx.Err() if the context
+// is done first. The channel lock isn't held while waiting so a stalled write can't block
+// reconnection
+func (publisher *Publisher) publishWithContext(
+	ctx context.Context,
+	publishFunc func() (<-chan amqp.Confirmation, error),
+) (<-chan amqp.Confirmation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		// the context can never be cancelled, no need to wait in a separate goroutine
+		return publishFunc()
+	}
+
+	type publishResult struct {
+		confirmChan <-chan amqp.Confirmation
+		err         error
+	}
+	resultChan := make(chan publishResult, 1)
+	go func() {
+		confirmChan, err := publishFunc()
+		resultChan <- publishResult{confirmChan, err}
+	}()
+	select {
+	case result := <-resultChan:
+		return result.confirmChan, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// StopPublishing stops the publishing of messages, it's the same as Close but ignores the error.
 // The publisher should be discarded as it's not safe for re-use
 func (publisher Publisher) StopPublishing() {
-	publisher.chManager.channel.Close()
-	publisher.chManager.connection.Close()
+	publisher.Close()
+}
+
+// Close stops the publishing of messages. New publishings fail right away, then the ones in
+// progress are given the chance to complete, honouring the shutdown timeout, before the channel
+// and the connection are closed. The channels returned by NewPublisher and NotifyPublish are closed.
+// The publisher should be discarded as it's not safe for re-use
+func (publisher *Publisher) Close() error {
+	publisher.closeMux.Lock()
+	select {
+	case <-publisher.done:
+		publisher.closeMux.Unlock()
+		return nil
+	default:
+		close(publisher.done)
+	}
+	publisher.closeMux.Unlock()
+
+	// publishings waiting for a reconnection give up
+	publisher.chManager.markClosed()
+	publishingsDone := make(chan struct{})
+	go func() {
+		publisher.inFlight.Wait()
+		close(publishingsDone)
+	}()
+	if publisher.shutdownTimeout > 0 {
+		select {
+		case <-publishingsDone:
+		case <-time.After(publisher.shutdownTimeout):
+			publisher.logger.Warnf("publishings didn't finish within %s, closing the connection", publisher.shutdownTimeout)
+		}
+	} else {
+		<-publishingsDone
+	}
+
+	if publisher.confirms != nil {
+		publisher.confirms.close()
+	}
+	return publisher.chManager.close()
 }
 
-func (publisher *Publisher) startNotifyFlowHandler() {
+func (publisher *Publisher) startNotifyFlowHandler(notifyFlowChan <-chan bool) {
 	// Listeners for active=true flow control.  When true is sent to a listener,
 	// publishing should pause until false is sent to listeners.
-	for ok := range publisher.notifyFlowChan {
+	for ok := range notifyFlowChan {
 		publisher.disablePublishDueToFlowMux.Lock()
 		if ok {
-			publisher.logger.Printf("pausing publishing due to flow request from server")
+			publisher.logger.Warnf("pausing publishing due to flow request from server")
 			publisher.disablePublishDueToFlow = true
 		} else {
 			publisher.disablePublishDueToFlow = false
-			publisher.logger.Printf("resuming publishing due to flow request from server")
+			publisher.logger.Infof("resuming publishing due to flow request from server")
 		}
 		publisher.disablePublishDueToFlowMux.Unlock()
 	}
 }
+
+// startNotifyReturnHandler forwards the returns of a channel to the publisher's returns
+// until the channel is closed or the publisher is
+func (publisher *Publisher) startNotifyReturnHandler(notifyReturnChan <-chan amqp.Return) {
+	defer publisher.returnsWG.Done()
+	for ret := range notifyReturnChan {
+		select {
+		case publisher.returns <- Return{ret}:
+		case <-publisher.done:
+			return
+		}
+	}
+}
+
+// declareExchangesOn declares the exchanges of the options on a new channel.
+// The caller must hold the channel lock
+func (publisher *Publisher) declareExchangesOn(channel *amqp.Channel) error {
+	for _, exchange := range publisher.declareExchanges {
+		err := declareExchangeOn(channel, exchange)
+		if err != nil {
+			return fmt.Errorf("couldn't declare exchange %s: %w", exchange.Name, err)
+		}
+	}
+	return nil
+}
+
+// startNotifyCancelOrCloseHandler restores the publisher's notifications on the new
+// channel every time the channel manager reconnects
+func (publisher *Publisher) startNotifyCancelOrCloseHandler() {
+	notifyReconnect, stopNotifyReconnect := publisher.chManager.notifyReconnect()
+	defer stopNotifyReconnect()
+	for {
+		var err error
+		select {
+		case err = <-notifyReconnect:
+		case <-publisher.done:
+			return
+		}
+		publisher.logger.Log(LogLevelInfo, "publish cancel/close handler triggered", map[string]interface{}{
+			"error": err,
+		})
+		// flow control doesn't carry over to the new channel
+		publisher.disablePublishDueToFlowMux.Lock()
+		publisher.disablePublishDueToFlow = false
+		publisher.disablePublishDueToFlowMux.Unlock()
+
+		publisher.closeMux.Lock()
+		select {
+		case <-publisher.done:
+			publisher.closeMux.Unlock()
+			return
+		default:
+		}
+		publisher.returnsWG.Add(1)
+		publisher.closeMux.Unlock()
+
+		publisher.chManager.channelMux.RLock()
+		notifyFlowChan := publisher.chManager.channel.NotifyFlow(make(chan bool))
+		notifyReturnChan := publisher.chManager.channel.NotifyReturn(make(chan amqp.Return))
+		publisher.chManager.channelMux.RUnlock()
+		go publisher.startNotifyFlowHandler(notifyFlowChan)
+		go publisher.startNotifyReturnHandler(notifyReturnChan)
+	}
+}
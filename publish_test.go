@@ -0,0 +1,120 @@
+package rabbitmq
+
+import (
+	"reflect"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/samuelkuklis/go-rabbitmq/rabbitmqtest"
+	"github.com/streadway/amqp"
+)
+
+func TestNewPublisherClosesOnDeclareError(t *testing.T) {
+	broker := rabbitmqtest.NewBroker()
+	defer broker.Close()
+	conn, err := amqp.DialConfig(broker.URL(), broker.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	channel, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = channel.ExchangeDeclare("events", amqp.ExchangeFanout, false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline := runtime.NumGoroutine()
+
+	_, _, err = NewPublisher(broker.URL(), broker.Config(), WithPublisherOptionsDeclareExchange(ExchangeOptions{
+		Name: "events",
+		Kind: amqp.ExchangeTopic,
+	}))
+	if !isPreconditionFailed(err) {
+		t.Fatalf("got error %v, want PRECONDITION_FAILED", err)
+	}
+	ok := waitFor(t, 5*time.Second, func() bool {
+		return runtime.NumGoroutine() <= baseline
+	})
+	if !ok {
+		t.Errorf("got %d goroutines after the publisher failed, want at most %d", runtime.NumGoroutine(), baseline)
+	}
+}
+
+func TestNotifyPublishClosedWhenNotDrained(t *testing.T) {
+	broker := rabbitmqtest.NewBroker()
+	defer broker.Close()
+	publisher, _, err := NewPublisher(broker.URL(), broker.Config(), WithPublisherOptionsConfirm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	_, err = publisher.DeclareQueue(QueueOptions{Name: "confirmed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	confirmations := publisher.NotifyPublish()
+
+	// the listener isn't drained while publishing one more message than it buffers
+	for i := 0; i <= notifyPublishBuffer; i++ {
+		err := publisher.PublishWithConfirm([]byte("message"), []string{"confirmed"}, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := 0
+	for range confirmations {
+		received++
+	}
+	if received != notifyPublishBuffer {
+		t.Errorf("got %d confirmations before the channel was closed, want %d", received, notifyPublishBuffer)
+	}
+}
+
+func TestSharedPublisherGivesUpReconnecting(t *testing.T) {
+	broker := rabbitmqtest.NewBroker()
+	defer broker.Close()
+	conn, err := NewConnection(broker.URL(), broker.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var attempts int32
+	clock := newFakeClock()
+	publisher, _, err := conn.NewPublisher(
+		withPublisherOptionsClock(clock),
+		WithPublisherOptionsReconnectBackoff(10*time.Millisecond, 0, 1),
+		WithPublisherOptionsMaxReconnectAttempts(2),
+		WithPublisherOptionsOnReconnect(func(int) {
+			atomic.AddInt32(&attempts, 1)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	// the connection can't be dialed again once the broker is closed
+	broker.Close()
+	ok := waitFor(t, 5*time.Second, func() bool {
+		return atomic.LoadInt32(&attempts) == 2 && !publisher.IsConnected()
+	})
+	if !ok {
+		t.Fatalf("got %d attempts to reconnect, want 2", atomic.LoadInt32(&attempts))
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := atomic.LoadInt32(&attempts); got != 2 {
+		t.Errorf("got %d attempts to reconnect, want 2", got)
+	}
+	want := []time.Duration{10 * time.Millisecond, 10 * time.Millisecond}
+	if got := clock.Waits(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got waits %v, want %v", got, want)
+	}
+	err = publisher.Publish([]byte("message"), []string{"queue"})
+	if err == nil {
+		t.Error("publishing succeeded after the publisher gave up")
+	}
+}
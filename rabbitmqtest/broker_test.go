@@ -0,0 +1,206 @@
+package rabbitmqtest_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	rabbitmq "github.com/samuelkuklis/go-rabbitmq"
+	"github.com/samuelkuklis/go-rabbitmq/rabbitmqtest"
+	"github.com/streadway/amqp"
+)
+
+// receive returns the next body of the channel or fails the test after a while
+func receive(t *testing.T, bodies <-chan string) string {
+	t.Helper()
+	select {
+	case body := <-bodies:
+		return body
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message was consumed")
+		return ""
+	}
+}
+
+// waitForQueue polls the state of the queue until it's the wanted one or a while elapsed
+func waitForQueue(t *testing.T, broker *rabbitmqtest.Broker, name string, want rabbitmqtest.QueueState) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state, _ := broker.Queue(name)
+		if state == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got queue %s state %+v, want %+v", name, state, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newConsumer(t *testing.T, broker *rabbitmqtest.Broker, optionFuncs ...func(*rabbitmq.ConsumerOptions)) rabbitmq.Consumer {
+	t.Helper()
+	consumer, err := rabbitmq.NewConsumer(broker.URL(), broker.Config(), optionFuncs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(consumer.StopConsuming)
+	return consumer
+}
+
+func newPublisher(t *testing.T, broker *rabbitmqtest.Broker, optionFuncs ...func(*rabbitmq.PublisherOptions)) (*rabbitmq.Publisher, <-chan rabbitmq.Return) {
+	t.Helper()
+	publisher, returns, err := rabbitmq.NewPublisher(broker.URL(), broker.Config(), optionFuncs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		publisher.Close()
+	})
+	return publisher, returns
+}
+
+func TestBrokerRoutesByKey(t *testing.T) {
+	broker := rabbitmqtest.NewBroker()
+	defer broker.Close()
+	consumer := newConsumer(t, broker)
+	bodies := make(chan string, 10)
+	err := consumer.StartConsuming(func(d rabbitmq.Delivery) bool {
+		bodies <- d.RoutingKey + " " + string(d.Body)
+		return true
+	}, "orders", []string{"orders.*"},
+		rabbitmq.WithConsumeOptionsBindingExchangeName("events"),
+		rabbitmq.WithConsumeOptionsBindingExchangeKind(amqp.ExchangeTopic),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher, _ := newPublisher(t, broker)
+
+	for _, key := range []string{"users.created", "orders.created", "orders.eu.created"} {
+		err := publisher.Publish([]byte("event"), []string{key}, rabbitmq.WithPublishOptionsExchange("events"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = publisher.Publish([]byte("last"), []string{"orders.shipped"}, rabbitmq.WithPublishOptionsExchange("events"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the messages are consumed in order, a misrouted one would be received first
+	for _, want := range []string{"orders.created event", "orders.shipped last"} {
+		if got := receive(t, bodies); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	waitForQueue(t, broker, "orders", rabbitmqtest.QueueState{Consumers: 1})
+}
+
+func TestBrokerConfirms(t *testing.T) {
+	broker := rabbitmqtest.NewBroker()
+	defer broker.Close()
+	publisher, _ := newPublisher(t, broker, rabbitmq.WithPublisherOptionsConfirm)
+	_, err := publisher.DeclareQueue(rabbitmq.QueueOptions{Name: "confirmed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"first", "second"} {
+		err := publisher.PublishWithConfirm([]byte(body), []string{"confirmed"}, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := broker.Messages("confirmed")
+	want := [][]byte{[]byte("first"), []byte("second")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got messages %q, want %q", got, want)
+	}
+}
+
+func TestBrokerReturnsUnroutable(t *testing.T) {
+	broker := rabbitmqtest.NewBroker()
+	defer broker.Close()
+	publisher, returns := newPublisher(t, broker)
+
+	err := publisher.Publish([]byte("lost"), []string{"nowhere"}, rabbitmq.WithPublishOptionsMandatory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-returns:
+		if !r.Unroutable() || string(r.Body) != "lost" {
+			t.Errorf("got return %d %s of %q, want an unroutable return of %q", r.ReplyCode, r.ReplyText, r.Body, "lost")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("unroutable message wasn't returned")
+	}
+}
+
+func TestBrokerDeadLetters(t *testing.T) {
+	broker := rabbitmqtest.NewBroker()
+	defer broker.Close()
+	publisher, _ := newPublisher(t, broker, rabbitmq.WithPublisherOptionsDeclareExchange(rabbitmq.ExchangeOptions{
+		Name: "dlx",
+		Kind: amqp.ExchangeFanout,
+	}))
+	_, err := publisher.DeclareQueue(rabbitmq.QueueOptions{Name: "dead"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = publisher.DeclareBinding(rabbitmq.BindingOptions{Queue: "dead", Exchange: "dlx"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer := newConsumer(t, broker)
+	err = consumer.StartConsuming(func(d rabbitmq.Delivery) bool {
+		return string(d.Body) != "poison"
+	}, "work", nil,
+		rabbitmq.WithConsumeOptionsDeadLetterExchange("dlx"),
+		rabbitmq.WithConsumeOptionsConsumerNoRequeue,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"poison", "fine"} {
+		err := publisher.Publish([]byte(body), []string{"work"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForQueue(t, broker, "work", rabbitmqtest.QueueState{Consumers: 1})
+	waitForQueue(t, broker, "dead", rabbitmqtest.QueueState{Ready: 1})
+	got := broker.Messages("dead")
+	if len(got) != 1 || string(got[0]) != "poison" {
+		t.Errorf("got dead letters %q, want the poison message", got)
+	}
+}
+
+func TestBrokerConsumerResumesAfterDrop(t *testing.T) {
+	broker := rabbitmqtest.NewBroker()
+	defer broker.Close()
+	consumer := newConsumer(t, broker, rabbitmq.WithConsumerOptionsReconnectBackoff(10*time.Millisecond, 0, 1))
+	bodies := make(chan string, 10)
+	err := consumer.StartConsuming(func(d rabbitmq.Delivery) bool {
+		bodies <- string(d.Body)
+		return true
+	}, "resumed", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker.DropConnections()
+	// the queue and the message outlive the connections
+	_, err = broker.Publish("", "resumed", amqp.Publishing{Body: []byte("after the drop")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, bodies); got != "after the drop" {
+		t.Errorf("got %q, want %q", got, "after the drop")
+	}
+	if !consumer.IsConnected() {
+		t.Error("consumer isn't connected after resuming")
+	}
+}
@@ -0,0 +1,870 @@
+package rabbitmqtest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// connection is the broker end of a client connection, the frames it reads are handled in order
+// while holding the lock of the broker, the frames it sends are written by another goroutine
+type connection struct {
+	broker   *Broker
+	conn     net.Conn
+	frameMax int
+	channels map[uint16]*channel
+	// closing is set once the broker sent connection.close, only the close-ok is then expected
+	closing bool
+	// released is set once the channels of the connection were released
+	released bool
+
+	// outMux guards the frames waiting to be written and finished
+	outMux  *sync.Mutex
+	outCond *sync.Cond
+	out     []frame
+	// finished is set when the connection is closed after writing the frames already sent
+	finished bool
+}
+
+// channel is the state of a channel of a connection
+type channel struct {
+	id        uint16
+	conn      *connection
+	consumers map[string]*consumer
+	unacked   map[uint64]*delivery
+	nextTag   uint64
+	// prefetch applies to each consumer started after it's set, globalPrefetch to the whole channel
+	prefetch       int
+	globalPrefetch int
+	active         bool
+	// closing is set once the broker sent channel.close, only the close-ok is then expected
+	closing      bool
+	consumerTags int
+	confirm      bool
+	publishSeq   uint64
+	tx           bool
+	txMessages   []*publishing
+	publishing   *publishing
+}
+
+// delivery is a message delivered on a channel and not settled yet,
+// the consumer is nil for a message obtained by basic.get
+type delivery struct {
+	message  *message
+	queue    *queue
+	consumer *consumer
+}
+
+// publishing is a message being published, it's complete once the whole body was received
+type publishing struct {
+	exchange   string
+	routingKey string
+	mandatory  bool
+	properties []byte
+	size       int
+	body       []byte
+	gotHeader  bool
+}
+
+// channelError closes the channel because of an error the client caused
+type channelError struct {
+	code   int
+	text   string
+	class  uint16
+	method uint16
+}
+
+// connectionError closes the connection because of an error the client caused
+type connectionError channelError
+
+func newConnection(broker *Broker, conn net.Conn) *connection {
+	outMux := &sync.Mutex{}
+	return &connection{
+		broker:   broker,
+		conn:     conn,
+		frameMax: frameMax,
+		channels: map[uint16]*channel{},
+		outMux:   outMux,
+		outCond:  sync.NewCond(outMux),
+	}
+}
+
+// serverProperties are sent to the client when it connects
+var serverProperties = amqp.Table{
+	"product": "rabbitmqtest",
+	"capabilities": amqp.Table{
+		"publisher_confirms":         true,
+		"exchange_exchange_bindings": true,
+		"basic.nack":                 true,
+		"consumer_cancel_notify":     true,
+		"connection.blocked":         true,
+		"per_consumer_qos":           true,
+	},
+}
+
+// run reads and handles the frames of the client until the connection is closed
+func (conn *connection) run() {
+	go conn.write()
+	defer func() {
+		conn.broker.mux.Lock()
+		conn.release()
+		conn.broker.mux.Unlock()
+		conn.finish()
+	}()
+
+	r := bufio.NewReader(conn.conn)
+	header := make([]byte, len(protocolHeader))
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(header, protocolHeader) {
+		conn.conn.Write(protocolHeader)
+		return
+	}
+	conn.send(frame{kind: frameMethod, payload: newMethod(10, 10).
+		octet(0).octet(9).table(serverProperties).longstr("PLAIN AMQPLAIN").longstr("en_US").bytes()})
+
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		conn.broker.mux.Lock()
+		done := conn.handle(f)
+		conn.broker.mux.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+// handle handles a frame and returns whether the connection is done
+func (conn *connection) handle(f frame) bool {
+	if conn.released && !conn.closing {
+		return true
+	}
+	if f.kind == frameHeartbeat {
+		return false
+	}
+	if f.kind != frameMethod {
+		ch, ok := conn.channels[f.channel]
+		if !ok || f.channel == 0 {
+			conn.closeWithError(amqp.UnexpectedFrame, "UNEXPECTED_FRAME - content without a method", 0, 0)
+			return false
+		}
+		if !ch.closing {
+			ch.content(f)
+		}
+		return false
+	}
+
+	d := &decoder{buf: f.payload}
+	class, method := d.short(), d.short()
+	if conn.closing {
+		// only connection.close-ok is expected, or a close sent at the same time
+		if f.channel == 0 && class == 10 && method == 50 {
+			conn.send(frame{kind: frameMethod, payload: newMethod(10, 51).bytes()})
+		}
+		return f.channel == 0 && class == 10 && (method == 51 || method == 50)
+	}
+	var err interface{}
+	if f.channel == 0 {
+		var done bool
+		done, err = conn.handleConnection(class, method, d)
+		if done {
+			return true
+		}
+	} else {
+		err = conn.handleChannel(f.channel, class, method, d)
+	}
+	if d.err != nil && err == nil {
+		err = connectionError{amqp.SyntaxError, "SYNTAX_ERROR - malformed method", class, method}
+	}
+	switch err := err.(type) {
+	case channelError:
+		ch, ok := conn.channels[f.channel]
+		if ok {
+			ch.closeWithError(err)
+		}
+	case connectionError:
+		conn.closeWithError(err.code, err.text, err.class, err.method)
+	}
+	return false
+}
+
+func (conn *connection) handleConnection(class, method uint16, d *decoder) (bool, interface{}) {
+	switch {
+	case class == 10 && method == 11: // start-ok
+		conn.send(frame{kind: frameMethod, payload: newMethod(10, 30).short(2047).long(frameMax).short(0).bytes()})
+	case class == 10 && method == 31: // tune-ok
+		d.short()
+		max := int(d.long())
+		if max > 0 && max < conn.frameMax {
+			conn.frameMax = max
+		}
+	case class == 10 && method == 40: // open
+		conn.send(frame{kind: frameMethod, payload: newMethod(10, 41).shortstr("").bytes()})
+		if conn.broker.blocked != "" {
+			conn.send(frame{kind: frameMethod, payload: newMethod(10, 60).shortstr(conn.broker.blocked).bytes()})
+		}
+	case class == 10 && method == 50: // close
+		conn.release()
+		conn.send(frame{kind: frameMethod, payload: newMethod(10, 51).bytes()})
+		return true, nil
+	default:
+		return false, connectionError{amqp.NotImplemented, "NOT_IMPLEMENTED - unexpected method on channel 0", class, method}
+	}
+	return false, nil
+}
+
+func (conn *connection) handleChannel(id uint16, class, method uint16, d *decoder) interface{} {
+	ch, ok := conn.channels[id]
+	if class == 20 && method == 10 { // open
+		if ok {
+			return connectionError{amqp.ChannelError, "CHANNEL_ERROR - second 'channel.open' seen", class, method}
+		}
+		conn.channels[id] = &channel{
+			id:        id,
+			conn:      conn,
+			consumers: map[string]*consumer{},
+			unacked:   map[uint64]*delivery{},
+			active:    true,
+		}
+		conn.send(frame{kind: frameMethod, channel: id, payload: newMethod(20, 11).longstr("").bytes()})
+		return nil
+	}
+	if !ok {
+		return connectionError{amqp.ChannelError, fmt.Sprintf("CHANNEL_ERROR - expected 'channel.open' on channel %d", id), class, method}
+	}
+	if ch.closing {
+		// only channel.close-ok is expected, or a close sent at the same time
+		if class == 20 && (method == 41 || method == 40) {
+			delete(conn.channels, id)
+		}
+		if class == 20 && method == 40 {
+			ch.reply(20, 41)
+		}
+		return nil
+	}
+	return ch.handle(class, method, d)
+}
+
+// send queues frames to be written to the client
+func (conn *connection) send(frames ...frame) {
+	conn.outMux.Lock()
+	defer conn.outMux.Unlock()
+	if conn.finished {
+		return
+	}
+	conn.out = append(conn.out, frames...)
+	conn.outCond.Signal()
+}
+
+// finish closes the connection once the frames already sent were written
+func (conn *connection) finish() {
+	conn.outMux.Lock()
+	defer conn.outMux.Unlock()
+	conn.finished = true
+	conn.outCond.Signal()
+}
+
+// write writes the frames sent to the client until the connection is finished
+func (conn *connection) write() {
+	defer conn.conn.Close()
+	w := bufio.NewWriter(conn.conn)
+	for {
+		conn.outMux.Lock()
+		for len(conn.out) == 0 && !conn.finished {
+			conn.outCond.Wait()
+		}
+		frames, finished := conn.out, conn.finished
+		conn.out = nil
+		conn.outMux.Unlock()
+
+		for _, f := range frames {
+			err := writeFrame(w, f)
+			if err != nil {
+				return
+			}
+		}
+		err := w.Flush()
+		if err != nil {
+			return
+		}
+		if finished && len(frames) == 0 {
+			return
+		}
+	}
+}
+
+// drop closes the connection without notifying the client. The caller must hold the lock of the broker
+func (conn *connection) drop() {
+	conn.release()
+	conn.finish()
+	conn.conn.Close()
+}
+
+// closeWithError releases the connection and sends connection.close to the client
+func (conn *connection) closeWithError(code int, text string, class, method uint16) {
+	if conn.closing {
+		return
+	}
+	conn.release()
+	conn.closing = true
+	conn.send(frame{kind: frameMethod, payload: newMethod(10, 50).
+		short(uint16(code)).shortstr(text).short(class).short(method).bytes()})
+}
+
+// release releases the channels of the connection and deletes its exclusive queues
+func (conn *connection) release() {
+	if conn.released {
+		return
+	}
+	conn.released = true
+	for _, ch := range conn.channels {
+		ch.release()
+	}
+	for _, q := range conn.broker.queues {
+		if q.owner == conn {
+			conn.broker.deleteQueue(q)
+		}
+	}
+	delete(conn.broker.connections, conn)
+}
+
+func (ch *channel) send(f frame) {
+	f.channel = ch.id
+	ch.conn.send(f)
+}
+
+func (ch *channel) reply(class, method uint16) {
+	ch.send(frame{kind: frameMethod, payload: newMethod(class, method).bytes()})
+}
+
+// sendContent sends a method followed by the header and body of the message
+func (ch *channel) sendContent(method []byte, m *message) {
+	frames := []frame{
+		{kind: frameMethod, channel: ch.id, payload: method},
+		{kind: frameHeader, channel: ch.id, payload: contentHeader(len(m.body), m.properties)},
+	}
+	size := ch.conn.frameMax - 8
+	for body := m.body; len(body) > 0; {
+		n := len(body)
+		if n > size {
+			n = size
+		}
+		frames = append(frames, frame{kind: frameBody, channel: ch.id, payload: body[:n]})
+		body = body[n:]
+	}
+	ch.conn.send(frames...)
+}
+
+// deliver sends the message to the consumer
+func (ch *channel) deliver(c *consumer, m *message) {
+	ch.nextTag++
+	if !c.noAck {
+		ch.unacked[ch.nextTag] = &delivery{message: m, queue: c.queue, consumer: c}
+		c.unacked++
+		c.queue.unacked++
+	}
+	ch.sendContent(newMethod(60, 60).shortstr(c.tag).longlong(ch.nextTag).bits(m.redelivered).
+		shortstr(m.exchange).shortstr(m.routingKey).bytes(), m)
+}
+
+// closeWithError releases the channel and sends channel.close to the client
+func (ch *channel) closeWithError(err channelError) {
+	ch.release()
+	ch.closing = true
+	ch.send(frame{kind: frameMethod, payload: newMethod(20, 40).
+		short(uint16(err.code)).shortstr(err.text).short(err.class).short(err.method).bytes()})
+}
+
+// release requeues the unacked messages of the channel and removes its consumers
+func (ch *channel) release() {
+	ch.closing = true
+	queues := ch.requeue(ch.sortedTags())
+	for _, c := range ch.consumers {
+		ch.conn.broker.removeConsumer(c)
+		queues[c.queue] = true
+	}
+	ch.consumers = map[string]*consumer{}
+	for q := range queues {
+		ch.conn.broker.dispatch(q)
+	}
+}
+
+// sortedTags returns the tags of the unacked deliveries in order
+func (ch *channel) sortedTags() []uint64 {
+	tags := make([]uint64, 0, len(ch.unacked))
+	for tag := range ch.unacked {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	return tags
+}
+
+// settle removes the deliveries from the unacked ones, and returns the queues they came from
+func (ch *channel) settle(tags []uint64, settled func(d *delivery)) map[*queue]bool {
+	queues := map[*queue]bool{}
+	for _, tag := range tags {
+		d := ch.unacked[tag]
+		delete(ch.unacked, tag)
+		d.queue.unacked--
+		if d.consumer != nil {
+			d.consumer.unacked--
+		}
+		queues[d.queue] = true
+		settled(d)
+	}
+	return queues
+}
+
+// requeue puts the deliveries back in their queues, in their original order
+func (ch *channel) requeue(tags []uint64) map[*queue]bool {
+	reversed := make([]uint64, 0, len(tags))
+	for i := len(tags) - 1; i >= 0; i-- {
+		reversed = append(reversed, tags[i])
+	}
+	return ch.settle(reversed, func(d *delivery) {
+		ch.conn.broker.requeue(d.queue, d.message)
+	})
+}
+
+// selectTags returns the tags an ack, nack or reject refers to
+func (ch *channel) selectTags(tag uint64, multiple bool, class, method uint16) ([]uint64, interface{}) {
+	if !multiple {
+		_, ok := ch.unacked[tag]
+		if !ok {
+			return nil, channelError{amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag), class, method}
+		}
+		return []uint64{tag}, nil
+	}
+	tags := []uint64{}
+	for _, other := range ch.sortedTags() {
+		if tag == 0 || other <= tag {
+			tags = append(tags, other)
+		}
+	}
+	return tags, nil
+}
+
+// dispatchAll delivers the messages of the queues and of the queues the channel consumes from
+func (ch *channel) dispatchAll(queues map[*queue]bool) {
+	for _, c := range ch.consumers {
+		queues[c.queue] = true
+	}
+	for q := range queues {
+		ch.conn.broker.dispatch(q)
+	}
+}
+
+func notFound(kind, name string, class, method uint16) channelError {
+	return channelError{amqp.NotFound, fmt.Sprintf("NOT_FOUND - no %s '%s' in vhost '/'", kind, name), class, method}
+}
+
+func inequivalent(arg, kind, name string, class, method uint16) channelError {
+	return channelError{amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg '%s' for %s '%s' in vhost '/'", arg, kind, name), class, method}
+}
+
+// handle handles a method of the channel
+func (ch *channel) handle(class, method uint16, d *decoder) interface{} {
+	broker := ch.conn.broker
+	switch {
+	case class == 20 && method == 20: // flow
+		ch.active = d.bit()
+		ch.send(frame{kind: frameMethod, payload: newMethod(20, 21).bits(ch.active).bytes()})
+		ch.dispatchAll(map[*queue]bool{})
+	case class == 20 && method == 21: // flow-ok
+	case class == 20 && method == 40: // close
+		ch.release()
+		delete(ch.conn.channels, ch.id)
+		ch.reply(20, 41)
+
+	case class == 40 && method == 10: // exchange.declare
+		d.short()
+		name, kind := d.shortstr(), d.shortstr()
+		passive, durable, autoDelete, internal, noWait := d.bit(), d.bit(), d.bit(), d.bit(), d.bit()
+		args := d.table()
+		ex, ok := broker.exchanges[name]
+		switch {
+		case passive && !ok:
+			return notFound("exchange", name, class, method)
+		case passive:
+		case ok && ex.kind != kind:
+			return inequivalent("type", "exchange", name, class, method)
+		case ok && ex.durable != durable:
+			return inequivalent("durable", "exchange", name, class, method)
+		case ok:
+		case name == "" || strings.HasPrefix(name, "amq."):
+			return channelError{amqp.AccessRefused, fmt.Sprintf("ACCESS_REFUSED - exchange name '%s' contains reserved prefix 'amq.*'", name), class, method}
+		case kind != amqp.ExchangeDirect && kind != amqp.ExchangeFanout && kind != amqp.ExchangeTopic && kind != amqp.ExchangeHeaders:
+			return connectionError{amqp.CommandInvalid, fmt.Sprintf("COMMAND_INVALID - unknown exchange type '%s'", kind), class, method}
+		default:
+			broker.exchanges[name] = &exchange{name: name, kind: kind, durable: durable, autoDelete: autoDelete, internal: internal, args: args}
+		}
+		if !noWait {
+			ch.reply(40, 11)
+		}
+	case class == 40 && method == 20: // exchange.delete
+		d.short()
+		name := d.shortstr()
+		ifUnused, noWait := d.bit(), d.bit()
+		ex, ok := broker.exchanges[name]
+		if name == "" || strings.HasPrefix(name, "amq.") {
+			return channelError{amqp.AccessRefused, fmt.Sprintf("ACCESS_REFUSED - operation not permitted on exchange '%s'", name), class, method}
+		}
+		if ok && ifUnused && len(ex.bindings) > 0 {
+			return channelError{amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - exchange '%s' in vhost '/' in use", name), class, method}
+		}
+		if ok {
+			broker.deleteExchange(ex)
+		}
+		if !noWait {
+			ch.reply(40, 21)
+		}
+	case class == 40 && (method == 30 || method == 40): // exchange.bind, exchange.unbind
+		d.short()
+		destination, source, routingKey := d.shortstr(), d.shortstr(), d.shortstr()
+		noWait := d.bit()
+		args := d.table()
+		sourceExchange, ok := broker.exchanges[source]
+		if !ok {
+			return notFound("exchange", source, class, method)
+		}
+		_, ok = broker.exchanges[destination]
+		if !ok {
+			return notFound("exchange", destination, class, method)
+		}
+		b := binding{destination: destination, toExchange: true, routingKey: routingKey, args: args}
+		if method == 30 {
+			sourceExchange.bind(b)
+		} else {
+			broker.unbind(sourceExchange, b)
+		}
+		if !noWait && method == 30 {
+			ch.reply(40, 31)
+		} else if !noWait {
+			ch.reply(40, 51)
+		}
+
+	case class == 50 && method == 10: // queue.declare
+		d.short()
+		name := d.shortstr()
+		passive, durable, exclusive, autoDelete, noWait := d.bit(), d.bit(), d.bit(), d.bit(), d.bit()
+		args := d.table()
+		generated := name == "" && !passive
+		if generated {
+			broker.queueNames++
+			name = fmt.Sprintf("amq.gen-%d", broker.queueNames)
+		}
+		q, ok := broker.queues[name]
+		switch {
+		case ok && q.owner != nil && q.owner != ch.conn:
+			return channelError{amqp.ResourceLocked, fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s' in vhost '/'", name), class, method}
+		case passive && !ok:
+			return notFound("queue", name, class, method)
+		case passive:
+		case ok && q.durable != durable:
+			return inequivalent("durable", "queue", name, class, method)
+		case ok && !reflect.DeepEqual(q.args["x-queue-type"], args["x-queue-type"]):
+			return inequivalent("x-queue-type", "queue", name, class, method)
+		case ok:
+		case !generated && strings.HasPrefix(name, "amq."):
+			return channelError{amqp.AccessRefused, fmt.Sprintf("ACCESS_REFUSED - queue name '%s' contains reserved prefix 'amq.*'", name), class, method}
+		default:
+			q = &queue{name: name, durable: durable, exclusive: exclusive, autoDelete: autoDelete, args: args}
+			if exclusive {
+				q.owner = ch.conn
+			}
+			broker.queues[name] = q
+		}
+		if !noWait {
+			ch.send(frame{kind: frameMethod, payload: newMethod(50, 11).
+				shortstr(name).long(uint32(len(q.messages))).long(uint32(len(q.consumers))).bytes()})
+		}
+	case class == 50 && (method == 20 || method == 50): // queue.bind, queue.unbind
+		d.short()
+		name, exchangeName, routingKey := d.shortstr(), d.shortstr(), d.shortstr()
+		noWait := false
+		if method == 20 {
+			noWait = d.bit()
+		}
+		args := d.table()
+		_, ok := broker.queues[name]
+		if !ok {
+			return notFound("queue", name, class, method)
+		}
+		ex, ok := broker.exchanges[exchangeName]
+		if !ok {
+			return notFound("exchange", exchangeName, class, method)
+		}
+		if exchangeName == "" {
+			return channelError{amqp.AccessRefused, "ACCESS_REFUSED - operation not permitted on the default exchange", class, method}
+		}
+		b := binding{destination: name, routingKey: routingKey, args: args}
+		if method == 20 {
+			ex.bind(b)
+			if !noWait {
+				ch.reply(50, 21)
+			}
+		} else {
+			broker.unbind(ex, b)
+			ch.reply(50, 51)
+		}
+	case class == 50 && method == 30: // queue.purge
+		d.short()
+		name := d.shortstr()
+		noWait := d.bit()
+		q, ok := broker.queues[name]
+		if !ok {
+			return notFound("queue", name, class, method)
+		}
+		count := len(q.messages)
+		q.messages = nil
+		if !noWait {
+			ch.send(frame{kind: frameMethod, payload: newMethod(50, 31).long(uint32(count)).bytes()})
+		}
+	case class == 50 && method == 40: // queue.delete
+		d.short()
+		name := d.shortstr()
+		ifUnused, ifEmpty, noWait := d.bit(), d.bit(), d.bit()
+		count := 0
+		q, ok := broker.queues[name]
+		if ok {
+			if ifUnused && len(q.consumers) > 0 {
+				return channelError{amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - queue '%s' in vhost '/' in use", name), class, method}
+			}
+			if ifEmpty && len(q.messages) > 0 {
+				return channelError{amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - queue '%s' in vhost '/' not empty", name), class, method}
+			}
+			count = len(q.messages)
+			broker.deleteQueue(q)
+		}
+		if !noWait {
+			ch.send(frame{kind: frameMethod, payload: newMethod(50, 41).long(uint32(count)).bytes()})
+		}
+
+	case class == 60 && method == 10: // basic.qos
+		d.long()
+		prefetch := int(d.short())
+		if d.bit() {
+			ch.globalPrefetch = prefetch
+		} else {
+			ch.prefetch = prefetch
+		}
+		ch.reply(60, 11)
+		ch.dispatchAll(map[*queue]bool{})
+	case class == 60 && method == 20: // basic.consume
+		d.short()
+		name, tag := d.shortstr(), d.shortstr()
+		d.bit()
+		noAck, exclusive, noWait := d.bit(), d.bit(), d.bit()
+		d.table()
+		q, ok := broker.queues[name]
+		if !ok {
+			return notFound("queue", name, class, method)
+		}
+		if q.owner != nil && q.owner != ch.conn {
+			return channelError{amqp.ResourceLocked, fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s' in vhost '/'", name), class, method}
+		}
+		if tag == "" {
+			ch.consumerTags++
+			tag = fmt.Sprintf("amq.ctag-%d-%d", ch.id, ch.consumerTags)
+		}
+		_, ok = ch.consumers[tag]
+		if ok {
+			return connectionError{amqp.NotAllowed, fmt.Sprintf("NOT_ALLOWED - attempt to reuse consumer tag '%s'", tag), class, method}
+		}
+		for _, other := range q.consumers {
+			if exclusive || other.exclusive {
+				return channelError{amqp.AccessRefused, fmt.Sprintf("ACCESS_REFUSED - queue '%s' in vhost '/' in exclusive use", name), class, method}
+			}
+		}
+		c := &consumer{tag: tag, channel: ch, queue: q, noAck: noAck, exclusive: exclusive, prefetch: ch.prefetch}
+		ch.consumers[tag] = c
+		q.consumers = append(q.consumers, c)
+		q.consumed = true
+		if !noWait {
+			ch.send(frame{kind: frameMethod, payload: newMethod(60, 21).shortstr(tag).bytes()})
+		}
+		broker.dispatch(q)
+	case class == 60 && method == 30: // basic.cancel
+		tag := d.shortstr()
+		noWait := d.bit()
+		c, ok := ch.consumers[tag]
+		if ok {
+			delete(ch.consumers, tag)
+			broker.removeConsumer(c)
+		}
+		if !noWait {
+			ch.send(frame{kind: frameMethod, payload: newMethod(60, 31).shortstr(tag).bytes()})
+		}
+	case class == 60 && method == 40: // basic.publish
+		d.short()
+		exchangeName, routingKey := d.shortstr(), d.shortstr()
+		mandatory := d.bit()
+		_, ok := broker.exchanges[exchangeName]
+		if !ok {
+			return notFound("exchange", exchangeName, class, method)
+		}
+		ch.publishing = &publishing{exchange: exchangeName, routingKey: routingKey, mandatory: mandatory}
+	case class == 60 && method == 70: // basic.get
+		d.short()
+		name := d.shortstr()
+		noAck := d.bit()
+		q, ok := broker.queues[name]
+		if !ok {
+			return notFound("queue", name, class, method)
+		}
+		if len(q.messages) == 0 {
+			ch.send(frame{kind: frameMethod, payload: newMethod(60, 72).shortstr("").bytes()})
+			return nil
+		}
+		m := q.messages[0]
+		q.messages = q.messages[1:]
+		ch.nextTag++
+		if !noAck {
+			ch.unacked[ch.nextTag] = &delivery{message: m, queue: q}
+			q.unacked++
+		}
+		ch.sendContent(newMethod(60, 71).longlong(ch.nextTag).bits(m.redelivered).
+			shortstr(m.exchange).shortstr(m.routingKey).long(uint32(len(q.messages))).bytes(), m)
+	case class == 60 && (method == 80 || method == 90 || method == 120): // basic.ack, basic.reject, basic.nack
+		tag := d.longlong()
+		multiple, requeue := false, false
+		switch method {
+		case 80:
+			multiple = d.bit()
+		case 90:
+			requeue = d.bit()
+		case 120:
+			multiple, requeue = d.bit(), d.bit()
+		}
+		tags, err := ch.selectTags(tag, multiple, class, method)
+		if err != nil {
+			return err
+		}
+		var queues map[*queue]bool
+		switch {
+		case method == 80:
+			queues = ch.settle(tags, func(d *delivery) {})
+		case requeue:
+			queues = ch.requeue(tags)
+		default:
+			queues = ch.settle(tags, func(d *delivery) {
+				broker.deadLetter(d.queue, d.message)
+			})
+		}
+		ch.dispatchAll(queues)
+	case class == 60 && (method == 100 || method == 110): // basic.recover-async, basic.recover
+		d.bit()
+		queues := ch.requeue(ch.sortedTags())
+		if method == 110 {
+			ch.reply(60, 111)
+		}
+		ch.dispatchAll(queues)
+
+	case class == 85 && method == 10: // confirm.select
+		noWait := d.bit()
+		if ch.tx {
+			return channelError{amqp.PreconditionFailed, "PRECONDITION_FAILED - cannot switch from tx to confirm mode", class, method}
+		}
+		ch.confirm = true
+		if !noWait {
+			ch.reply(85, 11)
+		}
+
+	case class == 90 && method == 10: // tx.select
+		if ch.confirm {
+			return channelError{amqp.PreconditionFailed, "PRECONDITION_FAILED - cannot switch from confirm to tx mode", class, method}
+		}
+		ch.tx = true
+		ch.reply(90, 11)
+	case class == 90 && (method == 20 || method == 30): // tx.commit, tx.rollback
+		if !ch.tx {
+			return channelError{amqp.PreconditionFailed, "PRECONDITION_FAILED - channel is not transactional", class, method}
+		}
+		messages := ch.txMessages
+		ch.txMessages = nil
+		if method == 20 {
+			for _, p := range messages {
+				err := ch.route(p)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		ch.reply(90, method+1)
+
+	default:
+		return connectionError{amqp.NotImplemented, "NOT_IMPLEMENTED - unsupported method", class, method}
+	}
+	return nil
+}
+
+// content handles a header or body frame of the message being published
+func (ch *channel) content(f frame) {
+	p := ch.publishing
+	if p == nil {
+		ch.conn.closeWithError(amqp.UnexpectedFrame, "UNEXPECTED_FRAME - content without basic.publish", 0, 0)
+		return
+	}
+	if f.kind == frameHeader {
+		d := &decoder{buf: f.payload}
+		d.short()
+		d.short()
+		p.size = int(d.longlong())
+		p.properties = d.buf
+		p.gotHeader = true
+	} else {
+		p.body = append(p.body, f.payload...)
+	}
+	if !p.gotHeader || len(p.body) < p.size {
+		return
+	}
+	ch.publishing = nil
+	if ch.tx {
+		ch.txMessages = append(ch.txMessages, p)
+		return
+	}
+	err := ch.route(p)
+	if err != nil {
+		ch.closeWithError(err.(channelError))
+	}
+}
+
+// route routes a published message, returns it if it's mandatory and unroutable and confirms it
+func (ch *channel) route(p *publishing) interface{} {
+	broker := ch.conn.broker
+	ex, ok := broker.exchanges[p.exchange]
+	if !ok {
+		return notFound("exchange", p.exchange, 60, 40)
+	}
+	m := &message{
+		exchange:   p.exchange,
+		routingKey: p.routingKey,
+		properties: p.properties,
+		headers:    propertyHeaders(p.properties),
+		body:       p.body,
+	}
+	queues := broker.route(ex, m)
+	if len(queues) == 0 && p.mandatory {
+		ch.sendContent(newMethod(60, 50).short(amqp.NoRoute).shortstr("NO_ROUTE").
+			shortstr(p.exchange).shortstr(p.routingKey).bytes(), m)
+	}
+	broker.enqueue(queues, m)
+	if ch.confirm {
+		ch.publishSeq++
+		ch.send(frame{kind: frameMethod, payload: newMethod(60, 80).longlong(ch.publishSeq).bits(false).bytes()})
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package rabbitmqtest
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+type exchange struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	internal   bool
+	args       amqp.Table
+	bindings   []binding
+}
+
+// binding routes the messages of an exchange to a queue, or to another exchange
+type binding struct {
+	destination string
+	toExchange  bool
+	routingKey  string
+	args        amqp.Table
+}
+
+type queue struct {
+	name       string
+	durable    bool
+	exclusive  bool
+	autoDelete bool
+	// owner is the connection that declared an exclusive queue
+	owner    *connection
+	args     amqp.Table
+	messages []*message
+	// unacked is how many messages of the queue were delivered and not settled yet
+	unacked   int
+	consumers []*consumer
+	// next is the index of the consumer the next message is delivered to, round-robin
+	next int
+	// consumed is set once the queue had a consumer, an auto-delete queue is only deleted after
+	consumed bool
+}
+
+type message struct {
+	exchange    string
+	routingKey  string
+	properties  []byte
+	headers     amqp.Table
+	body        []byte
+	redelivered bool
+}
+
+type consumer struct {
+	tag       string
+	channel   *channel
+	queue     *queue
+	noAck     bool
+	exclusive bool
+	prefetch  int
+	unacked   int
+}
+
+// route returns the queues a message published to the exchange is routed to
+func (broker *Broker) route(ex *exchange, m *message) []*queue {
+	if ex.name == "" {
+		q, ok := broker.queues[m.routingKey]
+		if !ok {
+			return nil
+		}
+		return []*queue{q}
+	}
+	queues := []*queue{}
+	routed := map[*queue]bool{}
+	visited := map[*exchange]bool{}
+	broker.routeExchange(ex, m, visited, func(q *queue) {
+		if !routed[q] {
+			routed[q] = true
+			queues = append(queues, q)
+		}
+	})
+	return queues
+}
+
+func (broker *Broker) routeExchange(ex *exchange, m *message, visited map[*exchange]bool, routeTo func(q *queue)) {
+	if visited[ex] {
+		return
+	}
+	visited[ex] = true
+	for _, b := range ex.bindings {
+		if !matches(ex.kind, b, m) {
+			continue
+		}
+		if b.toExchange {
+			destination, ok := broker.exchanges[b.destination]
+			if ok {
+				broker.routeExchange(destination, m, visited, routeTo)
+			}
+			continue
+		}
+		q, ok := broker.queues[b.destination]
+		if ok {
+			routeTo(q)
+		}
+	}
+}
+
+// matches returns whether a message matches a binding of an exchange of the given kind
+func matches(kind string, b binding, m *message) bool {
+	switch kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return matchTopic(strings.Split(b.routingKey, "."), strings.Split(m.routingKey, "."))
+	case amqp.ExchangeHeaders:
+		return matchHeaders(b.args, m.headers)
+	}
+	return b.routingKey == m.routingKey
+}
+
+// matchTopic matches the words of a routing key against the words of a pattern,
+// where * matches exactly one word and # zero or more words
+func matchTopic(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchTopic(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchTopic(pattern[1:], words[1:])
+	}
+	return len(words) > 0 && pattern[0] == words[0] && matchTopic(pattern[1:], words[1:])
+}
+
+// matchHeaders matches the headers of a message against the arguments of a binding,
+// all of them must match unless x-match is any. Arguments starting with x- aren't matched
+func matchHeaders(args, headers amqp.Table) bool {
+	any := args["x-match"] == "any"
+	for key, value := range args {
+		if strings.HasPrefix(key, "x-") {
+			continue
+		}
+		header, ok := headers[key]
+		matched := ok && reflect.DeepEqual(header, value)
+		if any && matched {
+			return true
+		}
+		if !any && !matched {
+			return false
+		}
+	}
+	return !any
+}
+
+// enqueue adds a copy of the message to each queue and delivers it if a consumer is free
+func (broker *Broker) enqueue(queues []*queue, m *message) {
+	for _, q := range queues {
+		copied := *m
+		q.messages = append(q.messages, &copied)
+		broker.dispatch(q)
+	}
+}
+
+// requeue puts a message back at the head of its queue, marked as redelivered
+func (broker *Broker) requeue(q *queue, m *message) {
+	if broker.queues[q.name] != q {
+		// the queue was deleted
+		return
+	}
+	m.redelivered = true
+	q.messages = append([]*message{m}, q.messages...)
+}
+
+// deadLetter routes a rejected message to the dead letter exchange of its queue, if it has one
+func (broker *Broker) deadLetter(q *queue, m *message) {
+	name, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	ex, ok := broker.exchanges[name]
+	if !ok {
+		return
+	}
+	dead := *m
+	dead.redelivered = false
+	routingKey, ok := q.args["x-dead-letter-routing-key"].(string)
+	if ok {
+		dead.routingKey = routingKey
+	}
+	broker.enqueue(broker.route(ex, &dead), &dead)
+}
+
+// dispatch delivers the messages of the queue to its consumers while some has room for them
+func (broker *Broker) dispatch(q *queue) {
+	for len(q.messages) > 0 {
+		c := q.nextConsumer()
+		if c == nil {
+			return
+		}
+		m := q.messages[0]
+		q.messages = q.messages[1:]
+		c.channel.deliver(c, m)
+	}
+}
+
+// nextConsumer returns the next consumer in turn that can take a message, or nil
+func (q *queue) nextConsumer() *consumer {
+	for i := 0; i < len(q.consumers); i++ {
+		c := q.consumers[(q.next+i)%len(q.consumers)]
+		if c.canTake() {
+			q.next = (q.next + i + 1) % len(q.consumers)
+			return c
+		}
+	}
+	return nil
+}
+
+func (c *consumer) canTake() bool {
+	if c.channel.closing || !c.channel.active {
+		return false
+	}
+	if c.noAck {
+		return true
+	}
+	if c.prefetch > 0 && c.unacked >= c.prefetch {
+		return false
+	}
+	return c.channel.globalPrefetch == 0 || len(c.channel.unacked) < c.channel.globalPrefetch
+}
+
+// removeConsumer removes the consumer from its queue, and deletes an auto-delete queue left without consumers
+func (broker *Broker) removeConsumer(c *consumer) {
+	q := c.queue
+	for i, other := range q.consumers {
+		if other == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	if q.next >= len(q.consumers) {
+		q.next = 0
+	}
+	if q.autoDelete && q.consumed && len(q.consumers) == 0 {
+		broker.deleteQueue(q)
+	}
+}
+
+// deleteQueue deletes the queue and its bindings, and cancels its consumers
+func (broker *Broker) deleteQueue(q *queue) {
+	if broker.queues[q.name] != q {
+		return
+	}
+	delete(broker.queues, q.name)
+	for _, ex := range broker.exchanges {
+		ex.removeBindings(q.name, false)
+	}
+	consumers := q.consumers
+	q.consumers = nil
+	for _, c := range consumers {
+		delete(c.channel.consumers, c.tag)
+		c.channel.send(frame{kind: frameMethod, payload: newMethod(60, 30).shortstr(c.tag).bits(false).bytes()})
+	}
+}
+
+// deleteExchange deletes the exchange and the bindings to it
+func (broker *Broker) deleteExchange(ex *exchange) {
+	delete(broker.exchanges, ex.name)
+	for _, other := range broker.exchanges {
+		other.removeBindings(ex.name, true)
+	}
+}
+
+// removeBindings removes the bindings to the destination
+func (ex *exchange) removeBindings(destination string, toExchange bool) {
+	bindings := ex.bindings[:0]
+	for _, b := range ex.bindings {
+		if b.destination != destination || b.toExchange != toExchange {
+			bindings = append(bindings, b)
+		}
+	}
+	ex.bindings = bindings
+}
+
+// bind adds a binding unless the same one exists
+func (ex *exchange) bind(b binding) {
+	for _, other := range ex.bindings {
+		if sameBinding(b, other) {
+			return
+		}
+	}
+	ex.bindings = append(ex.bindings, b)
+}
+
+// unbind removes a binding, and deletes an auto-delete exchange left without bindings
+func (broker *Broker) unbind(ex *exchange, b binding) {
+	for i, other := range ex.bindings {
+		if sameBinding(b, other) {
+			ex.bindings = append(ex.bindings[:i], ex.bindings[i+1:]...)
+			break
+		}
+	}
+	if ex.autoDelete && len(ex.bindings) == 0 {
+		broker.deleteExchange(ex)
+	}
+}
+
+func sameBinding(a, b binding) bool {
+	return a.destination == b.destination && a.toExchange == b.toExchange &&
+		a.routingKey == b.routingKey && reflect.DeepEqual(a.args, b.args)
+}
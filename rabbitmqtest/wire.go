@@ -0,0 +1,394 @@
+package rabbitmqtest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	frameMethod    = 1
+	frameHeader    = 2
+	frameBody      = 3
+	frameHeartbeat = 8
+	frameEnd       = 206
+
+	// frameMax is the largest frame the broker accepts, bodies are split to fit it
+	frameMax = 131072
+)
+
+var errMalformed = errors.New("malformed frame")
+
+var protocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+// frame is a frame as it's read from or written to the wire
+type frame struct {
+	kind    byte
+	channel uint16
+	payload []byte
+}
+
+func readFrame(r *bufio.Reader) (frame, error) {
+	var header [7]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return frame{}, err
+	}
+	f := frame{
+		kind:    header[0],
+		channel: binary.BigEndian.Uint16(header[1:3]),
+		payload: make([]byte, binary.BigEndian.Uint32(header[3:7])),
+	}
+	_, err = io.ReadFull(r, f.payload)
+	if err != nil {
+		return frame{}, err
+	}
+	end, err := r.ReadByte()
+	if err != nil {
+		return frame{}, err
+	}
+	if end != frameEnd {
+		return frame{}, errMalformed
+	}
+	return f, nil
+}
+
+func writeFrame(w io.Writer, f frame) error {
+	buf := make([]byte, 7, 8+len(f.payload))
+	buf[0] = f.kind
+	binary.BigEndian.PutUint16(buf[1:3], f.channel)
+	binary.BigEndian.PutUint32(buf[3:7], uint32(len(f.payload)))
+	buf = append(buf, f.payload...)
+	buf = append(buf, frameEnd)
+	_, err := w.Write(buf)
+	return err
+}
+
+// decoder reads the fields of a method, the first error makes every following read return zero values
+type decoder struct {
+	buf  []byte
+	bits byte
+	// nbits is how many bits of the current octet were read, consecutive bits share an octet
+	nbits int
+	err   error
+}
+
+func (d *decoder) next(n int) []byte {
+	d.nbits = 0
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	if len(d.buf) < n {
+		d.err = errMalformed
+		return make([]byte, n)
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) octet() byte {
+	return d.next(1)[0]
+}
+
+func (d *decoder) short() uint16 {
+	return binary.BigEndian.Uint16(d.next(2))
+}
+
+func (d *decoder) long() uint32 {
+	return binary.BigEndian.Uint32(d.next(4))
+}
+
+func (d *decoder) longlong() uint64 {
+	return binary.BigEndian.Uint64(d.next(8))
+}
+
+func (d *decoder) bit() bool {
+	if d.nbits == 0 || d.nbits == 8 {
+		d.bits = d.octet()
+	}
+	bit := d.bits&(1<<d.nbits) != 0
+	d.nbits++
+	return bit
+}
+
+func (d *decoder) shortstr() string {
+	return string(d.next(int(d.octet())))
+}
+
+func (d *decoder) longstr() string {
+	return string(d.next(int(d.long())))
+}
+
+func (d *decoder) table() amqp.Table {
+	nested := &decoder{buf: d.next(int(d.long())), err: d.err}
+	table := amqp.Table{}
+	for nested.err == nil && len(nested.buf) > 0 {
+		key := nested.shortstr()
+		table[key] = nested.field()
+	}
+	if nested.err != nil {
+		d.err = nested.err
+	}
+	return table
+}
+
+func (d *decoder) array() []interface{} {
+	nested := &decoder{buf: d.next(int(d.long())), err: d.err}
+	array := []interface{}{}
+	for nested.err == nil && len(nested.buf) > 0 {
+		array = append(array, nested.field())
+	}
+	if nested.err != nil {
+		d.err = nested.err
+	}
+	return array
+}
+
+// field reads a value of a table with the same types as the amqp package
+func (d *decoder) field() interface{} {
+	switch d.octet() {
+	case 't':
+		return d.octet() != 0
+	case 'b':
+		return d.octet()
+	case 's':
+		return int16(d.short())
+	case 'I':
+		return int32(d.long())
+	case 'l':
+		return int64(d.longlong())
+	case 'f':
+		return math.Float32frombits(d.long())
+	case 'd':
+		return math.Float64frombits(d.longlong())
+	case 'D':
+		scale := d.octet()
+		return amqp.Decimal{Scale: scale, Value: int32(d.long())}
+	case 'S':
+		return d.longstr()
+	case 'x':
+		return []byte(d.longstr())
+	case 'A':
+		return d.array()
+	case 'T':
+		return time.Unix(int64(d.longlong()), 0)
+	case 'F':
+		return d.table()
+	case 'V':
+		return nil
+	}
+	if d.err == nil {
+		d.err = errMalformed
+	}
+	return nil
+}
+
+// encoder writes the fields of a method
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func newMethod(class, method uint16) *encoder {
+	e := &encoder{}
+	e.short(class)
+	e.short(method)
+	return e
+}
+
+func (e *encoder) octet(b byte) *encoder {
+	e.buf.WriteByte(b)
+	return e
+}
+
+func (e *encoder) short(s uint16) *encoder {
+	binary.Write(&e.buf, binary.BigEndian, s)
+	return e
+}
+
+func (e *encoder) long(l uint32) *encoder {
+	binary.Write(&e.buf, binary.BigEndian, l)
+	return e
+}
+
+func (e *encoder) longlong(l uint64) *encoder {
+	binary.Write(&e.buf, binary.BigEndian, l)
+	return e
+}
+
+// bits writes consecutive bits into a single octet, the first one is the lowest
+func (e *encoder) bits(bits ...bool) *encoder {
+	var octet byte
+	for i, bit := range bits {
+		if bit {
+			octet |= 1 << i
+		}
+	}
+	return e.octet(octet)
+}
+
+func (e *encoder) shortstr(s string) *encoder {
+	e.octet(byte(len(s)))
+	e.buf.WriteString(s)
+	return e
+}
+
+func (e *encoder) longstr(s string) *encoder {
+	e.long(uint32(len(s)))
+	e.buf.WriteString(s)
+	return e
+}
+
+// table writes a table with the same types as the amqp package
+func (e *encoder) table(table amqp.Table) *encoder {
+	nested := &encoder{}
+	for key, value := range table {
+		nested.shortstr(key).field(value)
+	}
+	e.long(uint32(nested.buf.Len()))
+	e.buf.Write(nested.buf.Bytes())
+	return e
+}
+
+func (e *encoder) field(value interface{}) *encoder {
+	switch value := value.(type) {
+	case bool:
+		if value {
+			return e.octet('t').octet(1)
+		}
+		return e.octet('t').octet(0)
+	case byte:
+		return e.octet('b').octet(value)
+	case int16:
+		return e.octet('s').short(uint16(value))
+	case int:
+		return e.octet('I').long(uint32(value))
+	case int32:
+		return e.octet('I').long(uint32(value))
+	case int64:
+		return e.octet('l').longlong(uint64(value))
+	case float32:
+		return e.octet('f').long(math.Float32bits(value))
+	case float64:
+		return e.octet('d').longlong(math.Float64bits(value))
+	case amqp.Decimal:
+		return e.octet('D').octet(value.Scale).long(uint32(value.Value))
+	case string:
+		return e.octet('S').longstr(value)
+	case []byte:
+		return e.octet('x').longstr(string(value))
+	case []interface{}:
+		nested := &encoder{}
+		for _, element := range value {
+			nested.field(element)
+		}
+		e.octet('A').long(uint32(nested.buf.Len()))
+		e.buf.Write(nested.buf.Bytes())
+		return e
+	case time.Time:
+		return e.octet('T').longlong(uint64(value.Unix()))
+	case amqp.Table:
+		return e.octet('F').table(value)
+	}
+	return e.octet('V')
+}
+
+func (e *encoder) bytes() []byte {
+	return e.buf.Bytes()
+}
+
+// contentHeader returns the payload of the header frame of a message
+func contentHeader(bodySize int, properties []byte) []byte {
+	e := &encoder{}
+	e.short(60).short(0).longlong(uint64(bodySize))
+	e.buf.Write(properties)
+	return e.bytes()
+}
+
+// propertyHeaders reads the headers out of the encoded properties of a message,
+// the properties before them in the property list are the content type and encoding
+func propertyHeaders(properties []byte) amqp.Table {
+	d := &decoder{buf: properties}
+	flags := d.short()
+	if flags&0x8000 != 0 {
+		d.shortstr()
+	}
+	if flags&0x4000 != 0 {
+		d.shortstr()
+	}
+	if flags&0x2000 == 0 {
+		return amqp.Table{}
+	}
+	headers := d.table()
+	if d.err != nil {
+		return amqp.Table{}
+	}
+	return headers
+}
+
+// encodeProperties returns the property flags and list of a message as a client would send them
+func encodeProperties(msg amqp.Publishing) []byte {
+	var flags uint16
+	list := &encoder{}
+	if msg.ContentType != "" {
+		flags |= 0x8000
+		list.shortstr(msg.ContentType)
+	}
+	if msg.ContentEncoding != "" {
+		flags |= 0x4000
+		list.shortstr(msg.ContentEncoding)
+	}
+	if len(msg.Headers) > 0 {
+		flags |= 0x2000
+		list.table(msg.Headers)
+	}
+	if msg.DeliveryMode > 0 {
+		flags |= 0x1000
+		list.octet(msg.DeliveryMode)
+	}
+	if msg.Priority > 0 {
+		flags |= 0x0800
+		list.octet(msg.Priority)
+	}
+	for _, property := range []struct {
+		flag  uint16
+		value string
+	}{
+		{0x0400, msg.CorrelationId},
+		{0x0200, msg.ReplyTo},
+		{0x0100, msg.Expiration},
+		{0x0080, msg.MessageId},
+	} {
+		if property.value != "" {
+			flags |= property.flag
+			list.shortstr(property.value)
+		}
+	}
+	if !msg.Timestamp.IsZero() {
+		flags |= 0x0040
+		list.longlong(uint64(msg.Timestamp.Unix()))
+	}
+	for _, property := range []struct {
+		flag  uint16
+		value string
+	}{
+		{0x0020, msg.Type},
+		{0x0010, msg.UserId},
+		{0x0008, msg.AppId},
+	} {
+		if property.value != "" {
+			flags |= property.flag
+			list.shortstr(property.value)
+		}
+	}
+	e := &encoder{}
+	e.short(flags)
+	e.buf.Write(list.bytes())
+	return e.bytes()
+}
@@ -0,0 +1,222 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// retryCountHeader counts how many times a delivery has been retried
+const retryCountHeader = "x-retry-count"
+
+// RetryOptions describe how deliveries the handler fails to process are retried.
+// MaxAttempts is the number of times a delivery is handled before it's given up on, in which case
+// it's nacked without being requeued so it's dead-lettered if the queue has a dead letter exchange.
+// Backoff returns how long to wait before the given retry, starting at 1.
+// DelayedExchange is the name of a delayed message exchange retries are published to,
+// when empty they are held in a retry queue instead
+type RetryOptions struct {
+	MaxAttempts     int
+	Backoff         func(attempt int) time.Duration
+	DelayedExchange string
+}
+
+// WithConsumeOptionsRetry returns a function that makes the consumer retry deliveries
+// the handler returns false for, instead of requeueing them right away. The delivery is
+// acked and a copy is published with an incremented x-retry-count header once the backoff
+// has elapsed, until it has been handled maxAttempts times.
+//
+// By default the copy waits in a queue named after the consumed queue with a ".retry" suffix,
+// which is declared with the consumed queue as dead letter destination and relies on per-message TTL.
+// Messages only expire at the head of a queue, so a retry waits for the ones ahead of it
+// even if their backoff is longer. WithConsumeOptionsRetryDelayedExchange avoids that.
+// A nil backoff doubles the delay on every retry, starting at 1 second
+func WithConsumeOptionsRetry(maxAttempts int, backoff func(attempt int) time.Duration) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		getRetryOptionsOrSetDefault(options).MaxAttempts = maxAttempts
+		options.Retry.Backoff = backoff
+	}
+}
+
+// WithConsumeOptionsRetryDelayedExchange returns a function that makes retries be published to
+// the given delayed message exchange with an x-delay header, which requires the
+// rabbitmq_delayed_message_exchange plugin. The queue must be bound to the exchange
+// with its own name as routing key, since retries are published with it
+func WithConsumeOptionsRetryDelayedExchange(exchange string) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		getRetryOptionsOrSetDefault(options).DelayedExchange = exchange
+	}
+}
+
+// getRetryOptionsOrSetDefault returns pointer to current Retry options. if no Retry options are set yet, it will set it with default values.
+func getRetryOptionsOrSetDefault(options *ConsumeOptions) *RetryOptions {
+	if options.Retry == nil {
+		options.Retry = &RetryOptions{
+			MaxAttempts:     1,
+			Backoff:         nil,
+			DelayedExchange: "",
+		}
+	}
+	return options.Retry
+}
+
+// retryQueueName returns the name of the queue retries of deliveries from the given queue wait in
+func retryQueueName(queue string) string {
+	return queue + ".retry"
+}
+
+// declareRetryQueue declares the queue retries wait in before being dead-lettered back
+// to the consumed queue. The caller must hold the channel lock
+func (consumer Consumer) declareRetryQueue(queue string, consumeOptions ConsumeOptions) error {
+	if queue == "" {
+		return errors.New("retrying deliveries but queue name not specified")
+	}
+	_, err := consumer.chManager.channel.QueueDeclare(
+		retryQueueName(queue),
+		consumeOptions.QueueDurable,
+		false,
+		false,
+		false,
+		amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue,
+		},
+	)
+	return err
+}
+
+// retry acks the delivery and publishes a copy of it to be handled again after the backoff,
+// or nacks it without requeueing once it has been handled MaxAttempts times
+func (consumer Consumer) retry(queue string, d Delivery, retryOptions RetryOptions) error {
+	attempt := retryCount(d.Headers) + 1
+	if attempt >= retryOptions.MaxAttempts {
+		consumer.logger.Log(LogLevelWarn, "giving up on message", map[string]interface{}{
+			"queue":        queue,
+			"consumer_tag": d.ConsumerTag,
+			"attempt":      attempt,
+		})
+		return d.Nack(false)
+	}
+
+	var delay time.Duration
+	if retryOptions.Backoff != nil {
+		delay = retryOptions.Backoff(attempt)
+	} else {
+		delay = getDefaultBackoffOptions().duration(attempt)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+
+	headers := copyTable(Table(d.Headers))
+	headers[retryCountHeader] = int32(attempt)
+	message := amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+	exchange := ""
+	routingKey := retryQueueName(queue)
+	if retryOptions.DelayedExchange != "" {
+		exchange = retryOptions.DelayedExchange
+		routingKey = queue
+		headers["x-delay"] = int32(delay.Milliseconds())
+	} else {
+		message.Expiration = strconv.FormatInt(delay.Milliseconds(), 10)
+	}
+
+	consumer.chManager.channelMux.RLock()
+	err := consumer.chManager.channel.Publish(exchange, routingKey, false, false, message)
+	consumer.chManager.channelMux.RUnlock()
+	if err != nil {
+		nackErr := d.Nack(true)
+		if nackErr != nil {
+			return nackErr
+		}
+		return fmt.Errorf("can't publish retry, message requeued: %w", err)
+	}
+	return d.Ack()
+}
+
+// retryCount returns how many times the delivery with the given headers has been retried
+func retryCount(headers amqp.Table) int {
+	return headerInt(headers[retryCountHeader])
+}
+
+// RetryCount returns how many times the message has been delivered before, as far as the
+// headers tell. It's the largest of the x-retry-count header set by WithConsumeOptionsRetry,
+// the x-delivery-count header of quorum queues and the counts of the x-death header,
+// which the server adds every time the message is dead-lettered.
+// Messages requeued by a nack on a classic queue aren't counted, Redelivered is set instead
+func (d Delivery) RetryCount() int {
+	count := retryCount(d.Headers)
+	deliveryCount := headerInt(d.Headers["x-delivery-count"])
+	if deliveryCount > count {
+		count = deliveryCount
+	}
+	deaths, _ := d.Headers["x-death"].([]interface{})
+	for _, death := range deaths {
+		table, ok := death.(amqp.Table)
+		if !ok {
+			continue
+		}
+		deathCount := headerInt(table["count"])
+		if deathCount > count {
+			count = deathCount
+		}
+	}
+	return count
+}
+
+// IsPoison reports whether the message has been delivered at least max times before,
+// according to RetryCount
+func (d Delivery) IsPoison(max int) bool {
+	return d.RetryCount() >= max
+}
+
+// DeathCount returns how many times the message was dead-lettered from the queue, according to the
+// x-death header the server adds, whatever the reason. With an empty queue the deaths from every queue
+// are counted, so a message going back and forth between a queue and a delay queue counts twice a round
+func (d Delivery) DeathCount(queue string) int {
+	count := 0
+	deaths, _ := d.Headers["x-death"].([]interface{})
+	for _, death := range deaths {
+		table, ok := death.(amqp.Table)
+		if !ok {
+			continue
+		}
+		if queue == "" || table["queue"] == queue {
+			count += headerInt(table["count"])
+		}
+	}
+	return count
+}
+
+// headerInt returns the integer value of a header, or 0 if it isn't an integer
+func headerInt(value interface{}) int {
+	switch value := value.(type) {
+	case int:
+		return value
+	case int16:
+		return int(value)
+	case int32:
+		return int(value)
+	case int64:
+		return int(value)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,186 @@
+package rabbitmq
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+// RPCClient publishes requests and waits for the matching responses,
+// which are received on a reply queue exclusive to the client
+type RPCClient struct {
+	publisher *Publisher
+	consumer  Consumer
+
+	replyQueue     string
+	consumeOptions ConsumeOptions
+	cancel         context.CancelFunc
+	reconnectDone  <-chan struct{}
+
+	// pending maps the correlation id of every request awaiting
+	// a response to the channel the response is sent on
+	pending    map[string]chan Delivery
+	pendingMux *sync.Mutex
+}
+
+// NewRPCClient returns a client publishing requests with the publisher and receiving
+// the responses with the consumer, which shouldn't be used for anything else.
+// The reply queue is declared exclusive, so it's deleted when the consumer disconnects
+func NewRPCClient(publisher *Publisher, consumer Consumer) (*RPCClient, error) {
+	client := &RPCClient{
+		publisher:  publisher,
+		consumer:   consumer,
+		replyQueue: "rpc-reply-" + randomID(),
+		pending:    map[string]chan Delivery{},
+		pendingMux: &sync.Mutex{},
+	}
+
+	options := getConsumeOptions(
+		WithConsumeOptionsQueueExclusive,
+		WithConsumeOptionsQueueAutoDelete,
+	)
+	options.ConsumerAutoAck = true
+	ctx, cancel := context.WithCancel(context.Background())
+	reconnectDone, err := consumer.startConsuming(
+		ctx,
+		contextHandler(client.handleReply),
+		client.replyQueue,
+		nil,
+		options,
+		&sync.WaitGroup{},
+	)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	client.consumeOptions = options
+	client.cancel = cancel
+	client.reconnectDone = reconnectDone
+	return client, nil
+}
+
+// Call publishes the body as a request to the exchange with the routing key and blocks until the
+// response is received, which is returned. If the context is done first ctx.Err() is returned
+func (client *RPCClient) Call(
+	ctx context.Context,
+	exchange string,
+	routingKey string,
+	body []byte,
+	optionFuncs ...func(*PublishOptions),
+) ([]byte, error) {
+	correlationID := randomID()
+	responseChan := make(chan Delivery, 1)
+	client.pendingMux.Lock()
+	client.pending[correlationID] = responseChan
+	client.pendingMux.Unlock()
+	defer func() {
+		client.pendingMux.Lock()
+		delete(client.pending, correlationID)
+		client.pendingMux.Unlock()
+	}()
+
+	optionFuncs = append(
+		optionFuncs,
+		WithPublishOptionsExchange(exchange),
+		WithPublishOptionsReplyTo(client.replyQueue),
+		WithPublishOptionsCorrelationID(correlationID),
+	)
+	err := client.publisher.PublishWithContext(ctx, body, []string{routingKey}, optionFuncs...)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case response := <-responseChan:
+		return response.Body, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops receiving responses, the publisher and the consumer are left open
+func (client *RPCClient) Close() {
+	client.cancel()
+	<-client.reconnectDone
+	client.consumer.cancelConsumer(client.consumeOptions)
+	client.consumer.forgetConsumer(client.consumeOptions.ConsumerName)
+}
+
+// handleReply passes the response on to the request waiting for it,
+// responses to requests that gave up waiting are dropped
+func (client *RPCClient) handleReply(d Delivery) bool {
+	client.pendingMux.Lock()
+	responseChan, ok := client.pending[d.CorrelationId]
+	client.pendingMux.Unlock()
+	if !ok {
+		client.consumer.logger.Warnf("dropping response with unknown correlation id %q", d.CorrelationId)
+		return true
+	}
+	select {
+	case responseChan <- d:
+	default:
+	}
+	return true
+}
+
+// RPCServer consumes requests and publishes the responses to the queue the requests were sent from
+type RPCServer struct {
+	consumer  Consumer
+	publisher *Publisher
+}
+
+// NewRPCServer returns a server receiving requests with the consumer and publishing the responses with the publisher
+func NewRPCServer(consumer Consumer, publisher *Publisher) *RPCServer {
+	return &RPCServer{
+		consumer:  consumer,
+		publisher: publisher,
+	}
+}
+
+// Serve starts consuming requests from the queue as StartConsuming does. The response returned by
+// the handler is published to the ReplyTo queue of the request with the same correlation id.
+// The request is nacked when the handler returns an error or the response can't be published
+func (server *RPCServer) Serve(
+	handler func(d Delivery) ([]byte, error),
+	queue string,
+	routingKeys []string,
+	optionFuncs ...func(*ConsumeOptions),
+) error {
+	return server.consumer.StartConsuming(
+		func(d Delivery) bool {
+			response, err := handler(d)
+			if err != nil {
+				server.consumer.logger.Errorf("rpc handler failed: %v", err)
+				return false
+			}
+			if d.ReplyTo == "" {
+				return true
+			}
+			err = server.publisher.Publish(
+				response,
+				[]string{d.ReplyTo},
+				WithPublishOptionsCorrelationID(d.CorrelationId),
+			)
+			if err != nil {
+				server.consumer.logger.Errorf("can't publish rpc response: %v", err)
+				return false
+			}
+			return true
+		},
+		queue,
+		routingKeys,
+		optionFuncs...,
+	)
+}
+
+// randomID returns a random identifier suitable for queue names and correlation ids
+func randomID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(errors.New("can't read random bytes: " + err.Error()))
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,116 @@
+package rabbitmq
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// stallCheckInterval is how often the stall detector checks the deliveries in flight
+const stallCheckInterval = time.Second
+
+// WithConsumeOptionsStallDetector returns a function that makes the consumer watch the deliveries that
+// were received but aren't handled yet, including the ones waiting for a handler. A warning is logged,
+// and the handler set by WithConsumeOptionsStallHandler called, when there are more than maxInFlight
+// of them or the oldest was received more than maxAge ago, which happens when handlers hang or can't
+// keep up. It's reported once until the deliveries in flight are back under the limits.
+// Zero disables either limit. With WithConsumeOptionsConsumerManualAck a delivery is considered
+// handled once the handler returns, even if it's settled later
+func WithConsumeOptionsStallDetector(maxInFlight int, maxAge time.Duration) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.StallMaxInFlight = maxInFlight
+		options.StallMaxAge = maxAge
+	}
+}
+
+// WithConsumeOptionsStallHandler returns a function that sets a handler called with the number of
+// deliveries in flight and the age of the oldest when the stall detector reports a stall
+func WithConsumeOptionsStallHandler(handle func(inFlight int, oldest time.Duration)) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		options.StallHandler = handle
+	}
+}
+
+// stallDetector records when the deliveries in flight were received
+type stallDetector struct {
+	maxInFlight int
+	maxAge      time.Duration
+	handle      func(inFlight int, oldest time.Duration)
+
+	mux      *sync.Mutex
+	nextID   uint64
+	inFlight map[uint64]time.Time
+}
+
+func newStallDetector(options ConsumeOptions) *stallDetector {
+	return &stallDetector{
+		maxInFlight: options.StallMaxInFlight,
+		maxAge:      options.StallMaxAge,
+		handle:      options.StallHandler,
+		mux:         &sync.Mutex{},
+		inFlight:    map[uint64]time.Time{},
+	}
+}
+
+// add records a delivery received at the given time and returns its id
+func (detector *stallDetector) add(received time.Time) uint64 {
+	detector.mux.Lock()
+	defer detector.mux.Unlock()
+	detector.nextID++
+	detector.inFlight[detector.nextID] = received
+	return detector.nextID
+}
+
+// remove forgets the delivery with the id once it's handled
+func (detector *stallDetector) remove(id uint64) {
+	detector.mux.Lock()
+	defer detector.mux.Unlock()
+	delete(detector.inFlight, id)
+}
+
+// state returns the number of deliveries in flight and the age of the oldest
+func (detector *stallDetector) state(now time.Time) (inFlight int, oldest time.Duration) {
+	detector.mux.Lock()
+	defer detector.mux.Unlock()
+	for _, received := range detector.inFlight {
+		age := now.Sub(received)
+		if age > oldest {
+			oldest = age
+		}
+	}
+	return len(detector.inFlight), oldest
+}
+
+// run checks the deliveries in flight periodically until the context is done
+func (detector *stallDetector) run(ctx context.Context, consumer Consumer, queue string) {
+	ticker := time.NewTicker(stallCheckInterval)
+	defer ticker.Stop()
+	stalled := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			inFlight, oldest := detector.state(now)
+			exceeded := (detector.maxInFlight > 0 && inFlight > detector.maxInFlight) ||
+				(detector.maxAge > 0 && oldest > detector.maxAge)
+			if exceeded && !stalled {
+				consumer.logger.Log(LogLevelWarn, "deliveries are piling up unhandled", map[string]interface{}{
+					"queue":     queue,
+					"in_flight": inFlight,
+					"oldest":    oldest,
+				})
+				if detector.handle != nil {
+					detector.handle(inFlight, oldest)
+				}
+			}
+			if !exceeded && stalled {
+				consumer.logger.Log(LogLevelInfo, "deliveries are handled again", map[string]interface{}{
+					"queue":     queue,
+					"in_flight": inFlight,
+				})
+			}
+			stalled = exceeded
+		}
+	}
+}
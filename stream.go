@@ -0,0 +1,77 @@
+package rabbitmq
+
+import (
+	"errors"
+	"time"
+)
+
+// defaultStreamPrefetch is the prefetch count WithConsumeOptionsStream sets
+// when none is set, since consuming a stream requires one
+const defaultStreamPrefetch = 100
+
+// WithConsumeOptionsStream declares the queue as a stream, an append-only log whose messages are
+// kept after being consumed so they can be read again from an offset, see WithConsumeOptionsStreamOffset.
+// Streams are durable and can't be exclusive or auto-deleted. Consuming them requires a prefetch count,
+// it's set to 100 unless one is set with WithConsumeOptionsQOSPrefetch, and deliveries can't be auto-acked
+func WithConsumeOptionsStream(options *ConsumeOptions) {
+	setQueueArg(options, "x-queue-type", "stream")
+	options.QueueDurable = true
+	if options.QOSPrefetch == 0 {
+		options.QOSPrefetch = defaultStreamPrefetch
+	}
+}
+
+// StreamOffset is the position in a stream the consumer starts reading from
+type StreamOffset struct {
+	value interface{}
+}
+
+var (
+	// StreamOffsetFirst starts from the first message still held by the stream
+	StreamOffsetFirst = StreamOffset{value: "first"}
+	// StreamOffsetLast starts from the last chunk of messages written to the stream
+	StreamOffsetLast = StreamOffset{value: "last"}
+	// StreamOffsetNext starts from the messages written after the consumer starts, it's the default
+	StreamOffsetNext = StreamOffset{value: "next"}
+)
+
+// StreamOffsetAt starts from the message with the given offset, the first message of a stream has offset 0
+func StreamOffsetAt(offset int64) StreamOffset {
+	return StreamOffset{value: offset}
+}
+
+// StreamOffsetTimestamp starts from the messages written to the stream at the given time,
+// with a precision of a second
+func StreamOffsetTimestamp(t time.Time) StreamOffset {
+	return StreamOffset{value: t}
+}
+
+// WithConsumeOptionsStreamOffset returns a function that makes the consumer of a stream start reading
+// from the offset. The offset of every delivery is given by Delivery.StreamOffset, so the application can
+// record the last one it handled and restart from the next one with StreamOffsetAt
+func WithConsumeOptionsStreamOffset(offset StreamOffset) func(*ConsumeOptions) {
+	return func(options *ConsumeOptions) {
+		setConsumerArg(options, "x-stream-offset", offset.value)
+	}
+}
+
+// StreamOffset returns the offset of a message delivered from a stream,
+// ok is false if the message doesn't come from a stream
+func (d Delivery) StreamOffset() (offset int64, ok bool) {
+	offset, ok = d.Headers["x-stream-offset"].(int64)
+	return offset, ok
+}
+
+// validateStreamOptions returns an error if options that streams don't support are set on a stream
+func validateStreamOptions(options ConsumeOptions) error {
+	if options.QueueExclusive || options.QueueAutoDelete {
+		return errors.New("a stream can't be exclusive or auto-deleted")
+	}
+	if options.ConsumerAutoAck {
+		return errors.New("deliveries from a stream can't be auto-acked")
+	}
+	if options.QOSPrefetch == 0 && options.AdaptivePrefetchMax == 0 {
+		return errors.New("consuming a stream requires a prefetch count")
+	}
+	return nil
+}
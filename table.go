@@ -1,41 +1,137 @@
 package rabbitmq
 
-import "github.com/streadway/amqp"
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
 
 // Table stores user supplied fields of the following types:
 //
-//   bool
-//   byte
-//   float32
-//   float64
-//   int
-//   int16
-//   int32
-//   int64
-//   nil
-//   string
-//   time.Time
-//   amqp.Decimal
-//   amqp.Table
-//   []byte
-//   []interface{} - containing above types
+//	bool
+//	byte
+//	float32
+//	float64
+//	int
+//	int16
+//	int32
+//	int64
+//	nil
+//	string
+//	time.Time
+//	amqp.Decimal
+//	amqp.Table
+//	[]byte
+//	[]interface{} - containing above types
 //
-// Functions taking a table will immediately fail when the table contains a
-// value of an unsupported type.
+// The other integer types are converted to the smallest of int16, int32 and int64 holding
+// them, an int is sent as an int32 when it fits, since RabbitMQ expects int32 for integer
+// values. Nested tables can be given as Table or map[string]interface{}, and arrays as
+// slices of any of the above types.
 //
-// The caller must be specific in which precision of integer it wishes to
-// encode.
+// Functions taking a table will immediately fail with a descriptive error when the table
+// contains a value of an unsupported type, instead of failing when the frame is encoded.
 //
 // Use a type assertion when reading values from a table for type conversion.
-//
-// RabbitMQ expects int32 for integer values.
-//
 type Table map[string]interface{}
 
-func tableToAMQPTable(table Table) amqp.Table {
-	new := amqp.Table{}
+// tableToAMQPTable validates the table and converts its values to the types amqp encodes
+func tableToAMQPTable(table Table) (amqp.Table, error) {
+	return convertTable("", table)
+}
+
+// copyTable returns a shallow copy of the table, for tables whose values are known to be valid
+func copyTable(table Table) amqp.Table {
+	copied := amqp.Table{}
 	for k, v := range table {
-		new[k] = v
+		copied[k] = v
+	}
+	return copied
+}
+
+func convertTable(path string, table map[string]interface{}) (amqp.Table, error) {
+	converted := amqp.Table{}
+	for k, v := range table {
+		field := k
+		if path != "" {
+			field = path + "." + k
+		}
+		value, err := convertField(field, v)
+		if err != nil {
+			return nil, err
+		}
+		converted[k] = value
+	}
+	return converted, nil
+}
+
+// convertField returns the value as one of the types supported in a table, path names
+// the field in the errors
+func convertField(path string, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, bool, byte, int16, int32, int64, float32, float64, string, []byte, amqp.Decimal, time.Time:
+		return v, nil
+	case int:
+		if v >= math.MinInt32 && v <= math.MaxInt32 {
+			return int32(v), nil
+		}
+		return int64(v), nil
+	case int8:
+		return int16(v), nil
+	case uint16:
+		return int32(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint:
+		return convertUint(path, uint64(v))
+	case uint64:
+		return convertUint(path, v)
+	case Table:
+		return convertTable(path, v)
+	case amqp.Table:
+		return convertTable(path, v)
+	case map[string]interface{}:
+		return convertTable(path, v)
+	case []interface{}:
+		return convertArray(path, reflect.ValueOf(v))
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		return convertArray(path, rv)
+	case reflect.Map:
+		if rv.Type().Key().Kind() == reflect.String {
+			table := map[string]interface{}{}
+			iter := rv.MapRange()
+			for iter.Next() {
+				table[iter.Key().String()] = iter.Value().Interface()
+			}
+			return convertTable(path, table)
+		}
+	}
+	return nil, fmt.Errorf("table field %s has unsupported type %T", path, value)
+}
+
+func convertUint(path string, v uint64) (interface{}, error) {
+	if v > math.MaxInt64 {
+		return nil, fmt.Errorf("table field %s value %d overflows int64", path, v)
+	}
+	return int64(v), nil
+}
+
+func convertArray(path string, rv reflect.Value) ([]interface{}, error) {
+	array := make([]interface{}, 0, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		value, err := convertField(path+"["+strconv.Itoa(i)+"]", rv.Index(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
 	}
-	return new
+	return array, nil
 }
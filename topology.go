@@ -0,0 +1,200 @@
+package rabbitmq
+
+import (
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// ExchangeOptions are used to describe an exchange to declare.
+// The exchange is created if it doesn't exist, unless Passive is set
+// in which case an error is returned instead.
+// AlternateExchange is where the exchange routes the messages it can't route,
+// DeclareAlternateExchange declares it as a fanout exchange as durable as this one
+type ExchangeOptions struct {
+	Name                     string
+	Kind                     string
+	Durable                  bool
+	AutoDelete               bool
+	Internal                 bool
+	NoWait                   bool
+	Passive                  bool
+	Args                     Table
+	AlternateExchange        string
+	DeclareAlternateExchange bool
+}
+
+// QueueOptions are used to describe a queue to declare.
+// The queue is created if it doesn't exist, unless Passive is set in which case
+// an error is returned instead. An empty name lets the server generate one
+type QueueOptions struct {
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	NoWait     bool
+	Passive    bool
+	Args       Table
+}
+
+// BindingOptions are used to describe a binding of a queue to an exchange
+type BindingOptions struct {
+	Queue      string
+	Exchange   string
+	RoutingKey string
+	NoWait     bool
+	Args       Table
+}
+
+// DeclareExchange declares the exchange without starting to consume
+func (consumer Consumer) DeclareExchange(options ExchangeOptions) error {
+	return consumer.chManager.declareExchange(options)
+}
+
+// DeclareQueue declares the queue without starting to consume, the returned
+// queue holds the name the server generated if none was given
+func (consumer Consumer) DeclareQueue(options QueueOptions) (amqp.Queue, error) {
+	return consumer.chManager.declareQueue(options)
+}
+
+// DeclareBinding binds the queue to the exchange without starting to consume
+func (consumer Consumer) DeclareBinding(options BindingOptions) error {
+	return consumer.chManager.declareBinding(options)
+}
+
+// DeclareExchange declares the exchange, which can be used to make sure
+// the exchange exists before publishing to it
+func (publisher *Publisher) DeclareExchange(options ExchangeOptions) error {
+	return publisher.chManager.declareExchange(options)
+}
+
+// DeclareQueue declares the queue, the returned queue holds
+// the name the server generated if none was given. The maximum priority of the queue
+// is remembered, so publishing a higher priority to it through the default exchange fails
+func (publisher *Publisher) DeclareQueue(options QueueOptions) (amqp.Queue, error) {
+	queue, err := publisher.chManager.declareQueue(options)
+	if err != nil {
+		return queue, err
+	}
+	max, _ := maxPriority(options.Args)
+	publisher.queuePrioritiesMux.Lock()
+	defer publisher.queuePrioritiesMux.Unlock()
+	if max > 0 {
+		publisher.queuePriorities[queue.Name] = max
+	} else {
+		delete(publisher.queuePriorities, queue.Name)
+	}
+	return queue, nil
+}
+
+// DeclareBinding binds the queue to the exchange
+func (publisher *Publisher) DeclareBinding(options BindingOptions) error {
+	return publisher.chManager.declareBinding(options)
+}
+
+func (chManager *channelManager) declareExchange(options ExchangeOptions) error {
+	chManager.channelMux.RLock()
+	defer chManager.channelMux.RUnlock()
+	return declareExchangeOn(chManager.channel, options)
+}
+
+// declareExchangeOn declares the exchange on the channel. The caller must hold the channel lock
+func declareExchangeOn(channel *amqp.Channel, options ExchangeOptions) error {
+	if options.Name == "" {
+		return fmt.Errorf("declaring exchange but name not specified")
+	}
+	kind := options.Kind
+	if kind == "" {
+		kind = amqp.ExchangeDirect
+	}
+	args := options.Args
+	if options.AlternateExchange != "" {
+		args = alternateExchangeArgs(args, options.AlternateExchange)
+	}
+	amqpArgs, err := tableToAMQPTable(args)
+	if err != nil {
+		return fmt.Errorf("invalid arguments for exchange %s: %w", options.Name, err)
+	}
+	if options.DeclareAlternateExchange && options.AlternateExchange != "" {
+		err := declareAlternateExchange(channel, options.AlternateExchange, options.Durable)
+		if err != nil {
+			return wrapError(err)
+		}
+	}
+	declare := channel.ExchangeDeclare
+	if options.Passive {
+		declare = channel.ExchangeDeclarePassive
+	}
+	err = declare(
+		options.Name,
+		kind,
+		options.Durable,
+		options.AutoDelete,
+		options.Internal,
+		options.NoWait,
+		amqpArgs,
+	)
+	return wrapError(err)
+}
+
+// alternateExchangeArgs returns a copy of the arguments of an exchange with the alternate exchange set
+func alternateExchangeArgs(args Table, alternateExchange string) Table {
+	withAlternate := Table{}
+	for key, value := range args {
+		withAlternate[key] = value
+	}
+	withAlternate["alternate-exchange"] = alternateExchange
+	return withAlternate
+}
+
+// declareAlternateExchange declares the fanout exchange unroutable messages are sent to,
+// so every queue bound to it gets them. The caller must hold the channel lock
+func declareAlternateExchange(channel *amqp.Channel, name string, durable bool) error {
+	return channel.ExchangeDeclare(name, amqp.ExchangeFanout, durable, false, false, false, nil)
+}
+
+func (chManager *channelManager) declareQueue(options QueueOptions) (amqp.Queue, error) {
+	_, err := maxPriority(options.Args)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	args, err := tableToAMQPTable(options.Args)
+	if err != nil {
+		return amqp.Queue{}, fmt.Errorf("invalid arguments for queue %s: %w", options.Name, err)
+	}
+	chManager.channelMux.RLock()
+	defer chManager.channelMux.RUnlock()
+	declare := chManager.channel.QueueDeclare
+	if options.Passive {
+		declare = chManager.channel.QueueDeclarePassive
+	}
+	queue, err := declare(
+		options.Name,
+		options.Durable,
+		options.AutoDelete,
+		options.Exclusive,
+		options.NoWait,
+		args,
+	)
+	return queue, wrapError(err)
+}
+
+func (chManager *channelManager) declareBinding(options BindingOptions) error {
+	if options.Exchange == "" {
+		return fmt.Errorf("binding to exchange but name not specified")
+	}
+	args, err := tableToAMQPTable(options.Args)
+	if err != nil {
+		return fmt.Errorf("invalid binding arguments: %w", err)
+	}
+	chManager.channelMux.RLock()
+	defer chManager.channelMux.RUnlock()
+	err = chManager.channel.QueueBind(
+		options.Queue,
+		options.RoutingKey,
+		options.Exchange,
+		options.NoWait,
+		args,
+	)
+	return wrapError(err)
+}
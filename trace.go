@@ -0,0 +1,49 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+)
+
+// Propagator is the interface used to carry a trace context in the headers of the messages,
+// such as the W3C traceparent and tracestate headers. It can be set using
+// WithPublisherOptionsPropagator() or WithConsumerOptionsPropagator().
+// HeaderCarrier implements the carrier interface of OpenTelemetry's propagation package,
+// so an OpenTelemetry propagator only needs a thin wrapper to be used
+type Propagator interface {
+	// Inject writes the trace context of ctx into the carrier
+	Inject(ctx context.Context, carrier HeaderCarrier)
+	// Extract returns a copy of ctx with the trace context read from the carrier
+	Extract(ctx context.Context, carrier HeaderCarrier) context.Context
+}
+
+// HeaderCarrier exposes the headers of a message as text key/value pairs
+type HeaderCarrier Table
+
+// Get returns the value of the header as a string, or an empty string if it isn't set
+func (c HeaderCarrier) Get(key string) string {
+	switch value := c[key].(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case []byte:
+		return string(value)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// Set sets the header to the given value
+func (c HeaderCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+// Keys lists the names of the headers
+func (c HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,101 @@
+package rabbitmq
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrTxChannelLost is returned when the publisher reconnected during a transaction. The publishings
+// held by the previous channel are lost, and publishing is refused until the transaction is ended,
+// since the new channel would route the messages right away
+var ErrTxChannelLost = errors.New("publisher reconnected during the transaction, its publishings were lost")
+
+// publisherTx tracks the transaction of a transactional publisher
+type publisherTx struct {
+	mux *sync.Mutex
+	// selected is the channel put in transaction mode, begun the one
+	// the current transaction was begun on, or nil if there is none
+	selected *amqp.Channel
+	begun    *amqp.Channel
+}
+
+// WithPublisherOptionsTransactional lets the publisher use AMQP transactions with BeginTx,
+// CommitTx and RollbackTx, the publishings are held by the server until they're committed.
+// A commit waits for the server to write the messages, which is much slower than publisher
+// confirms that can be waited on for many publishings at once, so confirms should be preferred
+// unless transactions are required. It can't be used with WithPublisherOptionsConfirm
+func WithPublisherOptionsTransactional(options *PublisherOptions) {
+	options.Transactional = true
+}
+
+// BeginTx begins a transaction, the publishings that follow are only routed once CommitTx is called.
+// The channel stays in transaction mode, so publishings made on it after a commit or a rollback are
+// held until the next commit too. A channel obtained by reconnecting is only put in transaction mode
+// by the next BeginTx, so the publishings made in between are routed right away. If the publisher
+// reconnects during a transaction, publishing fails with ErrTxChannelLost until CommitTx or RollbackTx
+// ends it. The transaction is shared by everything publishing with the publisher, so it must only
+// be used by one goroutine at a time
+func (publisher *Publisher) BeginTx() error {
+	if publisher.tx == nil {
+		return errors.New("publisher is not transactional, use WithPublisherOptionsTransactional")
+	}
+	publisher.tx.mux.Lock()
+	defer publisher.tx.mux.Unlock()
+	publisher.chManager.channelMux.RLock()
+	defer publisher.chManager.channelMux.RUnlock()
+	channel := publisher.chManager.channel
+	if publisher.tx.selected != channel {
+		err := channel.Tx()
+		if err != nil {
+			return wrapError(err)
+		}
+		publisher.tx.selected = channel
+	}
+	publisher.tx.begun = channel
+	return nil
+}
+
+// CommitTx commits the transaction begun with BeginTx. If the publisher reconnected in the
+// meantime an error is returned, since the publishings held by the previous channel are lost
+func (publisher *Publisher) CommitTx() error {
+	return publisher.endTx(func(channel *amqp.Channel) error {
+		return channel.TxCommit()
+	})
+}
+
+// RollbackTx drops the publishings of the transaction begun with BeginTx
+func (publisher *Publisher) RollbackTx() error {
+	return publisher.endTx(func(channel *amqp.Channel) error {
+		return channel.TxRollback()
+	})
+}
+
+// endTx ends the current transaction with fn, on the channel it was begun on
+func (publisher *Publisher) endTx(fn func(channel *amqp.Channel) error) error {
+	if publisher.tx == nil {
+		return errors.New("publisher is not transactional, use WithPublisherOptionsTransactional")
+	}
+	publisher.tx.mux.Lock()
+	defer publisher.tx.mux.Unlock()
+	begun := publisher.tx.begun
+	if begun == nil {
+		return errors.New("no transaction begun, use BeginTx")
+	}
+	publisher.tx.begun = nil
+	publisher.chManager.channelMux.RLock()
+	defer publisher.chManager.channelMux.RUnlock()
+	if publisher.chManager.channel != begun {
+		return ErrTxChannelLost
+	}
+	return wrapError(fn(begun))
+}
+
+// lost reports whether a transaction was begun on another channel than the given one,
+// in which case publishing on it would escape the transaction
+func (tx *publisherTx) lost(channel *amqp.Channel) bool {
+	tx.mux.Lock()
+	defer tx.mux.Unlock()
+	return tx.begun != nil && tx.begun != channel
+}